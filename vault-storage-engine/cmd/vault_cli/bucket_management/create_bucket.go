@@ -5,22 +5,42 @@ import (
 	"fmt"
 
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/erasurecoding"
 	"github.com/urfave/cli/v2"
 )
 
 func NewBucketCommand(c *cli.Context, db *sql.DB) error {
-	if c.NArg() != 2 {
-		return fmt.Errorf("usage: create-bucket <bucket_id> <owner_id>")
+	args := c.Args().Slice()
+	// A trailing "dedup" creates a deduplicated bucket
+	dedup := len(args) > 2 && args[len(args)-1] == "dedup"
+	if dedup {
+		args = args[:len(args)-1]
 	}
+	if len(args) != 2 && len(args) != 3 {
+		return fmt.Errorf("usage: create-bucket <bucket_id> <owner_id> [erasure_profile] [dedup]")
+	}
+
+	bucketID := args[0]
+	ownerID := args[1]
 
-	bucketID := c.Args().Get(0)
-	ownerID := c.Args().Get(1)
+	// The profile is a name (scratch, standard, archive, media) or <data>+<parity>, like 6+3
+	var profileName string
+	if len(args) == 3 {
+		profileName = args[2]
+	}
+	profile, err := erasurecoding.ParseProfile(profileName)
+	if err != nil {
+		return err
+	}
 
-	err := bucket.CreateBucket(db, bucketID, ownerID)
+	err = bucket.CreateBucketWithOptions(db, bucketID, ownerID, profile, dedup)
 	if err != nil {
 		return fmt.Errorf("failed to create new bucket, %w", err)
 	}
-	fmt.Printf("Succcessfully created bucket: \"%s\" for \"%s\"\n", bucketID, ownerID)
+	fmt.Printf("Succcessfully created bucket: \"%s\" for \"%s\" with erasure profile %s\n", bucketID, ownerID, profile)
+	if dedup {
+		fmt.Println("Versions stored in the bucket are deduplicated")
+	}
 
 	return nil
 }
@@ -0,0 +1,90 @@
+package key_cli
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/datastorage"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+)
+
+// RotateKeyCommand creates a new key encryption key version and re-wraps every data key under it
+// If the re-wrap is interrupted, running rewrap-keys (or the API gateway's background job) resumes it
+func RotateKeyCommand(c *cli.Context, db *sql.DB, cfg *config.Config, logger *zap.Logger) error {
+	if c.NArg() != 0 {
+		return fmt.Errorf("usage: rotate-key")
+	}
+
+	keyID, err := datastorage.RotateKey(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to rotate key, %w", err)
+	}
+	fmt.Printf("Rotated key encryption key, new key version: %s\n", keyID)
+
+	return RewrapKeysCommand(c, db, cfg, logger)
+}
+
+// RewrapKeysCommand re-wraps every data key under the current key encryption key, along with the manifests holding them
+func RewrapKeysCommand(c *cli.Context, db *sql.DB, cfg *config.Config, logger *zap.Logger) error {
+	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
+	rewrapped, err := datastorage.RewrapDataKeys(db, store, cfg, logger)
+	fmt.Printf("Re-wrapped %d data keys\n", rewrapped)
+	if err != nil {
+		return fmt.Errorf("re-wrap stopped, run rewrap-keys to resume: %w", err)
+	}
+
+	return KeyStatusCommand(c, db)
+}
+
+// RetireKeyCommand drops a key version from the keyring once every data key was re-wrapped under a newer one
+// The manifests are rewritten by rewrap-keys before the database, so they never hold a retired key
+func RetireKeyCommand(c *cli.Context, db *sql.DB, cfg *config.Config) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("usage: retire-key <key_id>")
+	}
+	keyID := c.Args().First()
+
+	if err := datastorage.RetireKey(db, cfg, keyID); err != nil {
+		return fmt.Errorf("failed to retire key, %w", err)
+	}
+	fmt.Printf("Retired key version %s\n", keyID)
+	return nil
+}
+
+// KeyStatusCommand reports how many versions and deduplicated chunks use each key version
+func KeyStatusCommand(c *cli.Context, db *sql.DB) error {
+	versions, err := bucket.CountVersionsByKey(db)
+	if err != nil {
+		return fmt.Errorf("failed to count versions by key, %w", err)
+	}
+	chunks, err := bucket.CountChunksByKey(db)
+	if err != nil {
+		return fmt.Errorf("failed to count chunks by key, %w", err)
+	}
+
+	fmt.Println("Versions by key version:")
+	printCounts(versions, "no stored versions")
+	fmt.Println("Chunks by key version:")
+	printCounts(chunks, "no stored chunks")
+	return nil
+}
+
+func printCounts(counts map[string]int, empty string) {
+	var keyIDs []string
+	for keyID := range counts {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Strings(keyIDs)
+
+	for _, keyID := range keyIDs {
+		fmt.Printf("* %s: %d\n", keyID, counts[keyID])
+	}
+	if len(keyIDs) == 0 {
+		fmt.Println(empty)
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/datastorage"
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
-	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/utils"
 	"github.com/google/uuid"
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
@@ -24,10 +23,11 @@ func StoreCommand(c *cli.Context, db *sql.DB, cfg *config.Config, logger *zap.Lo
 	bucketID := c.Args().Get(0)
 	filePath := c.Args().Get(1)
 
-	data, err := os.ReadFile(filePath)
+	data, err := os.Open(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to read file: %w", err)
 	}
+	defer data.Close()
 
 	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
 	locations := []string{
@@ -43,19 +43,12 @@ func StoreCommand(c *cli.Context, db *sql.DB, cfg *config.Config, logger *zap.Lo
 	objectID := uuid.New().String() // Generate a unique object ID
 
 	// Shard and store data
-	_, shardLocations, proofs, err := datastorage.StoreData(db, data, bucketID, objectID, filepath.Base(filePath), store, cfg, locations, logger)
+	// Versions of deduplicated buckets have no shards or proofs of their own, their chunks do
+	_, _, _, err = datastorage.StoreDataStream(db, data, bucketID, objectID, filepath.Base(filePath), store, cfg, locations, logger)
 	if err != nil {
 		return fmt.Errorf("store failed: %w", err)
 	}
 
-	// Convert proofs from []string to map[string]string
-	proofsMap := utils.ConvertSliceToMap(proofs)
-
-	// Validate that shardLocations and proofsMap are correctly populated
-	if len(shardLocations) == 0 || len(proofsMap) == 0 {
-		return fmt.Errorf("store failed: shardLocations or proofsMap cannot be empty")
-	}
-
 	owner := "default_owner" // Replace with actual owner if available
 	err = bucket.CreateBucket(db, bucketID, owner)
 	if err != nil {
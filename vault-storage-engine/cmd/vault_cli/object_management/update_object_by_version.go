@@ -35,10 +35,11 @@ func UpdateByVersion(c *cli.Context, db *sql.DB, cfg *config.Config, logger *zap
 	// go ahead and store it accorfingly
 	if originalFile == getfile {
 		fmt.Printf("Object (%s) exists. Proceeding to update ...\n", objectID)
-		data, err := os.ReadFile(originalFile)
+		data, err := os.Open(originalFile)
 		if err != nil {
 			return fmt.Errorf("failed to read file: %w", err)
 		}
+		defer data.Close()
 
 		// Setup a storage component for handling shards
 		store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
@@ -54,7 +55,7 @@ func UpdateByVersion(c *cli.Context, db *sql.DB, cfg *config.Config, logger *zap
 		}
 
 		// make use of the predefined versionID returned by UpdateFileVersionIfItExists
-		_, _, _, err = datastorage.StoreDataWithVersion(db, data, bucketID, objectID, version, filepath.Base(originalFile), store, cfg, locations, logger)
+		_, _, _, err = datastorage.StoreDataStreamWithVersion(db, data, bucketID, objectID, version, filepath.Base(originalFile), store, cfg, locations, logger)
 		if err != nil {
 			return fmt.Errorf("failed to store updated object, %w", err)
 		}
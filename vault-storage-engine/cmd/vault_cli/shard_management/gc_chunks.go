@@ -0,0 +1,27 @@
+package shard_cli
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/datastorage"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+)
+
+// GCChunksCommand deletes the chunks of deduplicated buckets that no version refers to anymore
+func GCChunksCommand(c *cli.Context, db *sql.DB, cfg *config.Config, logger *zap.Logger) error {
+	if c.NArg() != 0 {
+		return fmt.Errorf("usage: gc-chunks")
+	}
+
+	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
+	collected, err := datastorage.CollectChunks(db, store, logger)
+	fmt.Printf("Deleted %d unreferenced chunks\n", collected)
+	if err != nil {
+		return fmt.Errorf("garbage collection stopped, run gc-chunks again to resume: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package shard_cli
+
+import (
+	"fmt"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"github.com/urfave/cli/v2"
+)
+
+// MigrateShardLayoutCommand moves the shards of a local shard store from the flat layout to the fan-out layout
+// The shard store defaults to shard_store_base_path, storage nodes keep theirs at SHARD_STORE_BASE_PATH,
+// nothing may be using the store while it is migrated
+func MigrateShardLayoutCommand(c *cli.Context, cfg *config.Config) error {
+	if c.NArg() > 1 {
+		return fmt.Errorf("usage: migrate-shard-layout [shard-store-path]")
+	}
+	basePath := cfg.ShardStoreBasePath
+	if c.NArg() == 1 {
+		basePath = c.Args().Get(0)
+	}
+	if basePath == "" {
+		return fmt.Errorf("no shard store path given and shard_store_base_path is not set")
+	}
+
+	result, err := sharding.MigrateFlatLayout(basePath)
+	fmt.Printf("Migrated %d shards in %s\n", result.Migrated, basePath)
+	for _, path := range result.Conflicts {
+		fmt.Printf("* left %s in place, a shard is already stored at its new path\n", path)
+	}
+	if err != nil {
+		return fmt.Errorf("migration stopped, run migrate-shard-layout again to resume: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package shard_cli
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/datastorage"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/manifest"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+)
+
+// RecoverMetadataCommand rebuilds the database from the manifests kept next to the shards
+// It crawls the local shard locations, the configured ones by default, or the storage nodes, those registered with discovery by default
+// Versions already recorded are left as they are, so it is safe to run against a database that survived in part
+// Manifests have to be signed by a key given with --public-key or listed in manifest_public_keys,
+// the node key isn't trusted since it is created anew when it was lost along with the database
+func RecoverMetadataCommand(c *cli.Context, db *sql.DB, cfg *config.Config, logger *zap.Logger) error {
+	if c.NArg() == 0 {
+		return fmt.Errorf("usage: recover-metadata [--public-key key] local [location...] or recover-metadata [--public-key key] nodes [node_url...]")
+	}
+	targets := c.Args().Slice()[1:]
+
+	trusted, err := recoveryKeys(c.StringSlice("public-key"), cfg)
+	if err != nil {
+		return err
+	}
+
+	var report *datastorage.RecoveryReport
+	switch c.Args().First() {
+	case "local":
+		if len(targets) == 0 {
+			targets = cfg.ShardLocations
+		}
+		store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
+		report, err = datastorage.RecoverMetadata(db, store, targets, trusted, logger)
+	case "nodes":
+		if len(targets) == 0 {
+			targets, err = datastorage.LookupStorageNodes(logger)
+			if err != nil {
+				return fmt.Errorf("failed to lookup storage nodes: %w", err)
+			}
+		}
+		report, err = datastorage.RecoverMetadataFromNodes(db, targets, trusted, logger)
+	default:
+		return fmt.Errorf("usage: recover-metadata [--public-key key] local [location...] or recover-metadata [--public-key key] nodes [node_url...]")
+	}
+	if report != nil {
+		printRecoveryReport(report)
+	}
+	if err != nil {
+		return fmt.Errorf("recovery stopped, run recover-metadata again to resume: %w", err)
+	}
+	return nil
+}
+
+// recoveryKeys returns the keys given on the command line, or those of the configuration when none is given
+func recoveryKeys(args []string, cfg *config.Config) ([]ed25519.PublicKey, error) {
+	if len(args) == 0 {
+		args = cfg.ManifestPublicKeys
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%w, give one with --public-key or set manifest_public_keys", datastorage.ErrNoTrustedKey)
+	}
+
+	var keys []ed25519.PublicKey
+	for _, arg := range args {
+		pub, err := manifest.ParsePublicKey(arg)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, pub)
+	}
+	return keys, nil
+}
+
+func printRecoveryReport(report *datastorage.RecoveryReport) {
+	fmt.Println("Crawled locations:")
+	for _, location := range report.Locations {
+		if location.Err != "" {
+			fmt.Printf("* %s: unreachable, %s\n", location.Location, location.Err)
+			continue
+		}
+		fmt.Printf("* %s: %d shards, %d manifests\n", location.Location, location.Shards, location.Manifests)
+	}
+
+	fmt.Printf("Restored %d versions and %d chunks, %d versions were already recorded\n", report.VersionsRestored, report.ChunksRestored, report.VersionsExisting)
+	if len(report.BucketsCreated) > 0 {
+		fmt.Printf("Created buckets: %s\n", strings.Join(report.BucketsCreated, ", "))
+	}
+
+	if len(report.Incomplete) > 0 {
+		fmt.Printf("Incomplete (%d):\n", len(report.Incomplete))
+		for _, v := range report.Incomplete {
+			fmt.Printf("* %s %s/%s:", v.Kind, v.ObjectID, v.VersionID)
+			if len(v.MissingChunks) > 0 {
+				fmt.Printf(" missing chunks %s", strings.Join(v.MissingChunks, ", "))
+			}
+			if len(v.MissingShards) > 0 {
+				fmt.Printf(" missing shards %v", v.MissingShards)
+			}
+			if len(v.TruncatedShards) > 0 {
+				fmt.Printf(" truncated shards %v", v.TruncatedShards)
+			}
+			if len(v.UncheckedShards) > 0 {
+				fmt.Printf(" unchecked shards %v", v.UncheckedShards)
+			}
+			if v.Stripes > 0 {
+				fmt.Printf(", %d of %d stripes incomplete, %d unreadable", v.IncompleteStripes, v.Stripes, v.UnreadableStripes)
+			}
+			fmt.Println()
+		}
+	}
+
+	if len(report.Conflicts) > 0 {
+		fmt.Printf("Conflicts (%d):\n", len(report.Conflicts))
+		for _, conflict := range report.Conflicts {
+			fmt.Printf("* %s/%s: %s\n", conflict.ObjectID, conflict.VersionID, conflict.Reason)
+		}
+	}
+
+	if len(report.InvalidManifests) > 0 {
+		fmt.Printf("Invalid manifests (%d):\n", len(report.InvalidManifests))
+		for _, invalid := range report.InvalidManifests {
+			fmt.Printf("* %s/%s on %s: %s\n", invalid.ObjectID, invalid.VersionID, invalid.Location, invalid.Err)
+		}
+	}
+
+	if len(report.Orphans) > 0 {
+		fmt.Printf("Orphan shards (%d):\n", len(report.Orphans))
+		for _, orphan := range report.Orphans {
+			fmt.Printf("* %s\n", orphan)
+		}
+	}
+}
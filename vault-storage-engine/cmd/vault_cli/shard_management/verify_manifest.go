@@ -0,0 +1,160 @@
+package shard_cli
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/datastorage"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/manifest"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+)
+
+// VerifyManifestCommand checks the signature of a manifest file, or of every stored copy of the manifest of a version
+// Manifests have to be signed by the given public key, or by the node key when none is given
+func VerifyManifestCommand(c *cli.Context, db *sql.DB, cfg *config.Config, logger *zap.Logger) error {
+	usage := fmt.Errorf("usage: verify-manifest <manifest_file> [public_key] or verify-manifest <object_id> <version_id> [public_key]")
+	if c.NArg() == 0 {
+		return usage
+	}
+
+	// A manifest file is given when the first argument is an existing file
+	if info, err := os.Stat(c.Args().Get(0)); err == nil && info.Mode().IsRegular() {
+		if c.NArg() > 2 {
+			return usage
+		}
+		trusted, err := trustedKey(c.Args().Get(1), cfg)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(c.Args().Get(0))
+		if err != nil {
+			return fmt.Errorf("failed to read manifest: %w", err)
+		}
+		m, err := verifyManifest(data, trusted)
+		if err != nil {
+			return err
+		}
+		printManifest(m)
+		return nil
+	}
+
+	if c.NArg() < 2 || c.NArg() > 3 {
+		return usage
+	}
+	objectID := c.Args().Get(0)
+	versionID := c.Args().Get(1)
+	trusted, err := trustedKey(c.Args().Get(2), cfg)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
+	copies, err := datastorage.ReadManifests(db, objectID, versionID, store, logger)
+	if err != nil {
+		return err
+	}
+
+	valid := 0
+	for _, stored := range copies {
+		fmt.Printf("%s: ", stored.Location)
+		if stored.Err != nil {
+			fmt.Printf("unreadable, %v\n", stored.Err)
+			continue
+		}
+		m, err := verifyManifest(stored.Data, trusted)
+		if err != nil {
+			fmt.Printf("invalid, %v\n", err)
+			continue
+		}
+		if m.Kind != manifest.KindVersion || m.Version == nil || m.ObjectID != objectID || m.VersionID != versionID {
+			fmt.Printf("invalid, the manifest describes %s %s/%s\n", m.Kind, m.ObjectID, m.VersionID)
+			continue
+		}
+		if m.Version.MerkleRoot != metadata.MerkleRoot {
+			fmt.Printf("valid signature, but its Merkle root %s doesn't match the database (%s)\n", m.Version.MerkleRoot, metadata.MerkleRoot)
+			continue
+		}
+		fmt.Println("valid")
+		valid++
+	}
+	fmt.Printf("%d of %d manifest copies are valid\n", valid, len(copies))
+	if valid == 0 {
+		return fmt.Errorf("no valid manifest for %s/%s", objectID, versionID)
+	}
+	return nil
+}
+
+// ManifestKeyCommand prints the public key of the node key, the key to list in manifest_public_keys
+func ManifestKeyCommand(c *cli.Context, cfg *config.Config) error {
+	if c.NArg() != 0 {
+		return fmt.Errorf("usage: manifest-key")
+	}
+
+	key, err := manifest.LoadOrCreateKey(datastorage.ManifestKeyPath(cfg))
+	if err != nil {
+		return fmt.Errorf("failed to load node key: %w", err)
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	fmt.Printf("Key ID: %s\nPublic key: %s\n", manifest.KeyID(pub), hex.EncodeToString(pub))
+	return nil
+}
+
+// trustedKey returns the key manifests have to be signed with, the node key is used when arg is empty
+// A manifest is never trusted for the key it carries, so there has to be one or the other
+func trustedKey(arg string, cfg *config.Config) ([]ed25519.PublicKey, error) {
+	if arg != "" {
+		pub, err := manifest.ParsePublicKey(arg)
+		if err != nil {
+			return nil, err
+		}
+		return []ed25519.PublicKey{pub}, nil
+	}
+
+	path := datastorage.ManifestKeyPath(cfg)
+	key, err := manifest.LoadKey(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no node key at %s, give the public key manifests have to be signed with", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []ed25519.PublicKey{key.Public().(ed25519.PublicKey)}, nil
+}
+
+func verifyManifest(data []byte, trusted []ed25519.PublicKey) (*manifest.Manifest, error) {
+	signed, err := manifest.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	m, err := signed.Verify(trusted...)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("signed by key %s, ", signed.KeyID)
+	return m, nil
+}
+
+func printManifest(m *manifest.Manifest) {
+	fmt.Println("valid")
+	fmt.Printf("* kind: %s\n* bucket: %s\n* object: %s\n* version: %s\n* created at: %s\n", m.Kind, m.BucketID, m.ObjectID, m.VersionID, m.CreatedAt)
+	switch {
+	case m.Version != nil:
+		fmt.Printf("* filename: %s\n* size: %s\n* merkle root: %s\n", m.Version.Filename, m.Version.Filesize, m.Version.MerkleRoot)
+	case m.Chunk != nil:
+		fmt.Printf("* hash: %s\n* size: %d\n* merkle root: %s\n", m.Chunk.Hash, m.Chunk.Size, m.Chunk.Metadata.MerkleRoot)
+	case len(m.Chunks) > 0:
+		fmt.Printf("* chunks: %d\n", len(m.Chunks))
+	}
+}
@@ -3,11 +3,11 @@ module github.com/getvaultapp/storage-engine/vault-storage-engine
 go 1.23.6
 
 require (
-	github.com/cbergoon/merkletree v0.2.0
 	github.com/gin-gonic/gin v1.10.0
 	github.com/golang-jwt/jwt/v5 v5.2.1
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/mux v1.8.1
+	github.com/klauspost/compress v1.17.11
 	github.com/klauspost/reedsolomon v1.12.4
 	github.com/mattn/go-sqlite3 v1.14.24
 	github.com/pierrec/lz4/v4 v4.1.22
@@ -0,0 +1,86 @@
+// Auditor service, challenges random shards kept by storage nodes and scores the nodes on their answers
+// The scores are kept in the metadata database, where placement picks the nodes new shards are sent to
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/datastorage"
+	_ "github.com/mattn/go-sqlite3"
+	"go.uber.org/zap"
+)
+
+func main() {
+	logger, err := zap.NewProduction()
+	if err != nil {
+		log.Fatalf("Logger error: %v", err)
+	}
+
+	db, err := bucket.InitDB()
+	if err != nil {
+		logger.Fatal("DB connection error", zap.Error(err))
+	}
+	defer db.Close()
+
+	interval := 5 * time.Minute
+	if v := os.Getenv("AUDIT_INTERVAL"); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil {
+			logger.Fatal("Invalid AUDIT_INTERVAL", zap.Error(err))
+		}
+	}
+	batch := 20
+	if v := os.Getenv("AUDIT_BATCH"); v != "" {
+		if batch, err = strconv.Atoi(v); err != nil || batch <= 0 {
+			logger.Fatal("Invalid AUDIT_BATCH", zap.String("value", v))
+		}
+	}
+
+	go runAudits(db, interval, batch, logger)
+
+	http.HandleFunc("/scores", func(w http.ResponseWriter, r *http.Request) {
+		scores, err := bucket.GetNodeScores(db)
+		if err != nil {
+			http.Error(w, "Failed to get node scores", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(scores)
+	})
+
+	port := os.Getenv("AUDITOR_PORT")
+	if port == "" {
+		port = "8600"
+	}
+	logger.Info("Starting auditor", zap.String("port", port), zap.Duration("interval", interval), zap.Int("batch", batch))
+	log.Fatal(http.ListenAndServe(":"+port, nil))
+}
+
+// runAudits challenges a batch of random shards every interval
+func runAudits(db *sql.DB, interval time.Duration, batch int, logger *zap.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		results, err := datastorage.AuditNodes(db, batch, logger)
+		if err != nil {
+			logger.Error("Audit failed", zap.Error(err))
+		}
+
+		failed := 0
+		for _, result := range results {
+			if result.Outcome != bucket.AuditPassed {
+				failed++
+			}
+		}
+		logger.Info("Audited storage nodes", zap.Int("challenges", len(results)), zap.Int("failed", failed))
+
+		<-ticker.C
+	}
+}
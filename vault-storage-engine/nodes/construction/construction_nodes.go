@@ -9,6 +9,7 @@ import (
 	"io"
 	"log"
 	"math/rand"
+	"mime"
 	"net/http"
 	"os"
 	"sync"
@@ -184,24 +185,25 @@ var (
 )
 
 // PendingTask represents a file processing task.
+// The file is spooled to DataPath so that queued tasks don't hold objects in memory
 type PendingTask struct {
 	BuucketID string
 	ObjectID  string
 	VersionID string
-	Data      []byte
+	DataPath  string
 	FileName  string
 	CreatedAt time.Time
 	Assigned  bool
 }
 
-func registerTask(bucketID, objectID, versionID, fileName string, data []byte) {
+func registerTask(bucketID, objectID, versionID, fileName, dataPath string) {
 	taskQueueMu.Lock()
 	defer taskQueueMu.Unlock()
 	taskQueue[objectID] = PendingTask{
 		BuucketID: bucketID,
 		ObjectID:  objectID,
 		VersionID: versionID,
-		Data:      data,
+		DataPath:  dataPath,
 		FileName:  fileName,
 		CreatedAt: time.Now(),
 		Assigned:  false,
@@ -242,11 +244,6 @@ func handleInfo(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleProcessFile(w http.ResponseWriter, r *http.Request, db *sql.DB, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) {
-	data, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read file", http.StatusBadRequest)
-		return
-	}
 	defer r.Body.Close()
 
 	// Get the objectID, bucketID and filename from the request
@@ -258,28 +255,53 @@ func handleProcessFile(w http.ResponseWriter, r *http.Request, db *sql.DB, store
 		return
 	}
 
+	// The file is processed after we respond, so it is spooled to disk instead of memory
+	spool, err := os.CreateTemp("", "vault-task-*")
+	if err != nil {
+		http.Error(w, "Failed to spool file", http.StatusInternalServerError)
+		return
+	}
+	_, err = io.Copy(spool, r.Body)
+	spool.Close()
+	if err != nil {
+		os.Remove(spool.Name())
+		http.Error(w, "Failed to read file", http.StatusBadRequest)
+		return
+	}
+
 	// Generate a new version ID.
 	versionID := uuid.New().String()
 
 	// Register the task in our queue
-	registerTask(bucketID, objectID, versionID, fileName, data)
+	registerTask(bucketID, objectID, versionID, fileName, spool.Name())
 
 	// Instead of immediately processing, we could implement a work queue
 	// But for now, let's claim and process the task immediately
 	task, ok := claimTask(objectID)
 	if !ok {
+		os.Remove(spool.Name())
 		http.Error(w, "Task already assigned", http.StatusConflict)
 		return
 	}
 
 	// Process the task asynchronously
 	go func() {
+		defer os.Remove(task.DataPath)
+
+		data, err := os.Open(task.DataPath)
+		if err != nil {
+			logger.Error("Failed to open spooled file", zap.Error(err))
+			return
+		}
+		defer data.Close()
+
 		// Use the new distributed storage functionality
-		_, shardLocations, _, err := datastorage.NewStoreData(
+		_, shardLocations, _, err := datastorage.NewStoreDataStreamWithVersion(
 			db,
-			task.Data,
+			data,
 			task.BuucketID,
 			task.ObjectID,
+			task.VersionID,
 			task.FileName,
 			store,
 			cfg,
@@ -367,12 +389,11 @@ func handleReconstructFile(w http.ResponseWriter, r *http.Request, db *sql.DB, s
 	defer r.Body.Close()
 
 	// Use the new distributed retrieve function
-	data, fileName, err := datastorage.NewRetrieveData(
+	object, err := datastorage.NewOpenObject(
 		db,
 		req.BucketID,
 		req.ObjectID,
 		req.VersionID,
-		store,
 		cfg,
 		logger,
 	)
@@ -382,10 +403,11 @@ func handleReconstructFile(w http.ResponseWriter, r *http.Request, db *sql.DB, s
 		http.Error(w, fmt.Sprintf("Reconstruction failed: %v", err), http.StatusInternalServerError)
 		return
 	}
+	defer object.Close()
 
-	w.Header().Set("Content-Disposition", "attachment; filename="+fileName)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": object.Filename()}))
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Write(data)
+	http.ServeContent(w, r, "", object.ModTime(), object)
 }
 
 // This should work along with the discovery, not the construction port
@@ -4,10 +4,13 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/api"
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/datastorage"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/utils"
 	_ "github.com/mattn/go-sqlite3"
 	"go.uber.org/zap"
@@ -31,6 +34,11 @@ func main() {
 	}
 	defer db.Close()
 
+	// Data keys still wrapped under an older key version are moved to the current one in the background
+	// Their manifests are stored again along with them
+	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
+	datastorage.StartKeyRewrapper(db, store, cfg, logger, 10*time.Minute)
+
 	router := api.SetupRouter(db, cfg, logger)
 
 	tlsConfig, err := utils.LoadTLSConfig("certs/server.crt", "certs/server.key", "certs/ca.crt", true)
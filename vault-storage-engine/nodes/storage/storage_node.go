@@ -3,15 +3,18 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"sync"
 	"syscall"
@@ -20,6 +23,8 @@ import (
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/datastorage"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/proofofinclusion"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/proofofstorage"
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
@@ -342,13 +347,17 @@ func main() {
 	if basePath == "" {
 		basePath = "./data"
 	}
-	store := sharding.NewLocalShardStore(basePath)
 
 	logger, err := zap.NewProduction()
 	if err != nil {
 		log.Fatalf("Logger error: %v", err)
 	}
 
+	store, shards, err := newShardStore(cfg, basePath)
+	if err != nil {
+		log.Fatalf("Shard store error: %v", err)
+	}
+
 	startDiscoveryAndP2P()
 
 	// We'll give embedded server 1s to bind
@@ -393,7 +402,56 @@ func main() {
 
 	r.HandleFunc("/diskspace", handleDiskSpace).Methods("GET")
 
-	r.HandleFunc("/verify/{objectID}/{versionID}/{shardIdx}", handleVerifyShard).Methods("GET")
+	r.HandleFunc("/verify/{objectID}/{versionID}/{shardIdx}", handleVerifyShard(shards)).Methods("GET")
+
+	// Auditors check the node still holds a shard by having it hash random ranges of the shard with their nonce
+	r.HandleFunc("/challenge/{objectID}/{versionID}/{shardIdx}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		shardIdx, err := strconv.Atoi(vars["shardIdx"])
+		if err != nil {
+			http.Error(w, "Invalid shard index", http.StatusBadRequest)
+			return
+		}
+		var challenge proofofstorage.Challenge
+		if err := json.NewDecoder(r.Body).Decode(&challenge); err != nil {
+			http.Error(w, "Invalid challenge", http.StatusBadRequest)
+			return
+		}
+		if err := challenge.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		key := sharding.ShardKey{Location: nodeID, ObjectID: vars["objectID"], VersionID: vars["versionID"], Index: shardIdx}
+		proof, err := answerChallenge(r.Context(), shards, key, challenge)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, sharding.ErrShardNotFound):
+				status = http.StatusNotFound
+			case errors.Is(err, errRangeOutsideShard):
+				status = http.StatusRequestedRangeNotSatisfiable
+			case sharding.IsCorruptShard(err):
+				status = http.StatusUnprocessableEntity
+			}
+			http.Error(w, fmt.Sprintf("Failed to answer challenge: %v", err), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(proofofstorage.Response{Proof: hex.EncodeToString(proof)})
+	}).Methods("POST")
+
+	// Lists the shards the node keeps, only those of one object with ?object_id=, metadata recovery crawls nodes through it
+	r.HandleFunc("/shards", func(w http.ResponseWriter, r *http.Request) {
+		infos, err := shards.ListShards(r.Context(), nodeID, r.URL.Query().Get("object_id"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list shards: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(datastorage.ListedShards(infos))
+	}).Methods("GET")
 
 	r.HandleFunc("/shards/{objectID}/{versionID}/{shardIdx}", func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -405,14 +463,11 @@ func main() {
 			http.Error(w, "Invalid shard index", http.StatusBadRequest)
 			return
 		}
-		data, err := io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, "Failed to read shard data", http.StatusBadRequest)
-			return
-		}
 		defer r.Body.Close()
 
-		err = store.StoreShard(objectID, versionID, shardIdx, data, nodeID)
+		// The shard is streamed into the store, a cancelled or failed upload leaves nothing behind
+		key := sharding.ShardKey{Location: nodeID, ObjectID: objectID, VersionID: versionID, Index: shardIdx}
+		err = shards.PutShard(r.Context(), key, r.Body, r.ContentLength)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to store shard: %v", err), http.StatusInternalServerError)
 			return
@@ -431,13 +486,22 @@ func main() {
 			http.Error(w, "Invalid shard index", http.StatusBadRequest)
 			return
 		}
-		data, err := store.RetrieveShard(objectID, versionID, shardIdx, nodeID)
+		key := sharding.ShardKey{Location: nodeID, ObjectID: objectID, VersionID: versionID, Index: shardIdx}
+		shard, info, err := sharding.OpenShardSeeker(r.Context(), shards, key)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to retrieve shard: %v", err), http.StatusNotFound)
+			status := http.StatusInternalServerError
+			if errors.Is(err, sharding.ErrShardNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, fmt.Sprintf("Failed to retrieve shard: %v", err), status)
 			return
 		}
+		defer shard.Close()
+
+		// ServeContent answers the ranged requests used to read only some stripes of a shard,
+		// only the requested range is read from the store
 		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Write(data)
+		http.ServeContent(w, r, "", info.ModTime, shard)
 	}).Methods("GET")
 
 	r.HandleFunc("/shards/{objectID}/{versionID}/{shardIdx}", func(w http.ResponseWriter, r *http.Request) {
@@ -450,7 +514,8 @@ func main() {
 			http.Error(w, "Invalid shard index", http.StatusBadRequest)
 			return
 		}
-		err = store.DeleteShardByVersion(objectID, versionID, shardIdx, nodeID)
+		key := sharding.ShardKey{Location: nodeID, ObjectID: objectID, VersionID: versionID, Index: shardIdx}
+		err = shards.DeleteShard(r.Context(), key)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to delete shard: %v", err), http.StatusInternalServerError)
 			return
@@ -484,6 +549,31 @@ func main() {
 	log.Fatal(http.ListenAndServe(":"+port, r))
 }
 
+// newShardStore creates the store the node keeps its shards in, a local directory or an S3-compatible bucket
+// The shard handlers stream through the ShardStoreV2 view of the same store
+func newShardStore(cfg *config.Config, basePath string) (sharding.ShardStore, sharding.ShardStoreV2, error) {
+	switch cfg.ShardStore {
+	case "", "local":
+		store := sharding.NewLocalShardStore(basePath)
+		return store, sharding.NewLocalShardStoreV2(store), nil
+	case "s3":
+		store, err := sharding.NewS3ShardStore(sharding.S3Config{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			PathStyle: cfg.S3PathStyle,
+			Prefix:    cfg.S3Prefix,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, sharding.NewS3ShardStoreV2(store), nil
+	}
+	return nil, nil, fmt.Errorf("unknown shard store %q, expected local or s3", cfg.ShardStore)
+}
+
 func registerWithDiscovery(nodeID, discoveryURL, selfAddress string) {
 	regURL := discoveryURL + "/register"
 	payload := map[string]string{
@@ -534,43 +624,109 @@ func handleDiskSpace(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// Add shard verification endpoint
-func handleVerifyShard(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	objectID := vars["objectID"]
-	versionID := vars["versionID"]
-	shardIdxStr := vars["shardIdx"]
+// handleVerifyShard checks a shard of the node's store without it leaving the node
+func handleVerifyShard(shards sharding.ShardStoreV2) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		objectID := vars["objectID"]
+		versionID := vars["versionID"]
+		shardIdxStr := vars["shardIdx"]
 
-	nodeID := os.Getenv("NODE_ID")
+		nodeID := os.Getenv("NODE_ID")
 
-	shardIdx, err := strconv.Atoi(shardIdxStr)
-	if err != nil {
-		http.Error(w, "Invalid shard index", http.StatusBadRequest)
-		return
+		shardIdx, err := strconv.Atoi(shardIdxStr)
+		if err != nil {
+			http.Error(w, "Invalid shard index", http.StatusBadRequest)
+			return
+		}
+
+		// The shard is hashed here, so it can be verified without leaving the node
+		key := sharding.ShardKey{Location: nodeID, ObjectID: objectID, VersionID: versionID, Index: shardIdx}
+		result, err := verifyShard(r.Context(), shards, key, r.URL.Query().Get("root"), r.URL.Query().Get("proof"))
+		if err != nil {
+			http.Error(w, "Error checking shard", http.StatusInternalServerError)
+			log.Printf("Error: %v", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
 	}
+}
+
+// errRangeOutsideShard is returned for challenges asking for bytes past the end of the shard
+var errRangeOutsideShard = errors.New("range outside of the shard")
 
-	// Check if the shard exists
-	exists, err := shardExists(objectID, versionID, shardIdx, nodeID)
+// answerChallenge hashes the nonce of a challenge and the ranges it asks for, in the order they are asked for
+func answerChallenge(ctx context.Context, shards sharding.ShardStoreV2, key sharding.ShardKey, challenge proofofstorage.Challenge) ([]byte, error) {
+	info, err := shards.StatShard(ctx, key)
 	if err != nil {
-		http.Error(w, "Error checking shard", http.StatusInternalServerError)
-		log.Printf("Error: %v", err)
-		return
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(challenge.Nonce)
+	if err != nil {
+		return nil, err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]bool{
-		"exists": exists,
-	})
+	h := proofofstorage.NewHash(nonce)
+	for _, rng := range challenge.Ranges {
+		if rng.Offset+rng.Length > info.Size {
+			return nil, fmt.Errorf("%w: %d+%d, the shard holds %d bytes", errRangeOutsideShard, rng.Offset, rng.Length, info.Size)
+		}
+		body, err := shards.GetShardRange(ctx, key, rng.Offset, rng.Length)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.CopyN(h, body, rng.Length)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
 }
 
-func shardExists(objectID, versionID string, shardIdx int, nodeID string) (bool, error) {
-	shardBase := os.Getenv("SHARD_STORE_BASE_PATH")
-	shardPath := filepath.Join(shardBase, nodeID, fmt.Sprintf("%s-v(%s)_shard_%d", objectID, versionID, shardIdx))
-	_, err := os.ReadFile(shardPath)
-	if os.IsNotExist(err) {
-		log.Printf("%s does not have the shard", nodeID)
-		return false, fmt.Errorf("file does not exists: %v", err)
-	}
+// verifyShard hashes a stored shard, and checks it against a Merkle root and proof when a root is given
+// Missing and corrupt shards are reported in the result, errors are only returned when the shard couldn't be checked
+func verifyShard(ctx context.Context, shards sharding.ShardStoreV2, key sharding.ShardKey, root, proof string) (datastorage.ShardVerification, error) {
+	var result datastorage.ShardVerification
 
-	return true, nil
+	rc, err := shards.GetShard(ctx, key)
+	if errors.Is(err, sharding.ErrShardNotFound) {
+		log.Printf("%s does not have the shard", key.Location)
+		return result, nil
+	}
+	if sharding.IsCorruptShard(err) {
+		result.Exists = true
+		result.Corrupt = err.Error()
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+	defer rc.Close()
+
+	result.Exists = true
+	h := sha256.New()
+	n, err := io.Copy(h, rc)
+	if sharding.IsCorruptShard(err) {
+		result.Corrupt = err.Error()
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+	result.Size = n
+	result.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	if root != "" {
+		valid := false
+		rootHash, rootErr := hex.DecodeString(root)
+		parsed, proofErr := proofofinclusion.ParseProof(proof)
+		if rootErr == nil && proofErr == nil {
+			valid = proofofinclusion.VerifyProof(rootHash, h.Sum(nil), parsed)
+		}
+		result.Valid = &valid
+	}
+	return result, nil
 }
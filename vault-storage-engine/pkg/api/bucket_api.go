@@ -10,6 +10,7 @@ import (
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/datastorage"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/erasurecoding"
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
@@ -46,6 +47,10 @@ func CreateBucketHandler(c *gin.Context) {
 
 	var createRequest struct {
 		BucketID string `json:"bucket_id" binding:"required"`
+		// ErasureProfile is a name (scratch, standard, archive, media) or <data>+<parity>, it defaults to 4+2
+		ErasureProfile string `json:"erasure_profile"`
+		// Dedup splits the versions of the bucket into content-defined chunks stored once per bucket
+		Dedup bool `json:"dedup"`
 	}
 
 	// Get the user email to get the username and append it automatically to owner section
@@ -65,7 +70,13 @@ func CreateBucketHandler(c *gin.Context) {
 		return
 	}
 
-	err = bucket.CreateBucket(db, createRequest.BucketID, owner)
+	profile, err := erasurecoding.ParseProfile(createRequest.ErasureProfile)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = bucket.CreateBucketWithOptions(db, createRequest.BucketID, owner, profile, createRequest.Dedup)
 
 	if err != nil {
 		fmt.Println(err)
@@ -73,7 +84,7 @@ func CreateBucketHandler(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"message": "Bucket created successfully", "bucket_id": createRequest.BucketID})
+	c.JSON(http.StatusCreated, gin.H{"message": "Bucket created successfully", "bucket_id": createRequest.BucketID, "erasure_profile": profile.String(), "dedup": createRequest.Dedup})
 }
 
 func GetBucketHandler(c *gin.Context) {
@@ -2,7 +2,9 @@ package api
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -11,8 +13,9 @@ import (
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/datastorage"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/encryption"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/proofofinclusion"
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
-	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
@@ -74,29 +77,39 @@ func UploadObjectHandler(c *gin.Context) {
 		return
 	}
 
-	// Save the uploaded file to a temporary location
-	tempFilePath := filepath.Join("/tmp", file.Filename)
-	if err := c.SaveUploadedFile(file, tempFilePath); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+	customerKey, err := customerKeyFromRequest(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	data, err := os.ReadFile(tempFilePath)
+	// The upload is streamed into the stripe pipeline instead of being read into memory
+	data, err := file.Open()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
 		return
 	}
+	defer data.Close()
 
 	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
 	objectID := uuid.New().String()
 
-	_, shardLocations, proofs, err := datastorage.StoreData(db, data, bucketID, objectID, file.Filename, store, cfg, cfg.ShardLocations, logger)
+	var shardLocations map[string]string
+	var proofs []string
+	if customerKey != nil {
+		_, shardLocations, proofs, err = datastorage.StoreDataStreamWithCustomerKey(db, data, bucketID, objectID, file.Filename, store, cfg, cfg.ShardLocations, customerKey, logger)
+	} else {
+		_, shardLocations, proofs, err = datastorage.StoreDataStream(db, data, bucketID, objectID, file.Filename, store, cfg, cfg.ShardLocations, logger)
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store object"})
 		return
 	}
 
-	proofsMap := utils.ConvertSliceToMap(proofs)
+	proofsMap := make(map[string]string, len(proofs))
+	for idx, proof := range proofs {
+		proofsMap[proofofinclusion.ProofKey(idx)] = proof
+	}
 
 	c.JSON(http.StatusCreated, gin.H{
 		"message":         "Object uploaded successfully",
@@ -136,26 +149,21 @@ func GetObjectHandler(c *gin.Context) {
 	versionID := bucket.GetLatestVersion(db, objectID)
 	fmt.Println("latest version: ", versionID)
 
-	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
-	data, filename, err := datastorage.RetrieveData(db, bucketID, objectID, versionID, store, cfg, logger)
+	customerKey, err := customerKeyFromRequest(c)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Object not found"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	tmpFile, err := os.CreateTemp("", "object-*")
+	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
+	object, err := datastorage.OpenObjectWithCustomerKey(db, bucketID, objectID, versionID, store, cfg, customerKey, logger)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create temporary file"})
-		return
-	}
-	defer tmpFile.Close()
-
-	if _, err := tmpFile.Write(data); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write data to temporary file"})
+		openObjectError(c, err)
 		return
 	}
+	defer object.Close()
 
-	c.FileAttachment(tmpFile.Name(), filename)
+	serveObject(c, object)
 }
 
 // Download a particular version of an object
@@ -180,26 +188,21 @@ func GetObjectByVersionHandler(c *gin.Context) {
 		return
 	}
 
-	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
-	data, filename, err := datastorage.RetrieveData(db, bucketID, objectID, versionID, store, cfg, logger)
+	customerKey, err := customerKeyFromRequest(c)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Object not found"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	tmpFile, err := os.CreateTemp("", "object-*")
+	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
+	object, err := datastorage.OpenObjectWithCustomerKey(db, bucketID, objectID, versionID, store, cfg, customerKey, logger)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create temporary file"})
+		openObjectError(c, err)
 		return
 	}
-	defer tmpFile.Close()
+	defer object.Close()
 
-	if _, err := tmpFile.Write(data); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write data to temporary file"})
-		return
-	}
-
-	c.FileAttachment(tmpFile.Name(), filename)
+	serveObject(c, object)
 }
 
 // This stores a nw version of an object, it'll give it a new version
@@ -243,16 +246,17 @@ func UpdateObjectVersionHandler(c *gin.Context) {
 		return
 	}
 
-	data, err := os.ReadFile(updateRequest.Filename)
+	data, err := os.Open(updateRequest.Filename)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
 		return
 	}
+	defer data.Close()
 
 	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
 	locations := cfg.ShardLocations
 
-	versionID, _, _, err = datastorage.StoreDataWithVersion(db, data, bucketID, objectID, versionID, filepath.Base(updateRequest.Filename), store, cfg, locations, logger)
+	versionID, _, _, err = datastorage.StoreDataStreamWithVersion(db, data, bucketID, objectID, versionID, filepath.Base(updateRequest.Filename), store, cfg, locations, logger)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store updated object"})
 		return
@@ -325,3 +329,60 @@ func DeleteObjectByVersionHandler(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"message": "Object version deleted successfully", "bucket_id": bucketID, "object_id": objectID, "version_id": versionID})
 }
+
+// serveObject streams an object as an attachment
+// Range and conditional requests are answered by decoding only the stripes they cover
+func serveObject(c *gin.Context, object *datastorage.ObjectReader) {
+	contentType := mime.TypeByExtension(filepath.Ext(object.Filename()))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": object.Filename()}))
+
+	http.ServeContent(c.Writer, c.Request, object.Filename(), object.ModTime(), object)
+}
+
+// Headers carrying a customer supplied encryption key
+// The key is sent base64 encoded along with the base64 MD5 or SHA-256 of the key
+const (
+	customerAlgorithmHeader = "X-Vault-Server-Side-Encryption-Customer-Algorithm"
+	customerKeyHeader       = "X-Vault-Server-Side-Encryption-Customer-Key"
+	customerKeyMD5Header    = "X-Vault-Server-Side-Encryption-Customer-Key-MD5"
+	customerKeySHA256Header = "X-Vault-Server-Side-Encryption-Customer-Key-SHA256"
+)
+
+// customerKeyFromRequest returns the customer supplied key of a request, or nil when the request has none
+func customerKeyFromRequest(c *gin.Context) ([]byte, error) {
+	key := c.GetHeader(customerKeyHeader)
+	if key == "" {
+		return nil, nil
+	}
+	if algorithm := c.GetHeader(customerAlgorithmHeader); algorithm != "" && algorithm != encryption.CustomerKeyAlgorithm {
+		return nil, fmt.Errorf("unsupported customer key algorithm %q, only %s is supported", algorithm, encryption.CustomerKeyAlgorithm)
+	}
+
+	digest := c.GetHeader(customerKeySHA256Header)
+	if digest == "" {
+		digest = c.GetHeader(customerKeyMD5Header)
+	}
+	if digest == "" {
+		return nil, fmt.Errorf("%s or %s is required along with %s", customerKeyMD5Header, customerKeySHA256Header, customerKeyHeader)
+	}
+	return encryption.ParseCustomerKey(key, digest)
+}
+
+// openObjectError answers a request for an object that couldn't be opened
+// The key is never echoed back, a missing or wrong customer key only gets a 403
+func openObjectError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, datastorage.ErrCustomerKeyRequired):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Object is encrypted with a customer key, supply the key to read it"})
+	case errors.Is(err, datastorage.ErrCustomerKeyMismatch):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Customer key doesn't match the key the object was encrypted with"})
+	case errors.Is(err, datastorage.ErrCustomerKeyUnexpected):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Object isn't encrypted with a customer key"})
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Object not found"})
+	}
+}
@@ -1,12 +1,66 @@
 package api
 
-import "github.com/gin-gonic/gin"
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
 
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/auth"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/datastorage"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// CheckFileIntegrityHandler checks every shard of a version against the Merkle root of the version
+// ?mode=shallow, the default, has every shard hashed where it is stored, storage nodes through their /verify endpoint
+// ?mode=deep fetches every shard, hashes it here and test-decodes the version, versions stored with
+// a customer key need the key in the request headers to be decoded
 func CheckFileIntegrityHandler(c *gin.Context) {
-	// Implement this handler based on your requirements
+	bucketID := c.Param("bucketID")
+	objectID := c.Param("objectID")
+	versionID := c.Param("versionID")
+
+	db := c.MustGet("db").(*sql.DB)
+	cfg := c.MustGet("config").(*config.Config)
+	logger := c.MustGet("logger").(*zap.Logger)
+
+	token, err := auth.GetTokenFromRequest(c)
+	if err != nil {
+		fmt.Printf("failed to get token from request, %v", err)
+	}
+
+	authVerify, err := auth.VerifyBucketOwnership(c, db, bucketID, token)
+	if !authVerify {
+		fmt.Printf("verfying owner error: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "access denied:"})
+		return
+	}
+
+	var deep bool
+	switch mode := c.DefaultQuery("mode", "shallow"); mode {
+	case "shallow":
+	case "deep":
+		deep = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown mode %q, use shallow or deep", mode)})
+		return
+	}
+
+	customerKey, err := customerKeyFromRequest(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
+	report, err := datastorage.CheckIntegrity(db, bucketID, objectID, versionID, store, cfg, deep, customerKey, logger)
+	if err != nil {
+		logger.Warn("Integrity check failed", zap.String("object_id", objectID), zap.String("version_id", versionID), zap.Error(err))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
 
-	// How would this function work essentially?
-	// We already have the proofs of each shard generated and stored in their json files
-	// We could recompute the proof and compare it
-	// We could also find a new means of verifying proofs or even computing the proofs
+	c.JSON(http.StatusOK, report)
 }
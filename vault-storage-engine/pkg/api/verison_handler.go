@@ -74,7 +74,8 @@ func RetrieveVersionHandler(c *gin.Context) {
 		"creation_date":   objectMetadata.CreationDate,
 		"data":            objectMetadata.Data,
 		"shard_locations": objectMetadata.ShardLocations,
-		"proofs":          objectMetadata.Proofs})
+		"proofs":          objectMetadata.Proofs,
+		"merkle_root":     objectMetadata.MerkleRoot})
 }
 
 func DownloadMetadata(c *gin.Context) {
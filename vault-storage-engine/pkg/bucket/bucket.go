@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"time"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/erasurecoding"
 )
 
 // Bucket represents a storage bucket
@@ -13,8 +15,24 @@ type Bucket struct {
 	//CreatedAt time.Time
 }
 
-// CreateBucket inserts a new bucket into the database
+// CreateBucket inserts a new bucket with the default erasure profile into the database
 func CreateBucket(db *sql.DB, bucketID string, owner string) error {
+	return CreateBucketWithProfile(db, bucketID, owner, erasurecoding.DefaultProfile())
+}
+
+// CreateBucketWithProfile inserts a new bucket into the database
+// Every version stored in the bucket is erasure coded with the given profile
+func CreateBucketWithProfile(db *sql.DB, bucketID string, owner string, profile erasurecoding.Profile) error {
+	return CreateBucketWithOptions(db, bucketID, owner, profile, false)
+}
+
+// CreateBucketWithOptions inserts a new bucket into the database
+// With dedup set, versions are split into content-defined chunks shared by every version of the bucket
+func CreateBucketWithOptions(db *sql.DB, bucketID string, owner string, profile erasurecoding.Profile, dedup bool) error {
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+
 	var bucketExists bool
 
 	// Check if the Bucket exists
@@ -31,8 +49,8 @@ func CreateBucket(db *sql.DB, bucketID string, owner string) error {
 	// Update the time of creation
 	time := time.Now().Format(time.RFC3339)
 
-	query = `INSERT INTO buckets (bucket_id, owner, created_at) VALUES (?, ?, ?)`
-	_, err = db.Exec(query, bucketID, owner, time)
+	query = `INSERT INTO buckets (bucket_id, owner, data_shards, parity_shards, dedup, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err = db.Exec(query, bucketID, owner, profile.DataShards, profile.ParityShards, dedup, time)
 	if err != nil {
 		return fmt.Errorf("failed to create bucket: %w", err)
 	}
@@ -58,6 +76,33 @@ func GetBucket(db *sql.DB, bucketID string) (*Bucket, error) {
 	return &bucket, nil
 }
 
+// GetBucketProfile returns the erasure profile new versions of a bucket are stored with
+func GetBucketProfile(db *sql.DB, bucketID string) (erasurecoding.Profile, error) {
+	var profile erasurecoding.Profile
+	query := `SELECT data_shards, parity_shards FROM buckets WHERE bucket_id = ?`
+	err := db.QueryRow(query, bucketID).Scan(&profile.DataShards, &profile.ParityShards)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return erasurecoding.Profile{}, fmt.Errorf("bucket %s does not exists", bucketID)
+		}
+		return erasurecoding.Profile{}, fmt.Errorf("failed to get bucket profile: %w", err)
+	}
+	return profile, nil
+}
+
+// GetBucketOwner returns the owner of a bucket
+func GetBucketOwner(db *sql.DB, bucketID string) (string, error) {
+	var owner string
+	err := db.QueryRow(`SELECT owner FROM buckets WHERE bucket_id = ?`, bucketID).Scan(&owner)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("bucket %s does not exists", bucketID)
+		}
+		return "", fmt.Errorf("failed to get bucket owner: %w", err)
+	}
+	return owner, nil
+}
+
 func ListAllBuckets(db *sql.DB, owner string) ([]string, error) {
 	query := `SELECT bucket_id FROM buckets WHERE owner = ?`
 	rows, err := db.Query(query, owner)
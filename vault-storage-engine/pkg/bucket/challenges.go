@@ -0,0 +1,176 @@
+package bucket
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/proofofstorage"
+)
+
+// StorageChallenge is a challenge prepared for a shard when it was written, it is used once
+type StorageChallenge struct {
+	ID        int64
+	ObjectID  string
+	VersionID string
+	ShardIdx  int
+	Location  string
+	Challenge proofofstorage.Challenge
+	Expected  string
+}
+
+// AuditOutcome is the result of challenging a storage node
+type AuditOutcome string
+
+const (
+	AuditPassed AuditOutcome = "passed"
+	AuditFailed AuditOutcome = "failed"
+	// AuditUnreachable is a node that couldn't be asked, it counts as half a failure
+	AuditUnreachable AuditOutcome = "unreachable"
+)
+
+// NodeScore is the reliability of a storage node as seen by the audits
+// Score is a moving average of the audit outcomes, nodes start at InitialNodeScore and every audit weighs NodeScoreWeight
+type NodeScore struct {
+	Node        string  `json:"node"`
+	Score       float64 `json:"score"`
+	Passed      int     `json:"passed"`
+	Failed      int     `json:"failed"`
+	Unreachable int     `json:"unreachable"`
+	LastAudit   string  `json:"last_audit"`
+}
+
+const (
+	InitialNodeScore = 1.0
+	NodeScoreWeight  = 0.1
+)
+
+// AddChallenges records the challenges prepared for a shard
+func AddChallenges(db *sql.DB, objectID, versionID string, shardIdx int, location string, prepared []proofofstorage.Prepared) error {
+	if len(prepared) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, p := range prepared {
+		challengeJSON, err := json.Marshal(p.Challenge)
+		if err != nil {
+			return fmt.Errorf("failed to encode challenge: %w", err)
+		}
+		_, err = tx.Exec(`INSERT INTO storage_challenges (object_id, version_id, shard_idx, location, challenge, expected) VALUES (?, ?, ?, ?, ?, ?)`,
+			objectID, versionID, shardIdx, location, string(challengeJSON), p.Expected)
+		if err != nil {
+			return fmt.Errorf("failed to add challenge for shard %d of %s: %w", shardIdx, objectID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// TakeRandomChallenges removes up to n random challenges and returns them
+// A challenge is only handed out once, so a node never sees the same nonce twice
+func TakeRandomChallenges(db *sql.DB, n int) ([]StorageChallenge, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, object_id, version_id, shard_idx, location, challenge, expected FROM storage_challenges ORDER BY RANDOM() LIMIT ?`, n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query challenges: %w", err)
+	}
+	var challenges []StorageChallenge
+	for rows.Next() {
+		var c StorageChallenge
+		var challengeJSON string
+		if err := rows.Scan(&c.ID, &c.ObjectID, &c.VersionID, &c.ShardIdx, &c.Location, &challengeJSON, &c.Expected); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan challenge: %w", err)
+		}
+		if err := json.Unmarshal([]byte(challengeJSON), &c.Challenge); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to decode challenge %d: %w", c.ID, err)
+		}
+		challenges = append(challenges, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query challenges: %w", err)
+	}
+
+	for _, c := range challenges {
+		if _, err := tx.Exec(`DELETE FROM storage_challenges WHERE id = ?`, c.ID); err != nil {
+			return nil, fmt.Errorf("failed to take challenge %d: %w", c.ID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to take challenges: %w", err)
+	}
+	return challenges, nil
+}
+
+// DeleteChallenges removes the challenges left for the shards of a version
+func DeleteChallenges(db *sql.DB, objectID, versionID string) error {
+	_, err := db.Exec(`DELETE FROM storage_challenges WHERE object_id = ? AND version_id = ?`, objectID, versionID)
+	if err != nil {
+		return fmt.Errorf("failed to delete challenges of %s: %w", objectID, err)
+	}
+	return nil
+}
+
+// RecordAudit folds the outcome of an audit into the score of a node
+func RecordAudit(db *sql.DB, node string, outcome AuditOutcome) error {
+	var value float64
+	var passed, failed, unreachable int
+	switch outcome {
+	case AuditPassed:
+		value, passed = 1, 1
+	case AuditFailed:
+		value, failed = 0, 1
+	case AuditUnreachable:
+		value, unreachable = 0.5, 1
+	default:
+		return fmt.Errorf("unknown audit outcome %q", outcome)
+	}
+
+	query := `
+		INSERT INTO node_scores (node, score, passed, failed, unreachable, last_audit)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(node) DO UPDATE SET
+			score = score * ? + ?,
+			passed = passed + excluded.passed,
+			failed = failed + excluded.failed,
+			unreachable = unreachable + excluded.unreachable,
+			last_audit = excluded.last_audit
+	`
+	_, err := db.Exec(query, node, InitialNodeScore*(1-NodeScoreWeight)+value*NodeScoreWeight, passed, failed, unreachable,
+		1-NodeScoreWeight, value*NodeScoreWeight)
+	if err != nil {
+		return fmt.Errorf("failed to record audit of %s: %w", node, err)
+	}
+	return nil
+}
+
+// GetNodeScores returns the score of every audited node, by node
+func GetNodeScores(db *sql.DB) (map[string]NodeScore, error) {
+	rows, err := db.Query(`SELECT node, score, passed, failed, unreachable, last_audit FROM node_scores`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query node scores: %w", err)
+	}
+	defer rows.Close()
+
+	scores := make(map[string]NodeScore)
+	for rows.Next() {
+		var s NodeScore
+		if err := rows.Scan(&s.Node, &s.Score, &s.Passed, &s.Failed, &s.Unreachable, &s.LastAudit); err != nil {
+			return nil, fmt.Errorf("failed to scan node score: %w", err)
+		}
+		scores[s.Node] = s
+	}
+	return scores, rows.Err()
+}
@@ -0,0 +1,234 @@
+package bucket
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/erasurecoding"
+)
+
+// ChunkRef is a chunk of a deduplicated version, in the order the chunks make up the version
+type ChunkRef struct {
+	Hash string `json:"hash"` // hex SHA-256 of the plaintext of the chunk
+	Size int64  `json:"size"`
+}
+
+// Chunk is a chunk shared by the versions of a deduplicated bucket
+// Chunks are only shared within a bucket, they are reference counted once per ChunkRef pointing to them
+type Chunk struct {
+	BucketID string
+	Hash     string
+	Size     int64
+	RefCount int
+	Metadata ChunkMetadata
+}
+
+// ChunkMetadata records how a chunk was stored
+// Every chunk is stored as a single stripe, its shards are kept under ChunkID and ChunkVersionID
+type ChunkMetadata struct {
+	ChunkID        string            `json:"chunk_id"`
+	ShardLocations map[string]string `json:"shard_locations"`
+	DataShards     int               `json:"data_shards"`
+	ParityShards   int               `json:"parity_shards"`
+	Codecs         *Codecs           `json:"codecs"`
+	DataKey        *WrappedKey       `json:"data_key"`
+	Stripe         StripeMetadata    `json:"stripe"`
+	DegradedShards []int             `json:"degraded_shards,omitempty"`
+	Proofs         map[string]string `json:"proofs,omitempty"`
+	MerkleRoot     string            `json:"merkle_root,omitempty"`
+	// ChunkSet is the manifest recording the chunk along with the other chunks first stored by the same version
+	// Chunks stored before chunk sets existed have a manifest of their own instead
+	ChunkSet *ChunkSetRef `json:"chunk_set,omitempty"`
+}
+
+// ChunkSetRef locates the manifest of a chunk set, kept under ID and ChunkSetVersionID at each of Locations
+type ChunkSetRef struct {
+	ID        string   `json:"id"`
+	Locations []string `json:"locations"`
+}
+
+// ChunkVersionID is the version the shards of every chunk are stored under
+const ChunkVersionID = "chunk"
+
+// ChunkSetVersionID is the version the manifests of chunk sets are stored under
+const ChunkSetVersionID = "chunks"
+
+// ChunkedKeyID is how versions whose data lives in chunks are counted, every chunk has a data key of its own
+const ChunkedKeyID = "chunked"
+
+// ErasureProfile returns the erasure profile the chunk was stored with
+func (m *ChunkMetadata) ErasureProfile() erasurecoding.Profile {
+	return erasurecoding.Profile{DataShards: m.DataShards, ParityShards: m.ParityShards}
+}
+
+// GetBucketDedup reports whether new versions of a bucket are deduplicated
+func GetBucketDedup(db *sql.DB, bucketID string) (bool, error) {
+	var dedup bool
+	err := db.QueryRow(`SELECT dedup FROM buckets WHERE bucket_id = ?`, bucketID).Scan(&dedup)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, fmt.Errorf("bucket %s does not exists", bucketID)
+		}
+		return false, fmt.Errorf("failed to get bucket dedup mode: %w", err)
+	}
+	return dedup, nil
+}
+
+// SetBucketDedup turns deduplication of a bucket on or off
+// Only versions stored afterwards are affected, every version is read back the way it was stored
+func SetBucketDedup(db *sql.DB, bucketID string, dedup bool) error {
+	res, err := db.Exec(`UPDATE buckets SET dedup = ? WHERE bucket_id = ?`, dedup, bucketID)
+	if err != nil {
+		return fmt.Errorf("failed to set bucket dedup mode: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("bucket %s does not exists", bucketID)
+	}
+	return nil
+}
+
+// AcquireChunk takes a reference to a stored chunk, false when the bucket doesn't hold the chunk
+// A chunk whose last reference was just released can still be acquired until it is collected
+func AcquireChunk(db *sql.DB, bucketID, hash string) (bool, error) {
+	res, err := db.Exec(`UPDATE chunks SET refcount = refcount + 1 WHERE bucket_id = ? AND hash = ?`, bucketID, hash)
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire chunk %s: %w", hash, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire chunk %s: %w", hash, err)
+	}
+	return n > 0, nil
+}
+
+// AddChunk records a newly stored chunk holding one reference
+// It returns false when another writer stored the same chunk first, the caller then acquires that one instead
+func AddChunk(db *sql.DB, bucketID, hash string, size int64, metadata ChunkMetadata) (bool, error) {
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode chunk metadata: %w", err)
+	}
+
+	query := `
+		INSERT INTO chunks (bucket_id, hash, size, metadata, refcount, created_at)
+		VALUES (?, ?, ?, ?, 1, CURRENT_TIMESTAMP)
+		ON CONFLICT(bucket_id, hash) DO NOTHING
+	`
+	res, err := db.Exec(query, bucketID, hash, size, string(metadataJSON))
+	if err != nil {
+		return false, fmt.Errorf("failed to add chunk %s: %w", hash, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to add chunk %s: %w", hash, err)
+	}
+	return n > 0, nil
+}
+
+// ReleaseChunks drops one reference per ChunkRef, chunks left without references are reclaimed by garbage collection
+func ReleaseChunks(db *sql.DB, bucketID string, refs []ChunkRef) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, ref := range refs {
+		_, err := tx.Exec(`UPDATE chunks SET refcount = refcount - 1 WHERE bucket_id = ? AND hash = ? AND refcount > 0`, bucketID, ref.Hash)
+		if err != nil {
+			return fmt.Errorf("failed to release chunk %s: %w", ref.Hash, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// GetChunks returns the chunks of a bucket with the given hashes, hashes the bucket doesn't hold are left out
+func GetChunks(db *sql.DB, bucketID string, hashes []string) (map[string]Chunk, error) {
+	const batch = 500
+
+	chunks := make(map[string]Chunk, len(hashes))
+	for start := 0; start < len(hashes); start += batch {
+		part := hashes[start:min(start+batch, len(hashes))]
+		args := []any{bucketID}
+		for _, hash := range part {
+			args = append(args, hash)
+		}
+
+		query := fmt.Sprintf(`SELECT bucket_id, hash, size, refcount, metadata FROM chunks WHERE bucket_id = ? AND hash IN (?%s)`,
+			strings.Repeat(", ?", len(part)-1))
+		err := scanChunks(db, func(chunk Chunk) { chunks[chunk.Hash] = chunk }, query, args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return chunks, nil
+}
+
+// ListUnreferencedChunks returns up to limit chunks no version refers to anymore
+func ListUnreferencedChunks(db *sql.DB, limit int) ([]Chunk, error) {
+	var chunks []Chunk
+	query := `SELECT bucket_id, hash, size, refcount, metadata FROM chunks WHERE refcount = 0 LIMIT ?`
+	err := scanChunks(db, func(chunk Chunk) { chunks = append(chunks, chunk) }, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+// DeleteUnreferencedChunk removes a chunk from the database if it still has no references
+// Once it returns true no version can acquire the chunk anymore and its shards can be deleted
+func DeleteUnreferencedChunk(db *sql.DB, bucketID, hash string) (bool, error) {
+	res, err := db.Exec(`DELETE FROM chunks WHERE bucket_id = ? AND hash = ? AND refcount = 0`, bucketID, hash)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete chunk %s: %w", hash, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete chunk %s: %w", hash, err)
+	}
+	return n > 0, nil
+}
+
+// GetChunkSet returns the chunks of the chunk set setID that are still recorded, by hash
+func GetChunkSet(db *sql.DB, setID string) (map[string]Chunk, error) {
+	chunks := make(map[string]Chunk)
+	query := `SELECT bucket_id, hash, size, refcount, metadata FROM chunks WHERE json_extract(metadata, '$.chunk_set.id') = ?`
+	if err := scanChunks(db, func(chunk Chunk) { chunks[chunk.Hash] = chunk }, query, setID); err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+// ChunkSetInUse reports whether any chunk of the chunk set setID is still recorded
+func ChunkSetInUse(db *sql.DB, setID string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM chunks WHERE json_extract(metadata, '$.chunk_set.id') = ?)`, setID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if chunk set %s is in use: %w", setID, err)
+	}
+	return exists, nil
+}
+
+// scanChunks hands every chunk returned by query to add
+func scanChunks(db *sql.DB, add func(Chunk), query string, args ...any) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query chunks: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var chunk Chunk
+		var metadataJSON string
+		if err := rows.Scan(&chunk.BucketID, &chunk.Hash, &chunk.Size, &chunk.RefCount, &metadataJSON); err != nil {
+			return fmt.Errorf("failed to scan chunk: %w", err)
+		}
+		if err := json.Unmarshal([]byte(metadataJSON), &chunk.Metadata); err != nil {
+			return fmt.Errorf("failed to decode metadata of chunk %s: %w", chunk.Hash, err)
+		}
+		add(chunk)
+	}
+	return rows.Err()
+}
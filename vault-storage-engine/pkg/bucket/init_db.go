@@ -2,6 +2,7 @@ package bucket
 
 import (
 	"database/sql"
+	"fmt"
 	"os"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -10,7 +11,11 @@ import (
 // InitDB initializes the SQLite database
 // InitDB initializes the database if it doesn't exist and returns a connection to it.
 func InitDB() (*sql.DB, error) {
-	dbPath := "metadata.db"
+	return OpenDB("metadata.db")
+}
+
+// OpenDB opens the SQLite database at dbPath, creating it and its schema when needed
+func OpenDB(dbPath string) (*sql.DB, error) {
 	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
 		// Database file does not exist, create and initialize it
 		file, err := os.Create(dbPath)
@@ -51,6 +56,9 @@ func initializeSchema(db *sql.DB) error {
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		bucket_id TEXT NOT NULL,
 		owner TEXT NOT NULL,
+		data_shards INTEGER NOT NULL DEFAULT 4,
+		parity_shards INTEGER NOT NULL DEFAULT 2,
+		dedup INTEGER NOT NULL DEFAULT 0,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);
 	CREATE TABLE IF NOT EXISTS objects (
@@ -72,6 +80,46 @@ func initializeSchema(db *sql.DB) error {
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY (object_id) REFERENCES objects(id)
 	);
+	CREATE TABLE IF NOT EXISTS chunks (
+		bucket_id TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		metadata TEXT NOT NULL,
+		refcount INTEGER NOT NULL DEFAULT 1,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (bucket_id, hash)
+	);
+	CREATE INDEX IF NOT EXISTS chunks_unreferenced ON chunks (refcount) WHERE refcount = 0;
+	CREATE TABLE IF NOT EXISTS storage_challenges (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		object_id TEXT NOT NULL,
+		version_id TEXT NOT NULL,
+		shard_idx INTEGER NOT NULL,
+		location TEXT NOT NULL,
+		challenge TEXT NOT NULL,
+		expected TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS storage_challenges_version ON storage_challenges (object_id, version_id);
+	CREATE TABLE IF NOT EXISTS node_scores (
+		node TEXT PRIMARY KEY,
+		score REAL NOT NULL,
+		passed INTEGER NOT NULL DEFAULT 0,
+		failed INTEGER NOT NULL DEFAULT 0,
+		unreachable INTEGER NOT NULL DEFAULT 0,
+		last_audit TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS rewrap_progress (
+		key_id TEXT PRIMARY KEY,
+		last_version_row INTEGER NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS rewrap_chunk_progress (
+		key_id TEXT PRIMARY KEY,
+		last_bucket_id TEXT NOT NULL,
+		last_hash TEXT NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
 	CREATE TABLE IF NOT EXISTS acl (
 		resource_id TEXT,
 		resource_type TEXT,
@@ -81,5 +129,37 @@ func initializeSchema(db *sql.DB) error {
 	);
 	`
 	_, err := db.Exec(schema)
-	return err
+	if err != nil {
+		return err
+	}
+	return migrateSchema(db)
+}
+
+// migrateSchema adds the columns introduced after a database was first created
+// Buckets created before erasure profiles existed get the profile they were stored with, 4+2
+func migrateSchema(db *sql.DB) error {
+	columns := []struct {
+		table, name, definition string
+	}{
+		{"buckets", "data_shards", "INTEGER NOT NULL DEFAULT 4"},
+		{"buckets", "parity_shards", "INTEGER NOT NULL DEFAULT 2"},
+		{"buckets", "dedup", "INTEGER NOT NULL DEFAULT 0"},
+	}
+
+	for _, column := range columns {
+		var exists bool
+		query := fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM pragma_table_info('%s') WHERE name = ?)", column.table)
+		if err := db.QueryRow(query, column.name).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to inspect table %s: %w", column.table, err)
+		}
+		if exists {
+			continue
+		}
+
+		_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", column.table, column.name, column.definition))
+		if err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", column.table, column.name, err)
+		}
+	}
+	return nil
 }
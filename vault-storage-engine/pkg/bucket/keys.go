@@ -0,0 +1,208 @@
+package bucket
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// LegacyKeyID is how versions encrypted directly with the master key, without a data key, are counted
+const LegacyKeyID = "legacy"
+
+// CustomerKeyID is how versions encrypted with a customer supplied key are counted
+const CustomerKeyID = "customer"
+
+// VersionRow is the metadata of a version along with its row in the versions table
+// Rows only ever grow, so they are used to walk all versions in a resumable way
+type VersionRow struct {
+	Row         int64
+	RootVersion string
+	Metadata    VersionMetadata
+}
+
+// ListVersionsAfter returns up to limit versions whose row comes after the given one, in row order
+func ListVersionsAfter(db *sql.DB, afterRow int64, limit int) ([]VersionRow, error) {
+	query := `SELECT id, root_version, metadata FROM versions WHERE id > ? ORDER BY id LIMIT ?`
+	rows, err := db.Query(query, afterRow, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []VersionRow
+	for rows.Next() {
+		var version VersionRow
+		var metadataJSON string
+		if err := rows.Scan(&version.Row, &version.RootVersion, &metadataJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan version: %w", err)
+		}
+		if err := json.Unmarshal([]byte(metadataJSON), &version.Metadata); err != nil {
+			return nil, fmt.Errorf("failed to decode metadata of version row %d: %w", version.Row, err)
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// UpdateVersionMetadata replaces the metadata of a version
+func UpdateVersionMetadata(tx *sql.Tx, row int64, metadata VersionMetadata) error {
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	_, err = tx.Exec(`UPDATE versions SET metadata = ? WHERE id = ?`, string(metadataJSON), row)
+	if err != nil {
+		return fmt.Errorf("failed to update version metadata: %w", err)
+	}
+	return nil
+}
+
+// GetRewrapProgress returns the last version row whose data key was re-wrapped under keyID
+func GetRewrapProgress(db *sql.DB, keyID string) (int64, error) {
+	var row int64
+	err := db.QueryRow(`SELECT last_version_row FROM rewrap_progress WHERE key_id = ?`, keyID).Scan(&row)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get re-wrap progress: %w", err)
+	}
+	return row, nil
+}
+
+// SetRewrapProgress records the last version row whose data key was re-wrapped under keyID
+func SetRewrapProgress(tx *sql.Tx, keyID string, row int64) error {
+	query := `
+		INSERT INTO rewrap_progress (key_id, last_version_row, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(key_id) DO UPDATE SET last_version_row = excluded.last_version_row, updated_at = CURRENT_TIMESTAMP
+	`
+	if _, err := tx.Exec(query, keyID, row); err != nil {
+		return fmt.Errorf("failed to record re-wrap progress: %w", err)
+	}
+	return nil
+}
+
+// CountVersionsByKey returns how many versions have their data key wrapped under each key version
+// Versions without a data key are counted under LegacyKeyID, or CustomerKeyID when a customer supplied the key
+// and ChunkedKeyID when their data lives in deduplicated chunks, whose data keys are counted by CountChunksByKey
+func CountVersionsByKey(db *sql.DB) (map[string]int, error) {
+	counts := make(map[string]int)
+	var after int64
+	for {
+		versions, err := ListVersionsAfter(db, after, 500)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) == 0 {
+			return counts, nil
+		}
+		for _, version := range versions {
+			keyID := LegacyKeyID
+			if version.Metadata.DataKey != nil {
+				keyID = version.Metadata.DataKey.KeyID
+			} else if version.Metadata.CustomerKey != "" {
+				keyID = CustomerKeyID
+			} else if len(version.Metadata.Chunks) > 0 {
+				keyID = ChunkedKeyID
+			}
+			counts[keyID]++
+			after = version.Row
+		}
+	}
+}
+
+// ChunkRow is the metadata of a chunk along with the key of its row in the chunks table
+type ChunkRow struct {
+	BucketID string
+	Hash     string
+	Size     int64
+	Metadata ChunkMetadata
+}
+
+// ListChunksAfter returns up to limit chunks whose bucket and hash come after the given ones, in that order
+// An empty bucket ID starts from the first chunk
+func ListChunksAfter(db *sql.DB, afterBucketID, afterHash string, limit int) ([]ChunkRow, error) {
+	query := `SELECT bucket_id, hash, size, metadata FROM chunks WHERE (bucket_id, hash) > (?, ?) ORDER BY bucket_id, hash LIMIT ?`
+	rows, err := db.Query(query, afterBucketID, afterHash, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %w", err)
+	}
+	defer rows.Close()
+
+	var chunks []ChunkRow
+	for rows.Next() {
+		var chunk ChunkRow
+		var metadataJSON string
+		if err := rows.Scan(&chunk.BucketID, &chunk.Hash, &chunk.Size, &metadataJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan chunk: %w", err)
+		}
+		if err := json.Unmarshal([]byte(metadataJSON), &chunk.Metadata); err != nil {
+			return nil, fmt.Errorf("failed to decode metadata of chunk %s: %w", chunk.Hash, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
+
+// UpdateChunkMetadata replaces the metadata of a chunk
+func UpdateChunkMetadata(tx *sql.Tx, bucketID, hash string, metadata ChunkMetadata) error {
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode chunk metadata: %w", err)
+	}
+
+	_, err = tx.Exec(`UPDATE chunks SET metadata = ? WHERE bucket_id = ? AND hash = ?`, string(metadataJSON), bucketID, hash)
+	if err != nil {
+		return fmt.Errorf("failed to update chunk metadata: %w", err)
+	}
+	return nil
+}
+
+// GetChunkRewrapProgress returns the last chunk whose data key was re-wrapped under keyID
+func GetChunkRewrapProgress(db *sql.DB, keyID string) (string, string, error) {
+	var bucketID, hash string
+	err := db.QueryRow(`SELECT last_bucket_id, last_hash FROM rewrap_chunk_progress WHERE key_id = ?`, keyID).Scan(&bucketID, &hash)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get chunk re-wrap progress: %w", err)
+	}
+	return bucketID, hash, nil
+}
+
+// SetChunkRewrapProgress records the last chunk whose data key was re-wrapped under keyID
+func SetChunkRewrapProgress(tx *sql.Tx, keyID, bucketID, hash string) error {
+	query := `
+		INSERT INTO rewrap_chunk_progress (key_id, last_bucket_id, last_hash, updated_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(key_id) DO UPDATE SET last_bucket_id = excluded.last_bucket_id, last_hash = excluded.last_hash, updated_at = CURRENT_TIMESTAMP
+	`
+	if _, err := tx.Exec(query, keyID, bucketID, hash); err != nil {
+		return fmt.Errorf("failed to record chunk re-wrap progress: %w", err)
+	}
+	return nil
+}
+
+// CountChunksByKey returns how many chunks have their data key wrapped under each key version
+func CountChunksByKey(db *sql.DB) (map[string]int, error) {
+	counts := make(map[string]int)
+	var afterBucketID, afterHash string
+	for {
+		chunks, err := ListChunksAfter(db, afterBucketID, afterHash, 500)
+		if err != nil {
+			return nil, err
+		}
+		if len(chunks) == 0 {
+			return counts, nil
+		}
+		for _, chunk := range chunks {
+			keyID := LegacyKeyID
+			if chunk.Metadata.DataKey != nil {
+				keyID = chunk.Metadata.DataKey.KeyID
+			}
+			counts[keyID]++
+			afterBucketID, afterHash = chunk.BucketID, chunk.Hash
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/erasurecoding"
 	"github.com/google/uuid"
 )
 
@@ -27,7 +28,51 @@ type VersionMetadata struct {
 	CreationDate   string            `json:"creation_date"`
 	Data           []byte            `json:"data"`
 	ShardLocations map[string]string `json:"shard_locations"`
-	Proofs         map[string]string `json:"proofs"`
+	Proofs         map[string]string `json:"proofs"`                // Merkle path of every shard, keyed like the shard locations
+	MerkleRoot     string            `json:"merkle_root,omitempty"` // hex root the proofs lead to, versions without one only kept the last hash of each path
+	DataShards     int               `json:"data_shards,omitempty"`
+	ParityShards   int               `json:"parity_shards,omitempty"`
+	Codecs         *Codecs           `json:"codecs,omitempty"`
+	DataKey        *WrappedKey       `json:"data_key,omitempty"`
+	CustomerKey    string            `json:"customer_key_fingerprint,omitempty"` // fingerprint of the customer supplied key, the key itself is never stored
+	EncodedSize    int64             `json:"encoded_size,omitempty"`             // exact length of the erasure coded data over all stripes
+	StripeSize     int               `json:"stripe_size,omitempty"`
+	Stripes        []StripeMetadata  `json:"stripes,omitempty"`
+	DegradedShards []int             `json:"degraded_shards,omitempty"` // shards that weren't stored when the version was written, left for repair
+	Chunks         []ChunkRef        `json:"chunks,omitempty"`          // set for versions of deduplicated buckets, their data only lives in the chunks
+}
+
+// Codecs records the IDs of the codecs a version was stored with, one per pipeline stage
+type Codecs struct {
+	Compression      string `json:"compression"`
+	CompressionLevel int    `json:"compression_level,omitempty"`
+	Encryption       string `json:"encryption"`
+	ErasureCoding    string `json:"erasure_coding"`
+	AdditionalData   int    `json:"additional_data,omitempty"` // layout of the data every stripe is authenticated with, 0 for none
+}
+
+// WrappedKey is the data key of a version, wrapped by the key encryption key KeyID
+type WrappedKey struct {
+	KeyID string `json:"key_id"`
+	Key   []byte `json:"key"`
+}
+
+// StripeMetadata records the sizes of one stripe of a version
+// Every shard of a version holds one shard of each stripe, stored back to back in stripe order
+// ShardSize includes the header at the start of each shard of the stripe
+type StripeMetadata struct {
+	PlainSize  int64 `json:"plain_size"`
+	CipherSize int64 `json:"cipher_size"`
+	ShardSize  int64 `json:"shard_size"`
+}
+
+// ErasureProfile returns the erasure profile the version was stored with
+// Versions stored before profiles were recorded all used the legacy profile
+func (m *VersionMetadata) ErasureProfile() erasurecoding.Profile {
+	if m.DataShards == 0 {
+		return erasurecoding.LegacyProfile
+	}
+	return erasurecoding.Profile{DataShards: m.DataShards, ParityShards: m.ParityShards}
 }
 
 // ObjectType represents a miniature singleton of an object
@@ -188,15 +233,18 @@ func GetLatestVersion(db *sql.DB, objectID string) string {
 
 	return latestVersionID
 }
+
+// GetRootVersion returns the first version of an object, "initial_version" for an object without versions
 func GetRootVersion(db *sql.DB, objectID string) (string, error) {
-	// Do nothing yet
 	var rootVersion string
 	query := `SELECT version_id FROM versions WHERE object_id = ? ORDER BY version_id ASC LIMIT 1`
 	row := db.QueryRow(query, objectID)
 	err := row.Scan(&rootVersion)
+	if err == sql.ErrNoRows {
+		return "initial_version", nil
+	}
 	if err != nil {
-		// Handle error or set default root version
-		rootVersion = "initial_version"
+		return "", fmt.Errorf("failed to get root version: %w", err)
 	}
 	return rootVersion, nil
 }
@@ -210,6 +258,13 @@ func DeleteObject(db *sql.DB, bucketID, objectID string) error {
 		return fmt.Errorf("failed to delete objects: %w", err)
 	}
 
+	// Challenges for the shards of the versions can't be answered anymore
+	query = "DELETE FROM storage_challenges WHERE object_id = ?"
+	_, err = db.Exec(query, objectID)
+	if err != nil {
+		return fmt.Errorf("failed to delete challenges: %w", err)
+	}
+
 	// Remove the objects
 	query = "DELETE FROM objects WHERE id = ?"
 	_, err = db.Exec(query, objectID)
@@ -225,6 +280,9 @@ func DeleteObjectByVersion(db *sql.DB, bucketID, objectID, versionID string) err
 	if err != nil {
 		return fmt.Errorf("failed to delete object version, %w", err)
 	}
+	if err := DeleteChallenges(db, objectID, versionID); err != nil {
+		return err
+	}
 
 	latest_version_id := GetLatestVersion(db, objectID)
 
@@ -0,0 +1,113 @@
+package bucket
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrObjectConflict is returned when a restored version belongs to an object recorded in another bucket
+var ErrObjectConflict = errors.New("object belongs to another bucket")
+
+// BucketExists reports whether a bucket is recorded
+func BucketExists(db *sql.DB, bucketID string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM buckets WHERE bucket_id = ?)`, bucketID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if bucket exists, %w", err)
+	}
+	return exists, nil
+}
+
+// RestoreVersion records a version rebuilt from its manifest, along with its object when that isn't recorded yet
+// It returns false when the version is already recorded, which is left as it is
+func RestoreVersion(db *sql.DB, rootVersion string, metadata VersionMetadata) (bool, error) {
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	shardLocBytes, err := json.Marshal(metadata.ShardLocations)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode shard locations: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var bucketID string
+	err = tx.QueryRow(`SELECT bucket_id FROM objects WHERE id = ?`, metadata.ObjectID).Scan(&bucketID)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec(`INSERT INTO objects (id, bucket_id, filename, latest_version) VALUES (?, ?, ?, ?)`,
+			metadata.ObjectID, metadata.BucketID, metadata.Filename, metadata.VersionID)
+		if err != nil {
+			return false, fmt.Errorf("failed to add object: %w", err)
+		}
+	case err != nil:
+		return false, fmt.Errorf("failed to check if object exists: %w", err)
+	case bucketID != metadata.BucketID:
+		return false, fmt.Errorf("%w: %s is in bucket %s, not %s", ErrObjectConflict, metadata.ObjectID, bucketID, metadata.BucketID)
+	}
+
+	var versionExists bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM versions WHERE object_id = ? AND version_id = ?)`, metadata.ObjectID, metadata.VersionID).Scan(&versionExists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if version exists: %w", err)
+	}
+	if versionExists {
+		return false, nil
+	}
+
+	query := `
+		INSERT INTO versions (
+			version_id, object_id, bucket_id, root_version,
+			metadata, data, shard_locations, created_at
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`
+	_, err = tx.Exec(query, metadata.VersionID, metadata.ObjectID, metadata.BucketID, rootVersion, metadataJSON, []byte{}, string(shardLocBytes))
+	if err != nil {
+		return false, fmt.Errorf("failed to add version: %w", err)
+	}
+
+	// Versions are restored oldest first, so the object ends up with the filename of its latest version
+	_, err = tx.Exec(`UPDATE objects SET latest_version = ?, filename = ? WHERE id = ?`, metadata.VersionID, metadata.Filename, metadata.ObjectID)
+	if err != nil {
+		return false, fmt.Errorf("failed to update object latest version: %w", err)
+	}
+	return true, tx.Commit()
+}
+
+// RestoreChunk records a chunk rebuilt from its manifest holding refs references
+// The references are added to those of the chunk when it is already recorded
+func RestoreChunk(db *sql.DB, bucketID, hash string, size int64, metadata ChunkMetadata, refs int) error {
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode chunk metadata: %w", err)
+	}
+
+	query := `
+		INSERT INTO chunks (bucket_id, hash, size, metadata, refcount, created_at)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(bucket_id, hash) DO UPDATE SET refcount = refcount + excluded.refcount
+	`
+	_, err = db.Exec(query, bucketID, hash, size, string(metadataJSON), refs)
+	if err != nil {
+		return fmt.Errorf("failed to restore chunk %s: %w", hash, err)
+	}
+	return nil
+}
+
+// ChunkIDExists reports whether a chunk stored under chunkID is recorded, in any bucket
+func ChunkIDExists(db *sql.DB, chunkID string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM chunks WHERE json_extract(metadata, '$.chunk_id') = ?)`, chunkID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if chunk %s exists: %w", chunkID, err)
+	}
+	return exists, nil
+}
@@ -0,0 +1,159 @@
+// Package chunking splits data into content-defined chunks with FastCDC
+// Chunk boundaries depend on the content around them rather than on offsets,
+// so an insertion or deletion only changes the chunks it touches and the rest of the data still deduplicates
+package chunking
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	DefaultMinSize = 16 << 10
+	DefaultAvgSize = 64 << 10
+	DefaultMaxSize = 256 << 10
+)
+
+// Options bounds the size of the chunks, AvgSize has to be a power of two
+// Changing them moves every chunk boundary, data chunked with other options no longer deduplicates
+type Options struct {
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+// DefaultOptions returns the chunk sizes deduplicated buckets are chunked with
+func DefaultOptions() Options {
+	return Options{MinSize: DefaultMinSize, AvgSize: DefaultAvgSize, MaxSize: DefaultMaxSize}
+}
+
+// Validate checks that the sizes can be chunked with
+func (o Options) Validate() error {
+	if o.MinSize <= 0 || o.MinSize > o.AvgSize || o.AvgSize > o.MaxSize {
+		return fmt.Errorf("invalid chunk sizes: min %d, avg %d, max %d", o.MinSize, o.AvgSize, o.MaxSize)
+	}
+	if o.AvgSize&(o.AvgSize-1) != 0 || o.AvgSize < 256 {
+		return fmt.Errorf("average chunk size %d isn't a power of two of at least 256", o.AvgSize)
+	}
+	return nil
+}
+
+// gear maps every byte to a random value for the rolling hash
+// The table is derived from a fixed seed, it must never change or stored chunks stop deduplicating
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x5641554c54434443) // "VAULTCDC"
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Chunker reads data and splits it into chunks
+// FastCDC's normalized chunking is used: a stricter mask before the average size and a looser one after it
+// keeps most chunks close to the average size
+type Chunker struct {
+	r     io.Reader
+	opts  Options
+	maskS uint64
+	maskL uint64
+
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+// NewChunker returns a Chunker reading from r
+func NewChunker(r io.Reader, opts Options) (*Chunker, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	avgBits := bits.TrailingZeros(uint(opts.AvgSize))
+	return &Chunker{
+		r:     r,
+		opts:  opts,
+		maskS: mask(avgBits + 2),
+		maskL: mask(avgBits - 2),
+		buf:   make([]byte, 2*opts.MaxSize),
+	}, nil
+}
+
+// mask returns a mask of the n high bits, the high bits of the gear hash depend on the most bytes
+func mask(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// Next returns the next chunk, or io.EOF once every byte was returned
+// The chunk is only valid until the next call
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// fill reads until MaxSize bytes are buffered or the reader is exhausted
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= c.opts.MaxSize {
+		return nil
+	}
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+	for c.end < len(c.buf) && c.end < c.opts.MaxSize {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if errors.Is(err, io.EOF) {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cut returns the length of the chunk at the start of data
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.opts.MinSize {
+		return n
+	}
+	if n > c.opts.MaxSize {
+		n = c.opts.MaxSize
+	}
+	normal := min(c.opts.AvgSize, n)
+
+	var hash uint64
+	i := c.opts.MinSize
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,53 @@
+package compression
+
+import (
+	"mime"
+	"strings"
+)
+
+// compressedTypes are content types whose formats are already compressed
+var compressedTypes = map[string]bool{
+	"application/zip":              true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/vnd.rar":          true,
+	"application/zstd":             true,
+	"image/jpeg":                   true,
+	"image/png":                    true,
+	"image/gif":                    true,
+	"image/webp":                   true,
+	"image/avif":                   true,
+	"image/heic":                   true,
+	"audio/mpeg":                   true,
+	"audio/aac":                    true,
+	"audio/ogg":                    true,
+	"audio/mp4":                    true,
+	"audio/flac":                   true,
+}
+
+// IsCompressedType reports whether data of a content type is already compressed
+// Video is always treated as compressed
+func IsCompressedType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return compressedTypes[mediaType] || strings.HasPrefix(mediaType, "video/")
+}
+
+// Gain returns the fraction of a sample saved by compressing it with c
+// A negative gain means compression grows the data
+func Gain(c Compressor, sample []byte) (float64, error) {
+	if len(sample) == 0 {
+		return 0, nil
+	}
+	compressed, err := c.Compress(sample)
+	if err != nil {
+		return 0, err
+	}
+	return 1 - float64(len(compressed))/float64(len(sample)), nil
+}
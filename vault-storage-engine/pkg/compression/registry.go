@@ -0,0 +1,76 @@
+package compression
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Codec IDs of the built in compressors
+const (
+	NoneID = "none"
+	LZ4ID  = "lz4"
+	ZstdID = "zstd"
+)
+
+// Constructor creates a Compressor compressing at the given level
+// Level 0 selects the default level of the codec, decompression never depends on the level
+type Constructor func(level int) (Compressor, error)
+
+var (
+	registryMu  sync.RWMutex
+	compressors = make(map[string]Constructor)
+)
+
+func init() {
+	Register(NoneID, func(level int) (Compressor, error) {
+		return None{}, nil
+	})
+	Register(LZ4ID, func(level int) (Compressor, error) {
+		return LZ4{}, nil
+	})
+	Register(ZstdID, NewZstd)
+}
+
+// Register makes a compressor available under a codec ID
+// The ID is recorded with every version compressed by it, so it must never be reused for another format
+func Register(id string, constructor Constructor) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := compressors[id]; exists {
+		panic(fmt.Sprintf("compression: codec %q registered twice", id))
+	}
+	compressors[id] = constructor
+}
+
+// New returns the compressor registered under a codec ID
+func New(id string, level int) (Compressor, error) {
+	registryMu.RLock()
+	constructor, ok := compressors[id]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown compression codec %q", id)
+	}
+	return constructor(level)
+}
+
+// LZ4 is the Compressor for the LZ4 frame format
+type LZ4 struct{}
+
+func (LZ4) Compress(data []byte) ([]byte, error) {
+	return Compress(data)
+}
+
+func (LZ4) Decompress(data []byte) ([]byte, error) {
+	return Decompress(data)
+}
+
+// None stores data as it is, for data that doesn't compress
+type None struct{}
+
+func (None) Compress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (None) Decompress(data []byte) ([]byte, error) {
+	return data, nil
+}
@@ -0,0 +1,60 @@
+package compression
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxDecodedSize bounds the memory a single decompression may use
+// Data is compressed one stripe at a time, stripes are far smaller than this
+const maxDecodedSize = 1 << 30
+
+var (
+	zstdDecoderOnce sync.Once
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderErr  error
+)
+
+// Zstd is the Compressor for the zstd format
+type Zstd struct {
+	encoder *zstd.Encoder
+}
+
+// NewZstd creates a zstd compressor, level follows the zstd command line levels from 1 to 22
+func NewZstd(level int) (Compressor, error) {
+	encoderLevel := zstd.SpeedDefault
+	if level != 0 {
+		if level < 1 || level > 22 {
+			return nil, fmt.Errorf("invalid zstd level %d, expected 1 to 22", level)
+		}
+		encoderLevel = zstd.EncoderLevelFromZstd(level)
+	}
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(encoderLevel))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd encoder, %w", err)
+	}
+	return &Zstd{encoder: encoder}, nil
+}
+
+func (z *Zstd) Compress(data []byte) ([]byte, error) {
+	return z.encoder.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+}
+
+func (z *Zstd) Decompress(data []byte) ([]byte, error) {
+	// The decoder is shared, DecodeAll can be called concurrently
+	zstdDecoderOnce.Do(func() {
+		zstdDecoder, zstdDecoderErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedSize))
+	})
+	if zstdDecoderErr != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder, %w", zstdDecoderErr)
+	}
+
+	plainText, err := zstdDecoder.DecodeAll(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress zstd data, %w", err)
+	}
+	return plainText, nil
+}
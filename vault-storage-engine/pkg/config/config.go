@@ -14,8 +14,40 @@ type Config struct {
 	ShardStoreBasePath string   `yaml:"shard_store_base_path"`
 	EncryptionKey      []byte   `yaml:"-"`
 	EncryptionKeyHex   string   `yaml:"encryption_key"`
+	KeyProvider        string   `yaml:"key_provider"`
+	KeyringPath        string   `yaml:"keyring_path"`
+	KMSURL             string   `yaml:"kms_url"`
+	KMSToken           string   `yaml:"kms_token"`
+	KMSKeyID           string   `yaml:"kms_key_id"`
 	Database           string   `yaml:"db"`
 	ShardLocations     []string `yaml:"shardLocations"`
+	StripeSize         int      `yaml:"stripe_size"`
+	// ManifestKeyPath is the Ed25519 key version manifests are signed with, it is generated on first use
+	ManifestKeyPath string `yaml:"manifest_key_path"`
+	// ManifestPublicKeys are the hex encoded Ed25519 public keys recover-metadata trusts manifests signed with
+	ManifestPublicKeys []string `yaml:"manifest_public_keys"`
+	// WriteQuorum is how many shards of a version have to be stored before it is acknowledged, every shard when 0
+	// Shards missing from a version stored with a lower quorum are recorded as degraded
+	WriteQuorum int `yaml:"write_quorum"`
+	// HedgePercentile is the shard read latency percentile after which reads ask parity shards too, 95 when 0
+	// Reads are never hedged when it is 100 or more
+	HedgePercentile float64 `yaml:"hedge_percentile"`
+	// Compression is the codec new versions are compressed with: lz4, zstd or none
+	Compression      string `yaml:"compression"`
+	CompressionLevel int    `yaml:"compression_level"`
+	// With AdaptiveCompression, versions that are already compressed or that would shrink
+	// by less than CompressionMinGain are stored raw
+	AdaptiveCompression bool    `yaml:"adaptive_compression"`
+	CompressionMinGain  float64 `yaml:"compression_min_gain"`
+	// ShardStore is where storage nodes keep their shards: local (default) or s3
+	ShardStore  string `yaml:"shard_store"`
+	S3Endpoint  string `yaml:"s3_endpoint"`
+	S3Region    string `yaml:"s3_region"`
+	S3Bucket    string `yaml:"s3_bucket"`
+	S3AccessKey string `yaml:"s3_access_key"`
+	S3SecretKey string `yaml:"s3_secret_key"`
+	S3PathStyle bool   `yaml:"s3_path_style"`
+	S3Prefix    string `yaml:"s3_prefix"`
 }
 
 // LoadConfig loads the configuration from a YAML file
@@ -0,0 +1,164 @@
+package datastorage
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/proofofinclusion"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/proofofstorage"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// MinPlacementScore is the score under which storage nodes only receive shards when there are not enough other nodes
+const MinPlacementScore = 0.5
+
+// challengesPerChunkShard is how many challenges are prepared for every shard of a chunk
+// Versions of deduplicated buckets are made of many small chunks, so each of their shards is challenged less often
+const challengesPerChunkShard = 2
+
+// errNodeUnreachable is wrapped by challenges that never got an answer from their node
+var errNodeUnreachable = errors.New("storage node unreachable")
+
+// isNodeLocation reports whether a shard is kept by a storage node, nodes are located by their URL
+func isNodeLocation(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// recordChallenges records the challenges sampled from the shards of a version or chunk
+// Only shards kept by storage nodes have a sampler. Challenges are best effort, shards without any are just never audited
+func recordChallenges(db *sql.DB, objectID, versionID string, locations map[string]string, samplers []*proofofstorage.Sampler, degraded []int, logger *zap.Logger) {
+	skip := make(map[int]bool, len(degraded))
+	for _, idx := range degraded {
+		skip[idx] = true
+	}
+
+	for idx, sampler := range samplers {
+		if sampler == nil || skip[idx] {
+			continue
+		}
+		prepared, err := sampler.Challenges()
+		if err == nil {
+			err = bucket.AddChallenges(db, objectID, versionID, idx, locations[proofofinclusion.ProofKey(idx)], prepared)
+		}
+		if err != nil {
+			logger.Warn("Failed to record storage challenges", zap.String("object_id", objectID), zap.String("version_id", versionID), zap.Int("shard", idx), zap.Error(err))
+		}
+	}
+}
+
+// challengeShard asks the storage node to prove it holds the shard and returns its answer
+func (b *nodeBackend) challengeShard(objectID, versionID string, shardIdx int, nodeURL string, challenge proofofstorage.Challenge) ([]byte, error) {
+	body, err := json.Marshal(challenge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode challenge: %w", err)
+	}
+
+	challengeURL := fmt.Sprintf("%s/challenge/%s/%s/%d", nodeURL, objectID, versionID, shardIdx)
+	resp, err := b.downloadClient.Post(challengeURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errNodeUnreachable, nodeURL, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("shard %d on %s: %w", shardIdx, nodeURL, sharding.ErrShardNotFound)
+	case resp.StatusCode >= 500:
+		return nil, fmt.Errorf("%w: %s responded with %s", errNodeUnreachable, nodeURL, resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("storage node %s refused the challenge with %s", nodeURL, resp.Status)
+	}
+
+	var result proofofstorage.Response
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode answer of %s: %w", nodeURL, err)
+	}
+	proof, err := hex.DecodeString(result.Proof)
+	if err != nil {
+		return nil, fmt.Errorf("storage node %s returned an invalid proof", nodeURL)
+	}
+	return proof, nil
+}
+
+// AuditResult is the outcome of challenging one shard
+type AuditResult struct {
+	ObjectID  string              `json:"object_id"`
+	VersionID string              `json:"version_id"`
+	Shard     int                 `json:"shard"`
+	Node      string              `json:"node"`
+	Outcome   bucket.AuditOutcome `json:"outcome"`
+	Error     string              `json:"error,omitempty"`
+}
+
+// AuditNodes challenges up to n random shards kept by storage nodes and folds the outcomes into the scores of the nodes
+// Every challenge is used once, shards run out of audits once all the challenges prepared when they were written are spent
+func AuditNodes(db *sql.DB, n int, logger *zap.Logger) ([]AuditResult, error) {
+	challenges, err := bucket.TakeRandomChallenges(db, n)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := newNodeBackend(nil, logger)
+	results := make([]AuditResult, 0, len(challenges))
+	for _, c := range challenges {
+		result := AuditResult{ObjectID: c.ObjectID, VersionID: c.VersionID, Shard: c.ShardIdx, Node: c.Location, Outcome: bucket.AuditPassed}
+		proof, err := backend.challengeShard(c.ObjectID, c.VersionID, c.ShardIdx, c.Location, c.Challenge)
+		switch {
+		case errors.Is(err, errNodeUnreachable):
+			result.Outcome = bucket.AuditUnreachable
+			result.Error = err.Error()
+		case err != nil:
+			result.Outcome = bucket.AuditFailed
+			result.Error = err.Error()
+		case hex.EncodeToString(proof) != c.Expected:
+			result.Outcome = bucket.AuditFailed
+			result.Error = "answer doesn't match the shard"
+		}
+
+		if result.Outcome != bucket.AuditPassed {
+			logger.Warn("Storage node failed an audit",
+				zap.String("node", c.Location),
+				zap.String("object_id", c.ObjectID),
+				zap.String("version_id", c.VersionID),
+				zap.Int("shard", c.ShardIdx),
+				zap.String("error", result.Error))
+		}
+		if err := bucket.RecordAudit(db, c.Location, result.Outcome); err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// rankStorageNodes orders the storage nodes by their audit score, nodes that were never audited keep the initial score
+// Nodes under MinPlacementScore are left out as long as enough nodes remain for every shard of a version
+func rankStorageNodes(db *sql.DB, nodes []string, need int, logger *zap.Logger) []string {
+	scores, err := bucket.GetNodeScores(db)
+	if err != nil {
+		logger.Warn("Failed to get node scores, nodes are used in discovery order", zap.Error(err))
+		return nodes
+	}
+	score := func(node string) float64 {
+		if s, ok := scores[node]; ok {
+			return s.Score
+		}
+		return bucket.InitialNodeScore
+	}
+
+	ranked := append([]string(nil), nodes...)
+	sort.SliceStable(ranked, func(i, j int) bool { return score(ranked[i]) > score(ranked[j]) })
+	for len(ranked) > need && score(ranked[len(ranked)-1]) < MinPlacementScore {
+		ranked = ranked[:len(ranked)-1]
+	}
+	return ranked
+}
@@ -0,0 +1,393 @@
+package datastorage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/utils"
+	"go.uber.org/zap"
+)
+
+// shardBackend is where the shards of a version are written to and read from
+// The local shard store and the remote storage nodes share the same stripe pipeline through it
+type shardBackend interface {
+	// openWriter starts writing a shard and returns the location it is written to
+	openWriter(objectID, versionID string, shardIdx int) (shardWriter, string, error)
+	// openReader opens length bytes of a stored shard starting at offset
+	openReader(objectID, versionID string, shardIdx int, location string, offset, length int64) (io.ReadCloser, error)
+	// readShard returns the full contents of a stored shard
+	readShard(objectID, versionID string, shardIdx int, location string) ([]byte, error)
+	// putShard stores a small shard whole at the given location
+	putShard(objectID, versionID string, shardIdx int, location string, data []byte) error
+	// deleteShard deletes a stored shard, deleting a shard that isn't stored succeeds
+	deleteShard(objectID, versionID string, shardIdx int, location string) error
+	// hashShard returns the SHA-256 of a stored shard of size bytes, -1 when the size isn't known
+	// Backends hash the shard where it is kept when they can, so it doesn't have to be fetched
+	hashShard(objectID, versionID string, shardIdx int, location string, size int64) ([]byte, error)
+}
+
+// shardWriter receives the shard of every stripe of a version in order
+type shardWriter interface {
+	io.Writer
+	// Close completes the shard, the shard is only stored once Close succeeds
+	Close() error
+	// Abort discards a partially written shard
+	Abort(err error)
+}
+
+// storeBackend writes shards to a ShardStore, shard n is kept in the nth location
+// Profiles with more shards than locations wrap around the locations
+type storeBackend struct {
+	store     sharding.ShardStore
+	locations []string
+}
+
+func (b *storeBackend) openWriter(objectID, versionID string, shardIdx int) (shardWriter, string, error) {
+	if len(b.locations) == 0 {
+		return nil, "", fmt.Errorf("no storage locations configured for shard %d", shardIdx)
+	}
+	location := b.locations[shardIdx%len(b.locations)] // Use configured storage locations
+
+	streaming, ok := b.store.(sharding.StreamingShardStore)
+	if !ok {
+		// Stores that only take whole shards have to buffer them
+		return &bufferedShardWriter{
+			store:     b.store,
+			objectID:  objectID,
+			versionID: versionID,
+			shardIdx:  shardIdx,
+			location:  location,
+		}, location, nil
+	}
+
+	w, err := streaming.OpenShardWriter(objectID, versionID, shardIdx, location)
+	if err != nil {
+		return nil, "", err
+	}
+	return &storeShardWriter{
+		WriteCloser: w,
+		discard: func() {
+			b.store.DeleteShardByVersion(objectID, versionID, shardIdx, location)
+		},
+	}, location, nil
+}
+
+func (b *storeBackend) openReader(objectID, versionID string, shardIdx int, location string, offset, length int64) (io.ReadCloser, error) {
+	if streaming, ok := b.store.(sharding.StreamingShardStore); ok {
+		return streaming.OpenShardReader(objectID, versionID, shardIdx, location, offset, length)
+	}
+
+	shard, err := b.store.RetrieveShard(objectID, versionID, shardIdx, location)
+	if err != nil {
+		return nil, err
+	}
+	if offset+length > int64(len(shard)) {
+		return nil, fmt.Errorf("shard %d is too short: %d bytes", shardIdx, len(shard))
+	}
+	return io.NopCloser(bytes.NewReader(shard[offset : offset+length])), nil
+}
+
+func (b *storeBackend) readShard(objectID, versionID string, shardIdx int, location string) ([]byte, error) {
+	return b.store.RetrieveShard(objectID, versionID, shardIdx, location)
+}
+
+func (b *storeBackend) deleteShard(objectID, versionID string, shardIdx int, location string) error {
+	return b.store.DeleteShardByVersion(objectID, versionID, shardIdx, location)
+}
+
+func (b *storeBackend) putShard(objectID, versionID string, shardIdx int, location string, data []byte) error {
+	return b.store.StoreShard(objectID, versionID, shardIdx, data, location)
+}
+
+func (b *storeBackend) hashShard(objectID, versionID string, shardIdx int, location string, size int64) ([]byte, error) {
+	if size < 0 {
+		shard, err := b.readShard(objectID, versionID, shardIdx, location)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(shard)
+		return sum[:], nil
+	}
+
+	rc, err := b.openReader(objectID, versionID, shardIdx, location, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return hashStream(rc, size, sharding.ShardKey{Location: location, ObjectID: objectID, VersionID: versionID, Index: shardIdx}.String())
+}
+
+// hashStream hashes a shard read from r, failing unless it holds exactly size bytes, name is what errors call the shard
+func hashStream(r io.Reader, size int64, name string) ([]byte, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	if n != size {
+		return nil, &sharding.CorruptShardError{Path: name, Reason: fmt.Sprintf("shard holds %d bytes, expected %d", n, size)}
+	}
+	return h.Sum(nil), nil
+}
+
+type storeShardWriter struct {
+	io.WriteCloser
+	discard func()
+}
+
+func (w *storeShardWriter) Abort(err error) {
+	w.WriteCloser.Close()
+	w.discard()
+}
+
+type bufferedShardWriter struct {
+	bytes.Buffer
+	store     sharding.ShardStore
+	objectID  string
+	versionID string
+	shardIdx  int
+	location  string
+}
+
+func (w *bufferedShardWriter) Close() error {
+	return w.store.StoreShard(w.objectID, w.versionID, w.shardIdx, w.Bytes(), w.location)
+}
+
+func (w *bufferedShardWriter) Abort(err error) {
+	w.Reset()
+}
+
+// nodeBackend writes shards to storage nodes over HTTP, shard n is sent to the nth node
+type nodeBackend struct {
+	nodes []string
+	// streams last as long as the object takes to read or write, so only the wait for a response is bounded
+	streamClient *http.Client
+	// In real time production we'll need to configure mTLS here
+	downloadClient *http.Client
+	logger         *zap.Logger
+}
+
+func newNodeBackend(nodes []string, logger *zap.Logger) *nodeBackend {
+	return &nodeBackend{
+		nodes: nodes,
+		streamClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				ResponseHeaderTimeout: 30 * time.Second,
+			},
+		},
+		downloadClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+		logger: logger,
+	}
+}
+
+func (b *nodeBackend) openWriter(objectID, versionID string, shardIdx int) (shardWriter, string, error) {
+	// This should get the URL of the nodes storing a particular shard
+	nodeURL := b.nodes[shardIdx%len(b.nodes)]
+	uploadURL := fmt.Sprintf("%s/shards/%s/%s/%d", nodeURL, objectID, versionID, shardIdx)
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("PUT", uploadURL, pr)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create upload request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := b.streamClient.Do(req)
+		// Unblock the stripe writer if the node answered before reading the whole shard
+		pr.Close()
+		if err != nil {
+			done <- err
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			done <- fmt.Errorf("storage node %s responded with %s", nodeURL, resp.Status)
+			return
+		}
+		done <- nil
+	}()
+
+	return &nodeShardWriter{pw: pw, done: done}, nodeURL, nil
+}
+
+func (b *nodeBackend) openReader(objectID, versionID string, shardIdx int, nodeURL string, offset, length int64) (io.ReadCloser, error) {
+	downloadURL := fmt.Sprintf("%s/shards/%s/%s/%d", nodeURL, objectID, versionID, shardIdx)
+
+	var downloadErr error
+	for attempt := 1; attempt <= maxDownloadRetries; attempt++ {
+		req, err := http.NewRequest("GET", downloadURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create download request: %w", err)
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+		resp, err := b.streamClient.Do(req)
+		if err == nil {
+			switch {
+			case resp.StatusCode == http.StatusPartialContent:
+				return resp.Body, nil
+			case resp.StatusCode == http.StatusOK && offset == 0:
+				// The node ignored the range and sent the whole shard
+				return struct {
+					io.Reader
+					io.Closer
+				}{io.LimitReader(resp.Body, length), resp.Body}, nil
+			}
+			resp.Body.Close()
+			err = fmt.Errorf("storage node responded with %s", resp.Status)
+		}
+
+		downloadErr = err
+		b.logger.Warn("download failed, retrying...",
+			zap.Int("shard", shardIdx),
+			zap.String("node", nodeURL),
+			zap.Int("attempt", attempt),
+			zap.Error(err))
+		time.Sleep(time.Duration(attempt) * baseBackoff)
+	}
+	return nil, downloadErr
+}
+
+func (b *nodeBackend) readShard(objectID, versionID string, shardIdx int, nodeURL string) ([]byte, error) {
+	downloadURL := fmt.Sprintf("%s/shards/%s/%s/%d", nodeURL, objectID, versionID, shardIdx)
+
+	var shard []byte
+	var downloadErr error
+	for attempt := 1; attempt <= maxDownloadRetries; attempt++ {
+		req, err := http.NewRequest("GET", downloadURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create download request: %w", err)
+		}
+
+		resp, err := b.downloadClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			if resp != nil {
+				resp.Body.Close()
+				err = fmt.Errorf("storage node responded with %s", resp.Status)
+			}
+			downloadErr = err
+			b.logger.Warn("download failed, retrying...",
+				zap.Int("shard", shardIdx),
+				zap.String("node", nodeURL),
+				zap.Int("attempt", attempt),
+				zap.Error(err))
+			time.Sleep(time.Duration(attempt) * baseBackoff)
+			continue
+		}
+
+		shard, downloadErr = utils.ReadAllWithBuffer(resp.Body)
+		resp.Body.Close()
+		if downloadErr == nil {
+			return shard, nil
+		}
+
+		b.logger.Warn("read shard failed, retrying...",
+			zap.Int("shard", shardIdx),
+			zap.String("node", nodeURL),
+			zap.Int("attempt", attempt),
+			zap.Error(downloadErr))
+		time.Sleep(time.Duration(attempt) * baseBackoff)
+	}
+	return nil, downloadErr
+}
+
+func (b *nodeBackend) putShard(objectID, versionID string, shardIdx int, nodeURL string, data []byte) error {
+	uploadURL := fmt.Sprintf("%s/shards/%s/%s/%d", nodeURL, objectID, versionID, shardIdx)
+	req, err := http.NewRequest("PUT", uploadURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create upload request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := b.downloadClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to contact storage node %s: %w", nodeURL, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("storage node %s responded with %s", nodeURL, resp.Status)
+	}
+	return nil
+}
+
+func (b *nodeBackend) deleteShard(objectID, versionID string, shardIdx int, nodeURL string) error {
+	deleteURL := fmt.Sprintf("%s/shards/%s/%s/%d", nodeURL, objectID, versionID, shardIdx)
+	req, err := http.NewRequest("DELETE", deleteURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create delete request: %w", err)
+	}
+
+	resp, err := b.downloadClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to contact storage node %s: %w", nodeURL, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("storage node %s responded with %s", nodeURL, resp.Status)
+	}
+	return nil
+}
+
+// hashShard asks the storage node to hash the shard, the shard never leaves the node
+func (b *nodeBackend) hashShard(objectID, versionID string, shardIdx int, nodeURL string, size int64) ([]byte, error) {
+	verifyURL := fmt.Sprintf("%s/verify/%s/%s/%d", nodeURL, objectID, versionID, shardIdx)
+	resp, err := b.downloadClient.Get(verifyURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to contact storage node %s: %w", nodeURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("storage node %s responded with %s", nodeURL, resp.Status)
+	}
+
+	var result ShardVerification
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode verification of shard %d: %w", shardIdx, err)
+	}
+	switch {
+	case !result.Exists:
+		return nil, fmt.Errorf("shard %d on %s: %w", shardIdx, nodeURL, sharding.ErrShardNotFound)
+	case result.Corrupt != "":
+		return nil, &sharding.CorruptShardError{Path: verifyURL, Reason: result.Corrupt}
+	case size >= 0 && result.Size != size:
+		return nil, &sharding.CorruptShardError{Path: verifyURL, Reason: fmt.Sprintf("shard holds %d bytes, expected %d", result.Size, size)}
+	}
+
+	sum, err := hex.DecodeString(result.SHA256)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("storage node %s returned an invalid shard hash", nodeURL)
+	}
+	return sum, nil
+}
+
+type nodeShardWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *nodeShardWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *nodeShardWriter) Close() error {
+	w.pw.Close()
+	return <-w.done
+}
+
+func (w *nodeShardWriter) Abort(err error) {
+	// Failing the request body makes the storage node discard the shard
+	w.pw.CloseWithError(err)
+	<-w.done
+}
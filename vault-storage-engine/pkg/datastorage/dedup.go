@@ -0,0 +1,607 @@
+package datastorage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/chunking"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/manifest"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/proofofinclusion"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/proofofstorage"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// ErrDedupCustomerKey is returned when a version of a deduplicated bucket is stored with a customer key
+// Chunks are shared between versions, they can't be encrypted with a key only one of them knows
+var ErrDedupCustomerKey = errors.New("deduplicated buckets don't take customer keys, their chunks are shared between versions")
+
+// unreferencedChunkBatch is how many unreferenced chunks garbage collection picks up at once
+const unreferencedChunkBatch = 500
+
+// challengedChunksPerVersion is how many of the new chunks of a version get challenges
+// Each gets challengesPerChunkShard per shard, so a version prepares as many challenges per shard index as one that isn't deduplicated
+const challengedChunksPerVersion = proofofstorage.ChallengesPerShard / challengesPerChunkShard
+
+// chunkStore stores the chunks of a version of a deduplicated bucket
+// Chunks the bucket already holds only gain a reference, new chunks are erasure coded and uploaded as a single stripe
+// The new chunks of a version share a data key and codecs, picked when the first of them is stored. They also share
+// a chunk set, a single manifest recording all of them, and the challenges of a few of them sampled at random
+type chunkStore struct {
+	db       *sql.DB
+	bucketID string
+	filePath string
+	profile  erasurecoding.Profile
+	quorum   int
+	backend  shardBackend
+	cfg      *config.Config
+	logger   *zap.Logger
+
+	pipeline   *Pipeline
+	key        []byte
+	wrappedKey *bucket.WrappedKey
+
+	// set is the chunk set of the new chunks, created along with the first of them
+	set       *bucket.ChunkSetRef
+	newChunks []manifest.ChunkManifest
+	// challenged holds the new chunks challenges are recorded for
+	challenged []challengedChunk
+
+	stored int
+	reused int
+}
+
+// challengedChunk is a new chunk with the samplers of its shards
+type challengedChunk struct {
+	metadata bucket.ChunkMetadata
+	samplers []*proofofstorage.Sampler
+}
+
+// storeChunkedVersion splits a version of a deduplicated bucket into content-defined chunks and records its metadata
+// The references taken on the chunks are released again if the version can't be stored
+func storeChunkedVersion(db *sql.DB, r io.Reader, bucketID, objectID, versionID, filePath string, profile erasurecoding.Profile, backend shardBackend, cfg *config.Config, logger *zap.Logger) (map[string]string, []string, error) {
+	chunker, err := chunking.NewChunker(r, chunking.DefaultOptions())
+	if err != nil {
+		return nil, nil, err
+	}
+	store := &chunkStore{
+		db:       db,
+		bucketID: bucketID,
+		filePath: filePath,
+		profile:  profile,
+		quorum:   writeQuorum(cfg, profile),
+		backend:  backend,
+		cfg:      cfg,
+		logger:   logger,
+	}
+
+	var refs []bucket.ChunkRef
+	var size int64
+	release := func() {
+		// Chunks stored for the version may already be shared by others, so they are recorded all the same
+		store.record()
+		if err := bucket.ReleaseChunks(db, bucketID, refs); err != nil {
+			logger.Warn("Failed to release the chunks of a version that wasn't stored", zap.String("object_id", objectID), zap.String("version_id", versionID), zap.Error(err))
+		}
+	}
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			release()
+			return nil, nil, fmt.Errorf("failed to read object data: %w", err)
+		}
+
+		ref, err := store.put(data)
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		refs = append(refs, ref)
+		size += ref.Size
+	}
+	// An empty object is a single empty chunk, so every version of a deduplicated bucket has chunks
+	if len(refs) == 0 {
+		ref, err := store.put(nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		refs = append(refs, ref)
+	}
+	store.record()
+
+	metadata := bucket.VersionMetadata{
+		BucketID:       bucketID,
+		ObjectID:       objectID,
+		VersionID:      versionID,
+		Filename:       filepath.Base(filePath),
+		Filesize:       fmt.Sprintf("%d", size),
+		Format:         strings.TrimPrefix(filepath.Ext(filePath), "."),
+		CreationDate:   time.Now().Format(time.RFC3339),
+		ShardLocations: map[string]string{},
+		Proofs:         map[string]string{},
+		DataShards:     profile.DataShards,
+		ParityShards:   profile.ParityShards,
+		Chunks:         refs,
+	}
+
+	root_version, err := bucket.GetRootVersion(db, objectID)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	if err := bucket.AddVersion(db, bucketID, objectID, versionID, root_version, metadata, []byte{}); err != nil {
+		release()
+		return nil, nil, fmt.Errorf("failed to add version to database: %w", err)
+	}
+	if err := bucket.AddObject(db, bucketID, objectID, filepath.Base(filePath)); err != nil {
+		// A version without its object can't be reached, it is removed before its chunks are released
+		// The chunks stay referenced as long as the version row is left
+		if deleteErr := bucket.DeleteObjectByVersion(db, bucketID, objectID, versionID); deleteErr != nil {
+			logger.Warn("Failed to remove a version whose object wasn't registered", zap.String("object_id", objectID), zap.String("version_id", versionID), zap.Error(deleteErr))
+			return nil, nil, fmt.Errorf("failed to register object in bucket: %w", err)
+		}
+		release()
+		return nil, nil, fmt.Errorf("failed to register object in bucket: %w", err)
+	}
+
+	// The version has no shards of its own, its manifest is kept next to the shards of its first chunk
+	if locations, err := versionManifestLocations(db, &metadata); err != nil {
+		logger.Warn("Failed to locate the manifest of the version", zap.String("object_id", objectID), zap.String("version_id", versionID), zap.Error(err))
+	} else {
+		storeManifest(versionManifest(db, metadata, root_version), locations, backend, cfg, logger)
+	}
+
+	logger.Info("Stored deduplicated version",
+		zap.String("object_id", objectID),
+		zap.String("version_id", versionID),
+		zap.Int("chunks", len(refs)),
+		zap.Int("new_chunks", store.stored),
+		zap.Int("shared_chunks", store.reused))
+	return metadata.ShardLocations, nil, nil
+}
+
+// put takes a reference to the chunk holding data, storing the chunk first if the bucket doesn't hold it yet
+func (s *chunkStore) put(data []byte) (bucket.ChunkRef, error) {
+	sum := sha256.Sum256(data)
+	ref := bucket.ChunkRef{Hash: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+
+	ok, err := bucket.AcquireChunk(s.db, s.bucketID, ref.Hash)
+	if err != nil {
+		return ref, err
+	}
+	if ok {
+		s.reused++
+		return ref, nil
+	}
+
+	slot := s.challengeSlot()
+	metadata, samplers, err := s.upload(data, slot >= 0)
+	if err != nil {
+		return ref, err
+	}
+	// The manifest of the set is kept next to the shards of its first chunk
+	if s.set == nil {
+		s.set = &bucket.ChunkSetRef{ID: uuid.New().String(), Locations: manifestLocations(metadata.ShardLocations, metadata.DegradedShards)}
+	}
+	metadata.ChunkSet = s.set
+	added, err := bucket.AddChunk(s.db, s.bucketID, ref.Hash, ref.Size, metadata)
+	if err == nil && added {
+		s.newChunks = append(s.newChunks, manifest.ChunkManifest{Hash: ref.Hash, Size: ref.Size, Metadata: metadata})
+		if slot >= 0 {
+			challenged := challengedChunk{metadata: metadata, samplers: samplers}
+			if slot == len(s.challenged) {
+				s.challenged = append(s.challenged, challenged)
+			} else {
+				s.challenged[slot] = challenged
+			}
+		}
+		s.stored++
+		return ref, nil
+	}
+
+	// Another version stored the same chunk in the meantime, its copy is used and ours is thrown away
+	s.discard(metadata)
+	if err != nil {
+		return ref, err
+	}
+	if ok, err = bucket.AcquireChunk(s.db, s.bucketID, ref.Hash); err != nil {
+		return ref, err
+	}
+	if !ok {
+		return ref, fmt.Errorf("chunk %s was collected while it was being stored", ref.Hash)
+	}
+	s.reused++
+	return ref, nil
+}
+
+// challengeSlot picks whether the next new chunk gets challenges, and which of the challenged chunks it replaces
+// Every new chunk of the version is equally likely to end up challenged, -1 leaves the chunk without challenges
+func (s *chunkStore) challengeSlot() int {
+	if s.stored < challengedChunksPerVersion {
+		return s.stored
+	}
+	if slot := rand.Intn(s.stored + 1); slot < challengedChunksPerVersion {
+		return slot
+	}
+	return -1
+}
+
+// record stores the manifest of the chunk set and the challenges of the new chunks stored so far
+func (s *chunkStore) record() {
+	if len(s.newChunks) == 0 {
+		return
+	}
+	storeManifest(chunkSetManifest(s.bucketID, s.set, s.newChunks), s.set.Locations, s.backend, s.cfg, s.logger)
+	for _, chunk := range s.challenged {
+		recordChallenges(s.db, chunk.metadata.ChunkID, bucket.ChunkVersionID, chunk.metadata.ShardLocations, chunk.samplers, chunk.metadata.DegradedShards, s.logger)
+	}
+	s.newChunks, s.challenged = nil, nil
+}
+
+// upload encodes a chunk as a single stripe and uploads its shards, the chunk is acknowledged once a write quorum of them is stored
+// With challenged, the samplers of the shards kept by storage nodes are returned, their challenges are only recorded once the chunk is added
+func (s *chunkStore) upload(data []byte, challenged bool) (bucket.ChunkMetadata, []*proofofstorage.Sampler, error) {
+	if s.pipeline == nil {
+		codecs, err := chooseCodecs(s.cfg, s.filePath, data)
+		if err != nil {
+			return bucket.ChunkMetadata{}, nil, err
+		}
+		if s.pipeline, err = NewPipeline(codecs, s.profile); err != nil {
+			return bucket.ChunkMetadata{}, nil, err
+		}
+
+		provider, err := keyProvider(s.cfg)
+		if err != nil {
+			return bucket.ChunkMetadata{}, nil, err
+		}
+		dataKey, err := provider.GenerateDataKey()
+		if err != nil {
+			return bucket.ChunkMetadata{}, nil, err
+		}
+		s.key = dataKey.Plaintext
+		s.wrappedKey = &bucket.WrappedKey{KeyID: dataKey.KeyID, Key: dataKey.Wrapped}
+	}
+
+	chunkID := uuid.New().String()
+	s.pipeline.Bind(s.bucketID, chunkID, bucket.ChunkVersionID, 0)
+	shards, stripe, err := s.pipeline.EncodeStripe(0, data, s.key)
+	if err != nil {
+		return bucket.ChunkMetadata{}, nil, err
+	}
+
+	// Chunks get proofs of their own, like the shards of versions
+	digests := make([][]byte, len(shards))
+	for idx, shard := range shards {
+		sum := sha256.Sum256(shard)
+		digests[idx] = sum[:]
+	}
+	tree, err := proofofinclusion.BuildMerkleTree(digests)
+	if err != nil {
+		return bucket.ChunkMetadata{}, nil, fmt.Errorf("failed to build Merkle tree: %w", err)
+	}
+	proofs := make(map[string]string, len(shards))
+	for idx := range shards {
+		proof, err := tree.GetProof(idx)
+		if err != nil {
+			return bucket.ChunkMetadata{}, nil, fmt.Errorf("failed to get proof: %w", err)
+		}
+		proofs[proofofinclusion.ProofKey(idx)] = proof.String()
+	}
+
+	metadata := bucket.ChunkMetadata{
+		ChunkID:        chunkID,
+		ShardLocations: make(map[string]string),
+		DataShards:     s.profile.DataShards,
+		ParityShards:   s.profile.ParityShards,
+		Codecs:         &s.pipeline.Codecs,
+		DataKey:        s.wrappedKey,
+		Stripe:         stripe,
+		Proofs:         proofs,
+		MerkleRoot:     hex.EncodeToString(tree.Root()),
+	}
+
+	uploads := newShardUploads(s.profile.Total(), s.quorum)
+	samplers := make([]*proofofstorage.Sampler, s.profile.Total())
+	for idx := range uploads.uploads {
+		w, location, err := s.backend.openWriter(chunkID, bucket.ChunkVersionID, idx)
+		if err != nil {
+			s.logger.Warn("Failed to open chunk shard", zap.String("chunk_id", chunkID), zap.Int("shard", idx), zap.Error(err))
+			uploads.errs[idx] = err
+			continue
+		}
+		uploads.uploads[idx] = startShardUpload(w)
+		metadata.ShardLocations[fmt.Sprintf("shard_%d", idx)] = location
+		if challenged && isNodeLocation(location) {
+			samplers[idx] = proofofstorage.NewSampler(challengesPerChunkShard)
+			samplers[idx].Write(shards[idx])
+		}
+	}
+	if err := uploads.checkQuorum(); err != nil {
+		uploads.abort()
+		return bucket.ChunkMetadata{}, nil, err
+	}
+	if err := uploads.write(shards); err != nil {
+		uploads.abort()
+		return bucket.ChunkMetadata{}, nil, err
+	}
+
+	degraded, err := uploads.close()
+	if err != nil {
+		// Shards that were stored before the quorum was lost would never be referenced
+		s.discard(metadata)
+		return bucket.ChunkMetadata{}, nil, err
+	}
+	metadata.DegradedShards = degraded
+	return metadata, samplers, nil
+}
+
+// discard deletes the shards of a chunk that was never recorded
+func (s *chunkStore) discard(metadata bucket.ChunkMetadata) {
+	deleteChunkShards(metadata, s.backend, s.logger)
+}
+
+// deleteChunkShards deletes every shard of a chunk
+func deleteChunkShards(metadata bucket.ChunkMetadata, backend shardBackend, logger *zap.Logger) {
+	for shardKey, location := range metadata.ShardLocations {
+		shardIdx, err := strconv.Atoi(strings.TrimPrefix(shardKey, "shard_"))
+		if err != nil {
+			logger.Warn("invalid shard index", zap.String("shardKey", shardKey), zap.Error(err))
+			continue
+		}
+		if err := backend.deleteShard(metadata.ChunkID, bucket.ChunkVersionID, shardIdx, location); err != nil {
+			logger.Warn("Failed to delete chunk shard", zap.String("chunk_id", metadata.ChunkID), zap.Int("shard", shardIdx), zap.String("location", location), zap.Error(err))
+		}
+	}
+	deleteManifests(metadata.ChunkID, bucket.ChunkVersionID, manifestLocations(metadata.ShardLocations, nil), backend, logger)
+}
+
+// deleteChunkSet deletes the manifest of a chunk set once none of its chunks is recorded anymore
+func deleteChunkSet(db *sql.DB, set *bucket.ChunkSetRef, backend shardBackend, logger *zap.Logger) {
+	inUse, err := bucket.ChunkSetInUse(db, set.ID)
+	if err != nil {
+		logger.Warn("Failed to check if the chunk set is in use", zap.String("set_id", set.ID), zap.Error(err))
+		return
+	}
+	if !inUse {
+		deleteManifests(set.ID, bucket.ChunkSetVersionID, set.Locations, backend, logger)
+	}
+}
+
+// CollectChunks deletes the chunks no version refers to anymore and returns how many were deleted
+// Chunks stored across storage nodes are located by the URL of their node, their shards are deleted through the node,
+// the shards of other chunks are deleted from store
+func CollectChunks(db *sql.DB, store sharding.ShardStore, logger *zap.Logger) (int, error) {
+	backend := newRoutedBackend(store, logger)
+
+	collected := 0
+	for {
+		// Chunks acquired again since they were listed keep their references and aren't listed twice
+		chunks, err := bucket.ListUnreferencedChunks(db, unreferencedChunkBatch)
+		if err != nil {
+			return collected, err
+		}
+		if len(chunks) == 0 {
+			return collected, nil
+		}
+
+		for _, chunk := range chunks {
+			// The chunk is removed from the database first, once it is gone no version can acquire it
+			deleted, err := bucket.DeleteUnreferencedChunk(db, chunk.BucketID, chunk.Hash)
+			if err != nil {
+				return collected, err
+			}
+			if !deleted {
+				continue
+			}
+			deleteChunkShards(chunk.Metadata, backend, logger)
+			if err := bucket.DeleteChallenges(db, chunk.Metadata.ChunkID, bucket.ChunkVersionID); err != nil {
+				logger.Warn("Failed to delete chunk challenges", zap.String("chunk_id", chunk.Metadata.ChunkID), zap.Error(err))
+			}
+			if set := chunk.Metadata.ChunkSet; set != nil {
+				deleteChunkSet(db, set, backend, logger)
+			}
+			collected++
+		}
+	}
+}
+
+// openChunkedObject opens a version of a deduplicated bucket for reading, every chunk is read as a stripe of its own
+func openChunkedObject(db *sql.DB, metadata *bucket.VersionMetadata, filename string, backend shardBackend, cfg *config.Config, customerKey []byte, logger *zap.Logger) (*ObjectReader, error) {
+	if customerKey != nil {
+		return nil, fmt.Errorf("failed to get encryption key: %w", ErrCustomerKeyUnexpected)
+	}
+
+	hashes := make([]string, len(metadata.Chunks))
+	for i, ref := range metadata.Chunks {
+		hashes[i] = ref.Hash
+	}
+	found, err := bucket.GetChunks(db, metadata.BucketID, hashes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve chunks: %w", err)
+	}
+
+	chunks := make([]bucket.Chunk, len(metadata.Chunks))
+	keys := make([][]byte, len(metadata.Chunks))
+	stripes := make([]bucket.StripeMetadata, len(metadata.Chunks))
+	// Every chunk stored by the same version shares a data key, each key is only unwrapped once
+	unwrapped := make(map[string][]byte)
+	provider, err := keyProvider(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get encryption key: %w", err)
+	}
+	for i, ref := range metadata.Chunks {
+		chunk, ok := found[ref.Hash]
+		if !ok || chunk.Size != ref.Size || chunk.Metadata.DataKey == nil {
+			return nil, fmt.Errorf("corrupt metadata: chunk %s of the version isn't stored", ref.Hash)
+		}
+		if err := chunk.Metadata.ErasureProfile().Validate(); err != nil {
+			return nil, fmt.Errorf("corrupt metadata of chunk %s: %w", ref.Hash, err)
+		}
+
+		wrapped := chunk.Metadata.DataKey
+		id := wrapped.KeyID + "/" + hex.EncodeToString(wrapped.Key)
+		if _, ok := unwrapped[id]; !ok {
+			key, err := provider.Unwrap(wrapped.KeyID, wrapped.Key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get encryption key: %w", err)
+			}
+			unwrapped[id] = key
+		}
+
+		chunks[i] = chunk
+		keys[i] = unwrapped[id]
+		stripes[i] = bucket.StripeMetadata{PlainSize: ref.Size}
+	}
+
+	modTime, _ := time.Parse(time.RFC3339, metadata.CreationDate)
+	o := &ObjectReader{
+		backend:    backend,
+		objectID:   metadata.ObjectID,
+		versionID:  metadata.VersionID,
+		filename:   filename,
+		modTime:    modTime,
+		profile:    metadata.ErasureProfile(),
+		logger:     logger,
+		chunks:     chunks,
+		chunkKeys:  keys,
+		pipelines:  make(map[pipelineKey]*Pipeline),
+		currentIdx: -1,
+	}
+	o.setStripes(stripes)
+	return o, nil
+}
+
+// pipelineKey identifies the pipelines chunks can share, chunks stored by different versions may use different codecs
+type pipelineKey struct {
+	codecs  bucket.Codecs
+	profile erasurecoding.Profile
+}
+
+// loadChunk fetches and decodes a chunk of a deduplicated version
+// Chunks are small, so their data shards are fetched at once and parity shards are only fetched in place of shards that failed
+func (o *ObjectReader) loadChunk(chunkIdx int) error {
+	chunk := o.chunks[chunkIdx]
+	profile := chunk.Metadata.ErasureProfile()
+
+	key := pipelineKey{codecs: legacyCodecs, profile: profile}
+	if chunk.Metadata.Codecs != nil {
+		key.codecs = *chunk.Metadata.Codecs
+	}
+	pipeline, ok := o.pipelines[key]
+	if !ok {
+		var err error
+		if pipeline, err = NewPipeline(key.codecs, profile); err != nil {
+			return fmt.Errorf("failed to assemble pipeline of chunk %s: %w", chunk.Hash, err)
+		}
+		o.pipelines[key] = pipeline
+	}
+	pipeline.Bind(chunk.BucketID, chunk.Metadata.ChunkID, bucket.ChunkVersionID, 0)
+
+	locations := make([]string, profile.Total())
+	for shardKey, location := range chunk.Metadata.ShardLocations {
+		shardIdx, err := strconv.Atoi(strings.TrimPrefix(shardKey, "shard_"))
+		if err != nil || shardIdx < 0 || shardIdx >= len(locations) {
+			o.logger.Warn("Invalid shard index", zap.String("shardKey", shardKey))
+			continue
+		}
+		locations[shardIdx] = location
+	}
+	for _, shardIdx := range chunk.Metadata.DegradedShards {
+		if shardIdx >= 0 && shardIdx < len(locations) {
+			locations[shardIdx] = ""
+		}
+	}
+
+	shards := make([][]byte, len(locations))
+	received, next := 0, 0
+	fetch := func(need int) {
+		for received < need {
+			var batch []int
+			for ; next < len(locations) && len(batch) < need-received; next++ {
+				if locations[next] != "" {
+					batch = append(batch, next)
+				}
+			}
+			if len(batch) == 0 {
+				return
+			}
+
+			var wg sync.WaitGroup
+			errs := make([]error, len(batch))
+			for i, idx := range batch {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					shard, err := o.backend.readShard(chunk.Metadata.ChunkID, bucket.ChunkVersionID, idx, locations[idx])
+					if err == nil && int64(len(shard)) != chunk.Metadata.Stripe.ShardSize {
+						err = fmt.Errorf("shard holds %d bytes, expected %d", len(shard), chunk.Metadata.Stripe.ShardSize)
+					}
+					if err != nil {
+						errs[i] = err
+						return
+					}
+					shards[idx] = shard
+				}()
+			}
+			wg.Wait()
+
+			for i, idx := range batch {
+				if errs[i] != nil {
+					o.logger.Warn("Shard retrieval failed", zap.String("chunk", chunk.Hash), zap.Int("shard", idx), zap.String("location", locations[idx]), zap.Error(errs[i]))
+					continue
+				}
+				received++
+			}
+		}
+	}
+	fetch(profile.DataShards)
+	if received < profile.DataShards {
+		return fmt.Errorf("insufficient shards for reconstruction of chunk %s: got %d shards", chunk.Hash, received)
+	}
+
+	// The chunk hash is checked along with decoding, so shards that decode to other data are found as bad too
+	decode := func(shards [][]byte) ([]byte, error) {
+		plainText, err := pipeline.DecodeStripe(0, shards, chunk.Metadata.Stripe, o.chunkKeys[chunkIdx])
+		if err != nil {
+			return nil, err
+		}
+		if sum := sha256.Sum256(plainText); hex.EncodeToString(sum[:]) != chunk.Hash {
+			return nil, errors.New("decoded data doesn't match the chunk hash")
+		}
+		return plainText, nil
+	}
+	plainText, err := decode(shards)
+	if err != nil {
+		o.logger.Warn("Chunk failed to decode, fetching every shard to find the bad ones", zap.String("chunk", chunk.Hash), zap.Error(err))
+		fetch(len(locations))
+
+		var bad []int
+		plainText, bad, err = decodeExcluding(decode, shards, profile.DataShards, err)
+		for _, idx := range bad {
+			o.logger.Warn("Shard returned bad data", zap.String("chunk", chunk.Hash), zap.Int("shard", idx), zap.String("location", locations[idx]))
+		}
+		if err != nil {
+			return fmt.Errorf("chunk %s: %w", chunk.Hash, err)
+		}
+	}
+	o.current = plainText
+	o.currentIdx = chunkIdx
+	return nil
+}
@@ -0,0 +1,231 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/manifest"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// countManifests counts the manifests kept at every location, by the version they are stored under
+func countManifests(t *testing.T, store *sharding.LocalShardStore, locations []string) map[string]int {
+	t.Helper()
+	counts := make(map[string]int)
+	for _, location := range locations {
+		shards, err := sharding.NewLocalShardStoreV2(store).ListShards(context.Background(), location, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, shard := range shards {
+			if shard.Key.Index == manifest.ShardIndex {
+				counts[shard.Key.VersionID]++
+			}
+		}
+	}
+	return counts
+}
+
+func TestChunkedVersionsRecordChunkSets(t *testing.T) {
+	dir := t.TempDir()
+	key := make([]byte, 32)
+	rand.Read(key)
+	cfg := &config.Config{
+		EncryptionKey:   key,
+		KeyringPath:     filepath.Join(dir, "keyring.json"),
+		ManifestKeyPath: filepath.Join(dir, "manifest.key"),
+	}
+	logger := zap.NewNop()
+	profile := erasurecoding.StandardProfile
+	locations := make([]string, profile.Total())
+	for i := range locations {
+		locations[i] = fmt.Sprintf("node%d", i)
+	}
+	store := sharding.NewLocalShardStore(filepath.Join(dir, "shards"))
+
+	db, err := bucket.OpenDB(filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := bucket.CreateBucketWithOptions(db, "bucket", "owner", profile, true); err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	versionID, _, _, err := StoreData(db, data, "bucket", "object", "object.bin", store, cfg, locations, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := bucket.GetObjectMetadata(db, "object", versionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metadata.Chunks) < 2 {
+		t.Fatalf("version stored as %d chunks, want several", len(metadata.Chunks))
+	}
+
+	// One set manifest and one version manifest, instead of a manifest for every chunk
+	counts := countManifests(t, store, locations)
+	if counts[bucket.ChunkVersionID] != 0 || counts[bucket.ChunkSetVersionID] != profile.Total() || counts[versionID] != profile.Total() {
+		t.Fatalf("manifests stored by version: %v", counts)
+	}
+
+	// The chunks are found again through their set once the database is lost
+	node, err := nodeKey(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := bucket.OpenDB(filepath.Join(dir, "recovered.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	report, err := RecoverMetadata(recovered, store, locations, []ed25519.PublicKey{node.Public().(ed25519.PublicKey)}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ChunksRestored != len(metadata.Chunks) || len(report.Orphans) != 0 || len(report.Incomplete) != 0 || len(report.Conflicts) != 0 {
+		t.Fatalf("restored %d of %d chunks, orphans %v, incomplete %v, conflicts %v",
+			report.ChunksRestored, len(metadata.Chunks), report.Orphans, report.Incomplete, report.Conflicts)
+	}
+	got, _, err := RetrieveData(recovered, "bucket", "object", versionID, store, cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("recovered version differs")
+	}
+
+	// A near identical object shares most of its chunks with the first one
+	edited := bytes.Clone(data)
+	copy(edited[len(edited)/2:], "edited in the middle")
+	editedID, _, _, err := StoreData(db, edited, "bucket", "edited", "edited.bin", store, cfg, locations, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editedMetadata, err := bucket.GetObjectMetadata(db, "edited", editedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := make([]string, len(editedMetadata.Chunks))
+	for i, ref := range editedMetadata.Chunks {
+		hashes[i] = ref.Hash
+	}
+	chunks, err := bucket.GetChunks(db, "bucket", hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := 0
+	for _, chunk := range chunks {
+		if chunk.RefCount > 1 {
+			shared++
+		}
+	}
+	if shared == 0 || shared == len(chunks) {
+		t.Fatalf("%d of the %d chunks of the edited object are shared", shared, len(chunks))
+	}
+	if counts := countManifests(t, store, locations); counts[bucket.ChunkSetVersionID] != 2*profile.Total() {
+		t.Fatalf("manifests stored by version: %v", counts)
+	}
+
+	// Collecting the chunks of the first object keeps those the edited one still refers to
+	if err := DeleteObject(db, "bucket", "object", store, logger); err != nil {
+		t.Fatal(err)
+	}
+	collected, err := CollectChunks(db, store, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if collected == 0 || collected >= len(metadata.Chunks) {
+		t.Fatalf("collected %d of the %d chunks of the deleted object", collected, len(metadata.Chunks))
+	}
+	got, _, err = RetrieveData(db, "bucket", "edited", editedID, store, cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, edited) {
+		t.Fatal("edited object differs after collecting the chunks of the first one")
+	}
+
+	// The set manifest goes along with the last of its chunks
+	if err := DeleteObject(db, "bucket", "edited", store, logger); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CollectChunks(db, store, logger); err != nil {
+		t.Fatal(err)
+	}
+	if counts := countManifests(t, store, locations); len(counts) != 0 {
+		t.Fatalf("manifests left after collecting every chunk: %v", counts)
+	}
+}
+
+func TestUnregisteredChunkedVersionReleasesItsChunks(t *testing.T) {
+	dir := t.TempDir()
+	key := make([]byte, 32)
+	rand.Read(key)
+	cfg := &config.Config{
+		EncryptionKey:   key,
+		KeyringPath:     filepath.Join(dir, "keyring.json"),
+		ManifestKeyPath: filepath.Join(dir, "manifest.key"),
+	}
+	logger := zap.NewNop()
+	profile := erasurecoding.StandardProfile
+	locations := make([]string, profile.Total())
+	for i := range locations {
+		locations[i] = fmt.Sprintf("node%d", i)
+	}
+	store := sharding.NewLocalShardStore(filepath.Join(dir, "shards"))
+
+	db, err := bucket.OpenDB(filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := bucket.CreateBucketWithOptions(db, "bucket", "owner", profile, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The object can't be registered once its version is recorded
+	if _, err := db.Exec(`CREATE TRIGGER no_objects BEFORE INSERT ON objects BEGIN SELECT RAISE(FAIL, 'objects are read only'); END`); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 256<<10)
+	rand.Read(data)
+	if _, _, _, err := StoreData(db, data, "bucket", "object", "object.bin", store, cfg, locations, logger); err == nil {
+		t.Fatal("StoreData succeeded without registering the object")
+	}
+
+	versions, err := bucket.ListVersionsAfter(db, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 0 {
+		t.Fatalf("%d versions left without their object", len(versions))
+	}
+	unreferenced, err := bucket.ListUnreferencedChunks(db, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := bucket.CountChunksByKey(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, n := range chunks {
+		total += n
+	}
+	if total == 0 || len(unreferenced) != total {
+		t.Fatalf("%d of %d chunks released", len(unreferenced), total)
+	}
+}
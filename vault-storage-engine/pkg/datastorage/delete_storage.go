@@ -59,11 +59,29 @@ func DeleteObject(db *sql.DB, bucketID, objectID string, store sharding.ShardSto
 		}
 	}
 
+	// Manifests of deduplicated versions are kept next to their chunks, they are only found through the metadata
+	backend := newRoutedBackend(store, logger)
+	for _, versionMetadata := range metadata {
+		locations, err := versionManifestLocations(db, &versionMetadata)
+		if err != nil {
+			logger.Warn("failed to locate manifest", zap.String("version_id", versionMetadata.VersionID), zap.Error(err))
+			continue
+		}
+		deleteManifests(objectID, versionMetadata.VersionID, locations, backend, logger)
+	}
+
 	err = bucket.DeleteObject(db, bucketID, objectID)
 	if err != nil {
 		return fmt.Errorf("failed to delete object from database, %w", err)
 	}
 
+	// Chunks are released once no version can refer to them anymore, a release that fails only leaks chunks
+	for _, versionMetadata := range metadata {
+		if err := bucket.ReleaseChunks(db, versionMetadata.BucketID, versionMetadata.Chunks); err != nil {
+			return fmt.Errorf("failed to release chunks of version %s, %w", versionMetadata.VersionID, err)
+		}
+	}
+
 	return nil
 }
 
@@ -86,10 +104,20 @@ func DeleteObjectByVersion(db *sql.DB, bucketID, objectID, versionID string, sto
 		}
 	}
 
+	if locations, err := versionManifestLocations(db, metadata); err != nil {
+		logger.Warn("failed to locate manifest", zap.String("version_id", versionID), zap.Error(err))
+	} else {
+		deleteManifests(objectID, versionID, locations, newRoutedBackend(store, logger), logger)
+	}
+
 	err = bucket.DeleteObjectByVersion(db, bucketID, objectID, versionID)
 	if err != nil {
 		return fmt.Errorf("failed to delete object from database, %w", err)
 	}
 
+	if err := bucket.ReleaseChunks(db, metadata.BucketID, metadata.Chunks); err != nil {
+		return fmt.Errorf("failed to release chunks of version, %w", err)
+	}
+
 	return nil
 }
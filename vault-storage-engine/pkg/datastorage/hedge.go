@@ -0,0 +1,77 @@
+package datastorage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+)
+
+const (
+	// DefaultHedgePercentile is the shard read latency percentile after which reads are hedged
+	DefaultHedgePercentile = 95
+	// defaultHedgeDelay is used until enough shard reads were timed to know their latency
+	defaultHedgeDelay = 100 * time.Millisecond
+	// minHedgeDelay keeps fast stores, like local disks, from hedging every read
+	minHedgeDelay = 10 * time.Millisecond
+	// latencySamples is how many recent shard reads the latency percentile is taken over
+	latencySamples    = 256
+	minLatencySamples = 20
+)
+
+// latencyTracker keeps the latencies of recent shard reads
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+// shardLatencies is shared by every reader of the process, so short reads benefit from what longer ones observed
+var shardLatencies = &latencyTracker{}
+
+func (t *latencyTracker) record(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.samples) < latencySamples {
+		t.samples = append(t.samples, d)
+		return
+	}
+	t.samples[t.next] = d
+	t.next = (t.next + 1) % latencySamples
+}
+
+// percentile returns the pth percentile of the recorded latencies, false until enough reads were timed
+func (t *latencyTracker) percentile(p float64) (time.Duration, bool) {
+	t.mu.Lock()
+	if len(t.samples) < minLatencySamples {
+		t.mu.Unlock()
+		return 0, false
+	}
+	sorted := append([]time.Duration(nil), t.samples...)
+	t.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	idx := int(float64(len(sorted)-1) * p / 100)
+	return sorted[idx], true
+}
+
+// hedgePercentile returns the configured hedge percentile, reads are never hedged when it is 100 or more
+func hedgePercentile(cfg *config.Config) float64 {
+	if cfg.HedgePercentile <= 0 {
+		return DefaultHedgePercentile
+	}
+	return cfg.HedgePercentile
+}
+
+// hedgeDelay returns how long a stripe waits for its shards before asking for more of them, false when reads aren't hedged
+func hedgeDelay(percentile float64) (time.Duration, bool) {
+	if percentile >= 100 {
+		return 0, false
+	}
+	delay, ok := shardLatencies.percentile(percentile)
+	if !ok {
+		return defaultHedgeDelay, true
+	}
+	return max(delay, minHedgeDelay), true
+}
@@ -0,0 +1,358 @@
+package datastorage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/proofofinclusion"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// ShardVerification is what the /verify endpoint of a storage node reports about a shard
+type ShardVerification struct {
+	Exists bool `json:"exists"`
+	// Corrupt is why the node's own checks rejected the shard, empty when they passed
+	Corrupt string `json:"corrupt,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+	// Valid is only set when the request carried a Merkle root and proof, it tells whether the shard verifies against them
+	Valid *bool `json:"valid,omitempty"`
+}
+
+// ShardStatus is the outcome of checking a single shard
+type ShardStatus string
+
+const (
+	ShardHealthy ShardStatus = "healthy"
+	ShardMissing ShardStatus = "missing"
+	ShardCorrupt ShardStatus = "corrupt"
+	// ShardUnverified shards exist but their version has no Merkle root to check them against
+	ShardUnverified ShardStatus = "unverified"
+	// ShardUnreachable shards couldn't be checked, their store or storage node failed
+	ShardUnreachable ShardStatus = "unreachable"
+)
+
+// ShardIntegrity is the state of one shard of a version, or of one of its chunks
+type ShardIntegrity struct {
+	Chunk    string      `json:"chunk,omitempty"`
+	Shard    int         `json:"shard"`
+	Location string      `json:"location,omitempty"`
+	Status   ShardStatus `json:"status"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// IntegrityReport is the outcome of checking every shard of a version
+type IntegrityReport struct {
+	BucketID  string           `json:"bucket_id"`
+	ObjectID  string           `json:"object_id"`
+	VersionID string           `json:"version_id"`
+	Deep      bool             `json:"deep"`
+	Shards    []ShardIntegrity `json:"shards"`
+	Healthy   int              `json:"healthy"`
+	Missing   int              `json:"missing"`
+	Corrupt   int              `json:"corrupt"`
+	// Readable tells whether enough healthy shards are left to read the version, in deep mode it was actually decoded
+	Readable bool `json:"readable"`
+	// DecodeError is why a deep check couldn't decode the version
+	DecodeError string `json:"decode_error,omitempty"`
+}
+
+// routedBackend sends every shard to the backend of its location: storage nodes are located by their URL,
+// any other location belongs to the local shard store. It only reads and deletes shards, it can't place new ones
+type routedBackend struct {
+	local *storeBackend
+	nodes *nodeBackend
+}
+
+func newRoutedBackend(store sharding.ShardStore, logger *zap.Logger) *routedBackend {
+	return &routedBackend{local: &storeBackend{store: store}, nodes: newNodeBackend(nil, logger)}
+}
+
+func (b *routedBackend) route(location string) shardBackend {
+	if isNodeLocation(location) {
+		return b.nodes
+	}
+	return b.local
+}
+
+func (b *routedBackend) openWriter(objectID, versionID string, shardIdx int) (shardWriter, string, error) {
+	return nil, "", errors.New("shards can't be written without a location")
+}
+
+func (b *routedBackend) openReader(objectID, versionID string, shardIdx int, location string, offset, length int64) (io.ReadCloser, error) {
+	return b.route(location).openReader(objectID, versionID, shardIdx, location, offset, length)
+}
+
+func (b *routedBackend) readShard(objectID, versionID string, shardIdx int, location string) ([]byte, error) {
+	return b.route(location).readShard(objectID, versionID, shardIdx, location)
+}
+
+func (b *routedBackend) putShard(objectID, versionID string, shardIdx int, location string, data []byte) error {
+	return b.route(location).putShard(objectID, versionID, shardIdx, location, data)
+}
+
+func (b *routedBackend) deleteShard(objectID, versionID string, shardIdx int, location string) error {
+	return b.route(location).deleteShard(objectID, versionID, shardIdx, location)
+}
+
+func (b *routedBackend) hashShard(objectID, versionID string, shardIdx int, location string, size int64) ([]byte, error) {
+	return b.route(location).hashShard(objectID, versionID, shardIdx, location, size)
+}
+
+// shardGroup is a set of shards decoded together: the shards of a version, or those of one of its chunks
+type shardGroup struct {
+	chunk      string
+	objectID   string
+	versionID  string
+	dataShards int
+	locations  []string
+	degraded   []int
+	size       int64 // length of every shard, -1 when it isn't recorded
+	root       string
+	proofs     map[string]string
+}
+
+// CheckIntegrity checks every shard of a version against the Merkle root of the version
+// A shallow check has every shard hashed where it is stored, storage nodes hash theirs through their /verify endpoint.
+// A deep check fetches every shard, hashes it here and decodes the version from the shards that passed.
+// customerKey is only needed to decode versions stored with a customer key in deep mode
+func CheckIntegrity(db *sql.DB, bucketID, objectID, versionID string, store sharding.ShardStore, cfg *config.Config, deep bool, customerKey []byte, logger *zap.Logger) (*IntegrityReport, error) {
+	metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+	if metadata.BucketID != bucketID {
+		return nil, fmt.Errorf("object version not found")
+	}
+
+	groups, err := shardGroups(db, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := newRoutedBackend(store, logger)
+	report := &IntegrityReport{BucketID: bucketID, ObjectID: objectID, VersionID: versionID, Deep: deep, Readable: true}
+	bad := make(map[string][]int)
+	for _, group := range groups {
+		healthy := 0
+		for shardIdx, location := range group.locations {
+			shard := checkShard(backend, group, shardIdx, location, deep)
+			switch shard.Status {
+			case ShardHealthy, ShardUnverified:
+				healthy++
+				report.Healthy++
+			case ShardMissing:
+				report.Missing++
+			case ShardCorrupt:
+				report.Corrupt++
+			}
+			if shard.Status != ShardHealthy && shard.Status != ShardUnverified {
+				bad[group.chunk] = append(bad[group.chunk], shardIdx)
+			}
+			report.Shards = append(report.Shards, shard)
+		}
+		if healthy < group.dataShards {
+			report.Readable = false
+		}
+	}
+
+	if deep {
+		// The version is decoded from the shards that passed, so the outcome doesn't depend on which shards the reader picks
+		if err := decodeCheck(db, metadata, backend, cfg, customerKey, bad, logger); err != nil {
+			report.Readable = false
+			report.DecodeError = err.Error()
+		}
+	}
+	return report, nil
+}
+
+// shardGroups lists the shard groups of a version, one per chunk for versions of deduplicated buckets
+func shardGroups(db *sql.DB, metadata *bucket.VersionMetadata) ([]shardGroup, error) {
+	if len(metadata.Chunks) == 0 {
+		profile := metadata.ErasureProfile()
+		size := int64(-1)
+		if metadata.StripeSize != 0 {
+			size = 0
+			for _, stripe := range metadata.Stripes {
+				size += stripe.ShardSize
+			}
+		}
+		return []shardGroup{{
+			objectID:   metadata.ObjectID,
+			versionID:  metadata.VersionID,
+			dataShards: profile.DataShards,
+			locations:  shardLocations(metadata.ShardLocations, profile.Total()),
+			degraded:   metadata.DegradedShards,
+			size:       size,
+			root:       metadata.MerkleRoot,
+			proofs:     metadata.Proofs,
+		}}, nil
+	}
+
+	hashes := make([]string, len(metadata.Chunks))
+	for i, ref := range metadata.Chunks {
+		hashes[i] = ref.Hash
+	}
+	chunks, err := bucket.GetChunks(db, metadata.BucketID, hashes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve chunks: %w", err)
+	}
+
+	var groups []shardGroup
+	seen := make(map[string]bool)
+	for _, ref := range metadata.Chunks {
+		if seen[ref.Hash] {
+			continue
+		}
+		seen[ref.Hash] = true
+		chunk, ok := chunks[ref.Hash]
+		if !ok {
+			return nil, fmt.Errorf("corrupt metadata: chunk %s of the version isn't stored", ref.Hash)
+		}
+		profile := chunk.Metadata.ErasureProfile()
+		groups = append(groups, shardGroup{
+			chunk:      ref.Hash,
+			objectID:   chunk.Metadata.ChunkID,
+			versionID:  bucket.ChunkVersionID,
+			dataShards: profile.DataShards,
+			locations:  shardLocations(chunk.Metadata.ShardLocations, profile.Total()),
+			degraded:   chunk.Metadata.DegradedShards,
+			size:       chunk.Metadata.Stripe.ShardSize,
+			root:       chunk.Metadata.MerkleRoot,
+			proofs:     chunk.Metadata.Proofs,
+		})
+	}
+	return groups, nil
+}
+
+// shardLocations returns the location of every shard by index, shards without a location are left empty
+func shardLocations(locations map[string]string, total int) []string {
+	byIdx := make([]string, total)
+	for shardKey, location := range locations {
+		shardIdx, err := strconv.Atoi(strings.TrimPrefix(shardKey, "shard_"))
+		if err == nil && shardIdx >= 0 && shardIdx < total {
+			byIdx[shardIdx] = location
+		}
+	}
+	return byIdx
+}
+
+// checkShard hashes a shard, where it is kept unless deep is set, and checks the hash against the root of its group
+func checkShard(backend *routedBackend, group shardGroup, shardIdx int, location string, deep bool) ShardIntegrity {
+	shard := ShardIntegrity{Chunk: group.chunk, Shard: shardIdx, Location: location}
+	for _, idx := range group.degraded {
+		if idx == shardIdx {
+			location = ""
+		}
+	}
+	if location == "" {
+		shard.Status = ShardMissing
+		shard.Error = "shard was not stored when the version was written"
+		return shard
+	}
+
+	var sum []byte
+	var err error
+	if deep {
+		sum, err = fetchAndHash(backend, group, shardIdx, location)
+	} else {
+		sum, err = backend.hashShard(group.objectID, group.versionID, shardIdx, location, group.size)
+	}
+	switch {
+	case errors.Is(err, sharding.ErrShardNotFound):
+		shard.Status = ShardMissing
+		shard.Error = err.Error()
+		return shard
+	case sharding.IsCorruptShard(err):
+		shard.Status = ShardCorrupt
+		shard.Error = err.Error()
+		return shard
+	case err != nil:
+		shard.Status = ShardUnreachable
+		shard.Error = err.Error()
+		return shard
+	}
+
+	if group.root == "" {
+		shard.Status = ShardUnverified
+		return shard
+	}
+	root, err := hex.DecodeString(group.root)
+	if err != nil {
+		shard.Status = ShardUnverified
+		shard.Error = "invalid Merkle root"
+		return shard
+	}
+	proof, err := proofofinclusion.ParseProof(group.proofs[proofofinclusion.ProofKey(shardIdx)])
+	if err != nil {
+		shard.Status = ShardUnverified
+		shard.Error = err.Error()
+		return shard
+	}
+	if !proofofinclusion.VerifyProof(root, sum, proof) {
+		shard.Status = ShardCorrupt
+		shard.Error = "shard doesn't match the Merkle root of the version"
+		return shard
+	}
+	shard.Status = ShardHealthy
+	return shard
+}
+
+// fetchAndHash fetches a shard and hashes it here, whatever the backend would rather do
+func fetchAndHash(backend shardBackend, group shardGroup, shardIdx int, location string) ([]byte, error) {
+	// Storage nodes can't serve an empty range, empty shards are read whole
+	if group.size <= 0 {
+		shard, err := backend.readShard(group.objectID, group.versionID, shardIdx, location)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(shard)
+		return sum[:], nil
+	}
+
+	rc, err := backend.openReader(group.objectID, group.versionID, shardIdx, location, 0, group.size)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return hashStream(rc, group.size, sharding.ShardKey{Location: location, ObjectID: group.objectID, VersionID: group.versionID, Index: shardIdx}.String())
+}
+
+// decodeCheck decodes a version, leaving out the shards that failed their checks
+func decodeCheck(db *sql.DB, metadata *bucket.VersionMetadata, backend shardBackend, cfg *config.Config, customerKey []byte, bad map[string][]int, logger *zap.Logger) error {
+	if metadata.CustomerKey != "" && customerKey == nil {
+		return ErrCustomerKeyRequired
+	}
+
+	o, err := openObject(db, metadata.BucketID, metadata.ObjectID, metadata.VersionID, backend, cfg, customerKey, logger)
+	if err != nil {
+		return err
+	}
+	defer o.Close()
+
+	if o.chunks != nil {
+		for i := range o.chunks {
+			for _, shardIdx := range bad[o.chunks[i].Hash] {
+				delete(o.chunks[i].Metadata.ShardLocations, proofofinclusion.ProofKey(shardIdx))
+			}
+		}
+	} else {
+		for _, shardIdx := range bad[""] {
+			if shardIdx < len(o.locations) {
+				o.locations[shardIdx] = ""
+			}
+		}
+	}
+
+	_, err = io.Copy(io.Discard, o)
+	return err
+}
@@ -0,0 +1,115 @@
+package datastorage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/encryption"
+)
+
+// DefaultKeyringPath is where rotated key encryption keys are kept when keyring_path isn't set
+const DefaultKeyringPath = "keyring.json"
+
+// KeyringPath returns the path of the keyring file
+func KeyringPath(cfg *config.Config) string {
+	if cfg.KeyringPath != "" {
+		return cfg.KeyringPath
+	}
+	return DefaultKeyringPath
+}
+
+// keyProvider returns the provider wrapping the data keys of versions, the local keyring by default
+// The provider is created on every call, so a rotation of the local keyring is picked up without a restart
+func keyProvider(cfg *config.Config) (encryption.KeyProvider, error) {
+	name := cfg.KeyProvider
+	if name == "" {
+		name = encryption.LocalKeyProvider
+	}
+	return encryption.NewKeyProvider(name, encryption.KeyProviderOptions{
+		MasterKey:   cfg.EncryptionKey,
+		KeyringPath: KeyringPath(cfg),
+		URL:         cfg.KMSURL,
+		Token:       cfg.KMSToken,
+		KeyID:       cfg.KMSKeyID,
+	})
+}
+
+// Errors returned when a version is opened with the wrong customer supplied key
+var (
+	ErrCustomerKeyRequired   = errors.New("version is encrypted with a customer key, the key is required to read it")
+	ErrCustomerKeyMismatch   = errors.New("customer key doesn't match the key the version was encrypted with")
+	ErrCustomerKeyUnexpected = errors.New("version isn't encrypted with a customer key")
+)
+
+// versionKey returns the key the stripes of a version were encrypted with
+// Versions stored before data keys existed were encrypted with the master key itself,
+// versions stored with a customer key can only be read with the same key
+func versionKey(cfg *config.Config, metadata *bucket.VersionMetadata, customerKey []byte) ([]byte, error) {
+	if metadata.CustomerKey != "" {
+		if customerKey == nil {
+			return nil, ErrCustomerKeyRequired
+		}
+		if !encryption.MatchesCustomerKey(metadata.CustomerKey, customerKey) {
+			return nil, ErrCustomerKeyMismatch
+		}
+		return customerKey, nil
+	}
+	if customerKey != nil {
+		return nil, ErrCustomerKeyUnexpected
+	}
+
+	if metadata.DataKey == nil {
+		if len(cfg.EncryptionKey) == 0 {
+			return nil, fmt.Errorf("encryption key not found in configuration")
+		}
+		return cfg.EncryptionKey, nil
+	}
+
+	provider, err := keyProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return provider.Unwrap(metadata.DataKey.KeyID, metadata.DataKey.Key)
+}
+
+// RotateKey adds a new version of the key encryption key and makes it current
+// Data keys are moved to the new version by RewrapDataKeys
+// Providers that can't rotate keys themselves, like most KMS, have their keys rotated in the KMS instead
+func RotateKey(cfg *config.Config) (string, error) {
+	provider, err := keyProvider(cfg)
+	if err != nil {
+		return "", err
+	}
+	rotator, ok := provider.(encryption.KeyRotator)
+	if !ok {
+		return "", fmt.Errorf("key provider %q can't rotate keys, rotate the key in the KMS and run rewrap-keys", cfg.KeyProvider)
+	}
+	return rotator.Rotate()
+}
+
+// RetireKey drops a key encryption key version from the keyring
+// It refuses while data keys of versions or chunks are still wrapped under it, RewrapDataKeys moves them to the current key
+// RewrapDataKeys stores the manifests of a batch again before the database moves off the key, so once no data key in the
+// database is wrapped under it no stored manifest is either
+func RetireKey(db *sql.DB, cfg *config.Config, keyID string) error {
+	provider, err := keyProvider(cfg)
+	if err != nil {
+		return err
+	}
+	retirer, ok := provider.(encryption.KeyRetirer)
+	if !ok {
+		return fmt.Errorf("key provider %q can't retire keys, disable the key in the KMS instead", cfg.KeyProvider)
+	}
+
+	counts, err := CountDataKeysByKey(db)
+	if err != nil {
+		return err
+	}
+	if counts[keyID] > 0 {
+		return fmt.Errorf("%d data keys are still wrapped under %q, run rewrap-keys first, it rewrites their manifests before the database moves off the key", counts[keyID], keyID)
+	}
+	return retirer.Retire(keyID)
+}
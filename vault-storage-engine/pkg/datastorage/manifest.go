@@ -0,0 +1,208 @@
+package datastorage
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/manifest"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/proofofinclusion"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// DefaultManifestKeyPath is where the key manifests are signed with is kept when manifest_key_path isn't set
+const DefaultManifestKeyPath = "manifest.key"
+
+// ManifestKeyPath returns the path of the node key manifests are signed with
+func ManifestKeyPath(cfg *config.Config) string {
+	if cfg.ManifestKeyPath != "" {
+		return cfg.ManifestKeyPath
+	}
+	return DefaultManifestKeyPath
+}
+
+var (
+	nodeKeysMu sync.Mutex
+	nodeKeys   = make(map[string]ed25519.PrivateKey)
+)
+
+// nodeKey returns the key manifests are signed with, it is only read from disk once
+func nodeKey(cfg *config.Config) (ed25519.PrivateKey, error) {
+	path := ManifestKeyPath(cfg)
+	nodeKeysMu.Lock()
+	defer nodeKeysMu.Unlock()
+	if key, ok := nodeKeys[path]; ok {
+		return key, nil
+	}
+	key, err := manifest.LoadOrCreateKey(path)
+	if err != nil {
+		return nil, err
+	}
+	nodeKeys[path] = key
+	return key, nil
+}
+
+// versionManifest describes a stored version
+func versionManifest(db *sql.DB, metadata bucket.VersionMetadata, rootVersion string) *manifest.Manifest {
+	// The owner only helps recovering the bucket, a manifest without one is still stored
+	owner, _ := bucket.GetBucketOwner(db, metadata.BucketID)
+	return &manifest.Manifest{
+		Format:      manifest.FormatVersion,
+		Kind:        manifest.KindVersion,
+		BucketID:    metadata.BucketID,
+		ObjectID:    metadata.ObjectID,
+		VersionID:   metadata.VersionID,
+		CreatedAt:   time.Now().Format(time.RFC3339),
+		RootVersion: rootVersion,
+		BucketOwner: owner,
+		Version:     &metadata,
+	}
+}
+
+// chunkManifest describes a stored chunk
+func chunkManifest(bucketID, hash string, size int64, metadata bucket.ChunkMetadata) *manifest.Manifest {
+	return &manifest.Manifest{
+		Format:    manifest.FormatVersion,
+		Kind:      manifest.KindChunk,
+		BucketID:  bucketID,
+		ObjectID:  metadata.ChunkID,
+		VersionID: bucket.ChunkVersionID,
+		CreatedAt: time.Now().Format(time.RFC3339),
+		Chunk:     &manifest.ChunkManifest{Hash: hash, Size: size, Metadata: metadata},
+	}
+}
+
+// chunkSetManifest describes the chunks a version stored, chunks it shares with other versions are in their sets
+func chunkSetManifest(bucketID string, set *bucket.ChunkSetRef, chunks []manifest.ChunkManifest) *manifest.Manifest {
+	return &manifest.Manifest{
+		Format:    manifest.FormatVersion,
+		Kind:      manifest.KindChunkSet,
+		BucketID:  bucketID,
+		ObjectID:  set.ID,
+		VersionID: bucket.ChunkSetVersionID,
+		CreatedAt: time.Now().Format(time.RFC3339),
+		Chunks:    chunks,
+	}
+}
+
+// manifestLocations returns every location holding a shard, once, leaving out degraded shards
+func manifestLocations(shardLocations map[string]string, degraded []int) []string {
+	skip := make(map[string]bool, len(degraded))
+	for _, idx := range degraded {
+		skip[proofofinclusion.ProofKey(idx)] = true
+	}
+
+	seen := make(map[string]bool)
+	var locations []string
+	for shardKey, location := range shardLocations {
+		if skip[shardKey] || location == "" || seen[location] {
+			continue
+		}
+		seen[location] = true
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	return locations
+}
+
+// storeManifest signs a manifest and stores a copy of it at every location
+// Manifests are only needed to recover from a lost database, a version is stored even when its manifest couldn't be
+func storeManifest(m *manifest.Manifest, locations []string, backend shardBackend, cfg *config.Config, logger *zap.Logger) {
+	if err := writeManifest(m, locations, backend, cfg, logger); err != nil {
+		logger.Warn("Manifest isn't stored everywhere", zap.String("kind", m.Kind), zap.String("object_id", m.ObjectID), zap.String("version_id", m.VersionID), zap.Error(err))
+	}
+}
+
+// writeManifest signs a manifest and stores a copy of it at every location, it fails unless every copy was stored
+// Copies that were stored are kept, a copy that failed leaves the previous one at its location
+func writeManifest(m *manifest.Manifest, locations []string, backend shardBackend, cfg *config.Config, logger *zap.Logger) error {
+	if len(locations) == 0 {
+		return fmt.Errorf("no location to store the manifest of %s/%s at", m.ObjectID, m.VersionID)
+	}
+	key, err := nodeKey(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to load the manifest signing key: %w", err)
+	}
+	signed, err := manifest.Sign(m, key)
+	if err != nil {
+		return fmt.Errorf("failed to sign manifest: %w", err)
+	}
+
+	failed := 0
+	for _, location := range locations {
+		if err := backend.putShard(m.ObjectID, m.VersionID, manifest.ShardIndex, location, signed); err != nil {
+			logger.Warn("Failed to store manifest copy", zap.String("kind", m.Kind), zap.String("object_id", m.ObjectID), zap.String("version_id", m.VersionID), zap.String("location", location), zap.Error(err))
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d manifest copies of %s/%s weren't stored", failed, len(locations), m.ObjectID, m.VersionID)
+	}
+	return nil
+}
+
+// deleteManifests deletes the copies of a manifest, locations without a copy are skipped
+func deleteManifests(objectID, versionID string, locations []string, backend shardBackend, logger *zap.Logger) {
+	for _, location := range locations {
+		err := backend.deleteShard(objectID, versionID, manifest.ShardIndex, location)
+		if err != nil && !errors.Is(err, sharding.ErrShardNotFound) {
+			logger.Warn("Failed to delete manifest copy", zap.String("object_id", objectID), zap.String("version_id", versionID), zap.String("location", location), zap.Error(err))
+		}
+	}
+}
+
+// ManifestCopy is one stored copy of the manifest of a version
+type ManifestCopy struct {
+	Location string
+	Data     []byte
+	Err      error
+}
+
+// ReadManifests reads every copy of the manifest of a version
+// Versions of deduplicated buckets keep theirs next to the shards of their first chunk
+func ReadManifests(db *sql.DB, objectID, versionID string, store sharding.ShardStore, logger *zap.Logger) ([]ManifestCopy, error) {
+	metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+	locations, err := versionManifestLocations(db, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if len(locations) == 0 {
+		return nil, fmt.Errorf("version %s has no shard locations", versionID)
+	}
+
+	backend := newRoutedBackend(store, logger)
+	copies := make([]ManifestCopy, len(locations))
+	for i, location := range locations {
+		copies[i] = ManifestCopy{Location: location}
+		copies[i].Data, copies[i].Err = backend.readShard(objectID, versionID, manifest.ShardIndex, location)
+	}
+	return copies, nil
+}
+
+// versionManifestLocations returns where the manifest of a version is kept
+func versionManifestLocations(db *sql.DB, metadata *bucket.VersionMetadata) ([]string, error) {
+	if len(metadata.Chunks) == 0 {
+		return manifestLocations(metadata.ShardLocations, metadata.DegradedShards), nil
+	}
+
+	first := metadata.Chunks[0].Hash
+	chunks, err := bucket.GetChunks(db, metadata.BucketID, []string{first})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve chunks: %w", err)
+	}
+	chunk, ok := chunks[first]
+	if !ok {
+		return nil, fmt.Errorf("corrupt metadata: chunk %s of the version isn't stored", first)
+	}
+	return manifestLocations(chunk.Metadata.ShardLocations, chunk.Metadata.DegradedShards), nil
+}
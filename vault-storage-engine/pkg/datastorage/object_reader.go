@@ -0,0 +1,558 @@
+package datastorage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// readAheadStripes is how many stripes a single shard request covers
+// A ranged read only pulls the stripes it touches, plus at most this many stripes past them
+const readAheadStripes = 8
+
+// ObjectReader reads a version of an object one stripe at a time
+// Only the shards of the stripes covering the bytes that are read are fetched and decoded,
+// which lets an object be served in ranges without reconstructing all of it
+type ObjectReader struct {
+	backend   shardBackend
+	objectID  string
+	versionID string
+	filename  string
+	modTime   time.Time
+	key       []byte
+	profile   erasurecoding.Profile
+	pipeline  *Pipeline
+	logger    *zap.Logger
+
+	stripes []bucket.StripeMetadata
+	// locations holds the location of every shard, missing shards have no location
+	locations []string
+	// plainStarts and shardStarts hold the offset of every stripe in the object and in the shards
+	plainStarts []int64
+	shardStarts []int64
+	size        int64
+	offset      int64
+
+	// Every shard is read through a stream covering a window of stripes
+	streams    []io.ReadCloser
+	streamNext []int
+	streamEnd  []int
+	failed     []bool
+
+	// Shards are fetched concurrently, a shard is busy while a fetch owns its stream
+	// A fetch that was hedged may outlive its stripe, the shard stays busy until it returns
+	mu              sync.Mutex
+	busy            []bool
+	released        chan struct{}
+	closed          bool
+	hedgePercentile float64
+
+	// Versions of deduplicated buckets are read one chunk at a time, every chunk is a stripe of its own
+	chunks    []bucket.Chunk
+	chunkKeys [][]byte
+	pipelines map[pipelineKey]*Pipeline
+
+	current    []byte
+	currentIdx int
+}
+
+// OpenObject opens a version of an object stored in a ShardStore for reading
+func OpenObject(db *sql.DB, bucketID, objectID, versionID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (*ObjectReader, error) {
+	return openObject(db, bucketID, objectID, versionID, &storeBackend{store: store}, cfg, nil, logger)
+}
+
+// OpenObjectWithCustomerKey opens a version that was stored with a customer supplied key for reading
+// Opening fails with ErrCustomerKeyMismatch unless customerKey is the key the version was stored with
+func OpenObjectWithCustomerKey(db *sql.DB, bucketID, objectID, versionID string, store sharding.ShardStore, cfg *config.Config, customerKey []byte, logger *zap.Logger) (*ObjectReader, error) {
+	return openObject(db, bucketID, objectID, versionID, &storeBackend{store: store}, cfg, customerKey, logger)
+}
+
+// NewOpenObject opens a version of an object whose shards are spread across storage nodes for reading
+func NewOpenObject(db *sql.DB, bucketID, objectID, versionID string, cfg *config.Config, logger *zap.Logger) (*ObjectReader, error) {
+	return openObject(db, bucketID, objectID, versionID, newNodeBackend(nil, logger), cfg, nil, logger)
+}
+
+func openObject(db *sql.DB, bucketID, objectID, versionID string, backend shardBackend, cfg *config.Config, customerKey []byte, logger *zap.Logger) (*ObjectReader, error) {
+	// Fetch metadata from the requested object
+	metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+
+	// Fetch filename from the database
+	var filename string
+	err = db.QueryRow(`SELECT filename FROM objects WHERE id = ?`, objectID).Scan(&filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve filename: %w", err)
+	}
+
+	if len(metadata.Chunks) > 0 {
+		return openChunkedObject(db, metadata, filename, backend, cfg, customerKey, logger)
+	}
+
+	key, err := versionKey(cfg, metadata, customerKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get encryption key: %w", err)
+	}
+
+	// The version is decoded with the profile it was stored with, whatever the bucket uses now
+	profile := metadata.ErasureProfile()
+	if err := profile.Validate(); err != nil {
+		return nil, fmt.Errorf("corrupt metadata: %w", err)
+	}
+
+	pipeline, err := versionPipeline(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to assemble pipeline: %w", err)
+	}
+
+	totalShards := profile.Total()
+	locations := make([]string, totalShards)
+	available := 0
+	for shardKey, location := range metadata.ShardLocations {
+		shardIdx, err := strconv.Atoi(strings.TrimPrefix(shardKey, "shard_"))
+		if err != nil || shardIdx < 0 || shardIdx >= totalShards {
+			logger.Warn("Invalid shard index", zap.String("shardKey", shardKey))
+			continue
+		}
+		locations[shardIdx] = location
+		available++
+	}
+	// Degraded shards were never stored, there is no point asking for them
+	for _, shardIdx := range metadata.DegradedShards {
+		if shardIdx >= 0 && shardIdx < totalShards && locations[shardIdx] != "" {
+			locations[shardIdx] = ""
+			available--
+		}
+	}
+
+	// Check if we have enough shards to reconstruct the data
+	if available < profile.DataShards {
+		return nil, fmt.Errorf("insufficient shards for reconstruction: missing %d shards", totalShards-available)
+	}
+
+	modTime, _ := time.Parse(time.RFC3339, metadata.CreationDate)
+	o := &ObjectReader{
+		backend:    backend,
+		objectID:   objectID,
+		versionID:  versionID,
+		filename:   filename,
+		modTime:    modTime,
+		key:        key,
+		profile:    profile,
+		pipeline:   pipeline,
+		logger:     logger,
+		locations:  locations,
+		streams:    make([]io.ReadCloser, totalShards),
+		streamNext: make([]int, totalShards),
+		streamEnd:  make([]int, totalShards),
+		failed:     make([]bool, totalShards),
+		busy:       make([]bool, totalShards),
+		released:   make(chan struct{}, 1),
+		currentIdx: -1,
+
+		hedgePercentile: hedgePercentile(cfg),
+	}
+
+	if metadata.StripeSize == 0 {
+		// Versions stored before striping can only be decoded as a whole
+		plainText, err := o.readUnstriped()
+		if err != nil {
+			return nil, err
+		}
+		o.setStripes([]bucket.StripeMetadata{{PlainSize: int64(len(plainText))}})
+		o.current = plainText
+		o.currentIdx = 0
+		return o, nil
+	}
+
+	o.setStripes(metadata.Stripes)
+
+	// The stripes have to account for every byte that was erasure coded
+	var encodedSize int64
+	for _, stripe := range metadata.Stripes {
+		encodedSize += stripe.CipherSize
+	}
+	if metadata.EncodedSize != 0 && encodedSize != metadata.EncodedSize {
+		return nil, fmt.Errorf("corrupt metadata: stripes hold %d encoded bytes, version records %d", encodedSize, metadata.EncodedSize)
+	}
+	return o, nil
+}
+
+func (o *ObjectReader) setStripes(stripes []bucket.StripeMetadata) {
+	o.stripes = stripes
+	o.plainStarts = make([]int64, len(stripes)+1)
+	o.shardStarts = make([]int64, len(stripes)+1)
+	for i, stripe := range stripes {
+		o.plainStarts[i+1] = o.plainStarts[i] + stripe.PlainSize
+		o.shardStarts[i+1] = o.shardStarts[i] + stripe.ShardSize
+	}
+	o.size = o.plainStarts[len(stripes)]
+}
+
+// Filename returns the name the object was stored under
+func (o *ObjectReader) Filename() string {
+	return o.filename
+}
+
+// Size returns the size of the object in bytes
+func (o *ObjectReader) Size() int64 {
+	return o.size
+}
+
+// ModTime returns when the version was stored
+func (o *ObjectReader) ModTime() time.Time {
+	return o.modTime
+}
+
+func (o *ObjectReader) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+
+	// Find the stripe holding the current offset
+	idx := sort.Search(len(o.stripes), func(i int) bool {
+		return o.plainStarts[i+1] > o.offset
+	})
+	if idx != o.currentIdx {
+		if err := o.loadStripe(idx); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, o.current[o.offset-o.plainStarts[idx]:])
+	o.offset += int64(n)
+	return n, nil
+}
+
+func (o *ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+// Close releases every open shard stream
+// The streams of shards that are still being fetched are released once their fetch returns
+func (o *ObjectReader) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	for idx := range o.streams {
+		if !o.busy[idx] {
+			o.closeStream(idx)
+		}
+	}
+	o.current = nil
+	return nil
+}
+
+type shardResult struct {
+	idx     int
+	shard   []byte
+	err     error
+	latency time.Duration
+}
+
+// loadStripe fetches and decodes a single stripe
+// The data shards are fetched concurrently and the stripe is decoded as soon as any DataShards shards arrived
+// Shards that fail are replaced by parity shards right away, shards that are slower than the hedge delay
+// get parity shards fetched alongside them, whichever arrive first are used
+// When the stripe doesn't decode, a shard returned bad data: every other shard is fetched to find it, see decodeExcluding
+func (o *ObjectReader) loadStripe(stripeIdx int) error {
+	if o.chunks != nil {
+		return o.loadChunk(stripeIdx)
+	}
+
+	need := o.profile.DataShards
+	shards := make([][]byte, len(o.locations))
+	if received := o.fetchStripeShards(stripeIdx, shards, need); received < need {
+		return fmt.Errorf("insufficient shards for reconstruction of stripe %d: got %d shards", stripeIdx, received)
+	}
+
+	decode := func(shards [][]byte) ([]byte, error) {
+		return o.pipeline.DecodeStripe(stripeIdx, shards, o.stripes[stripeIdx], o.key)
+	}
+	plainText, err := decode(shards)
+	if err != nil {
+		o.logger.Warn("Stripe failed to decode, fetching every shard to find the bad ones", zap.Int("stripe", stripeIdx), zap.Error(err))
+		o.fetchStripeShards(stripeIdx, shards, len(shards))
+
+		var bad []int
+		plainText, bad, err = decodeExcluding(decode, shards, need, err)
+		for _, idx := range bad {
+			o.logger.Warn("Shard returned bad data", zap.Int("shard", idx), zap.String("location", o.locations[idx]), zap.Int("stripe", stripeIdx))
+			o.failed[idx] = true
+			o.closeStream(idx)
+		}
+		if err != nil {
+			return fmt.Errorf("stripe %d: %w", stripeIdx, err)
+		}
+	}
+	o.current = plainText
+	o.currentIdx = stripeIdx
+	return nil
+}
+
+// fetchStripeShards fetches the shards of a stripe into shards until it holds need shards, or no shard is left to ask for
+// It returns how many shards it holds
+func (o *ObjectReader) fetchStripeShards(stripeIdx int, shards [][]byte, need int) int {
+	results := make(chan shardResult, len(o.locations))
+
+	// Shards are asked for in index order, data shards come first, and at most once per stripe
+	asked := make([]bool, len(o.locations))
+	received := 0
+	for idx, shard := range shards {
+		if shard != nil {
+			asked[idx] = true
+			received++
+		}
+	}
+	next, pending := 0, 0
+	launch := func() bool {
+		for ; next < len(o.locations); next++ {
+			idx := next
+			if o.locations[idx] == "" || o.failed[idx] || asked[idx] || !o.acquire(idx) {
+				continue
+			}
+			asked[idx] = true
+			next++
+			pending++
+			go o.fetchStripeShard(idx, stripeIdx, results)
+			return true
+		}
+		return false
+	}
+	for i := received; i < need && launch(); i++ {
+	}
+
+	var hedge <-chan time.Time
+	if delay, ok := hedgeDelay(o.hedgePercentile); ok {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		hedge = timer.C
+	}
+
+	for received < need {
+		if pending == 0 && !launch() {
+			// Shards still held by fetches of earlier stripes are the last resort
+			if !o.waitBusy() {
+				return received
+			}
+			next = 0
+			continue
+		}
+
+		select {
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				// A shard that failed once is not trusted for the rest of the object
+				o.logger.Warn("Shard retrieval failed", zap.Int("shard", r.idx), zap.String("location", o.locations[r.idx]), zap.Int("stripe", stripeIdx), zap.Error(r.err))
+				o.failed[r.idx] = true
+				o.closeStream(r.idx)
+				launch()
+				continue
+			}
+			shardLatencies.record(r.latency)
+			shards[r.idx] = r.shard
+			received++
+		case <-hedge:
+			hedge = nil
+			// One more shard is asked for in place of every shard that is still missing
+			for i := received; i < need && launch(); i++ {
+			}
+			o.logger.Debug("Hedging slow shard reads", zap.Int("stripe", stripeIdx), zap.Int("pending", pending))
+		}
+	}
+	return received
+}
+
+// maxDecodeAttempts bounds how many sets of shards decodeExcluding tries, enough to find
+// as many bad shards as there are parity shards in every named profile
+const maxDecodeAttempts = 2048
+
+// decodeExcluding finds the shards that keep a stripe from decoding, shards that came back with bad data
+// Erasure decoding alone can't tell which shard is bad, the stripe's authentication tag can: sets of shards are
+// left out, fewest first, and the rest reconstructed until the stripe decodes. It returns the stripe and the shards
+// that had to be left out, or decodeErr when no set of shards decodes
+func decodeExcluding(decode func(shards [][]byte) ([]byte, error), shards [][]byte, dataShards int, decodeErr error) ([]byte, []int, error) {
+	var present []int
+	for idx, shard := range shards {
+		if shard != nil {
+			present = append(present, idx)
+		}
+	}
+
+	attempts := 0
+	subset := make([][]byte, len(shards))
+	for leftOut := 1; leftOut <= len(present)-dataShards; leftOut++ {
+		// combination holds the positions in present of the shards left out, in increasing order
+		combination := make([]int, leftOut)
+		for i := range combination {
+			combination[i] = i
+		}
+		for {
+			if attempts == maxDecodeAttempts {
+				return nil, nil, fmt.Errorf("%w, no set of shards decodes after %d attempts", decodeErr, attempts)
+			}
+			attempts++
+
+			copy(subset, shards)
+			excluded := make([]int, leftOut)
+			for i, pos := range combination {
+				excluded[i] = present[pos]
+				subset[present[pos]] = nil
+			}
+			if plainText, err := decode(subset); err == nil {
+				return plainText, excluded, nil
+			}
+
+			// Move on to the next combination
+			i := leftOut - 1
+			for i >= 0 && combination[i] == len(present)-leftOut+i {
+				i--
+			}
+			if i < 0 {
+				break
+			}
+			combination[i]++
+			for j := i + 1; j < leftOut; j++ {
+				combination[j] = combination[j-1] + 1
+			}
+		}
+	}
+	return nil, nil, decodeErr
+}
+
+// acquire marks a shard busy, false when a fetch already owns it
+func (o *ObjectReader) acquire(idx int) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.busy[idx] {
+		return false
+	}
+	o.busy[idx] = true
+	return true
+}
+
+// waitBusy waits for a fetch left over from an earlier stripe to return, false when there is none
+func (o *ObjectReader) waitBusy() bool {
+	o.mu.Lock()
+	busy := false
+	for _, b := range o.busy {
+		busy = busy || b
+	}
+	o.mu.Unlock()
+	if !busy {
+		return false
+	}
+	<-o.released
+	return true
+}
+
+// fetchStripeShard reads the shard of one stripe on its own goroutine, it owns the stream of the shard until it returns
+func (o *ObjectReader) fetchStripeShard(idx, stripeIdx int, results chan<- shardResult) {
+	start := time.Now()
+	shard, err := o.readStripeShard(idx, stripeIdx)
+
+	o.mu.Lock()
+	if o.closed {
+		o.closeStream(idx)
+	}
+	o.busy[idx] = false
+	o.mu.Unlock()
+	select {
+	case o.released <- struct{}{}:
+	default:
+	}
+
+	// results has room for every shard, a fetch that outlived its stripe never blocks
+	results <- shardResult{idx: idx, shard: shard, err: err, latency: time.Since(start)}
+}
+
+// readStripeShard reads the shard of one stripe, reusing the open stream of the shard when it is positioned on that stripe
+func (o *ObjectReader) readStripeShard(shardIdx, stripeIdx int) ([]byte, error) {
+	if o.streams[shardIdx] == nil || o.streamNext[shardIdx] != stripeIdx {
+		o.closeStream(shardIdx)
+
+		end := stripeIdx + readAheadStripes
+		if end > len(o.stripes) {
+			end = len(o.stripes)
+		}
+		offset := o.shardStarts[stripeIdx]
+		length := o.shardStarts[end] - offset
+		stream, err := o.backend.openReader(o.objectID, o.versionID, shardIdx, o.locations[shardIdx], offset, length)
+		if err != nil {
+			return nil, err
+		}
+		o.streams[shardIdx] = stream
+		o.streamNext[shardIdx] = stripeIdx
+		o.streamEnd[shardIdx] = end
+	}
+
+	shard := make([]byte, o.stripes[stripeIdx].ShardSize)
+	if _, err := io.ReadFull(o.streams[shardIdx], shard); err != nil {
+		return nil, err
+	}
+
+	o.streamNext[shardIdx]++
+	if o.streamNext[shardIdx] == o.streamEnd[shardIdx] {
+		o.closeStream(shardIdx)
+	}
+	return shard, nil
+}
+
+func (o *ObjectReader) closeStream(shardIdx int) {
+	if o.streams[shardIdx] != nil {
+		o.streams[shardIdx].Close()
+		o.streams[shardIdx] = nil
+	}
+}
+
+// readUnstriped fetches every shard of a version stored before striping and decodes it as a whole
+func (o *ObjectReader) readUnstriped() ([]byte, error) {
+	shards := make([][]byte, len(o.locations))
+	missing := 0
+	for idx, location := range o.locations {
+		if location == "" {
+			missing++
+			continue
+		}
+
+		shard, err := o.backend.readShard(o.objectID, o.versionID, idx, location)
+		if err != nil {
+			o.logger.Warn("Shard retrieval failed", zap.Int("shard", idx), zap.String("location", location), zap.Error(err))
+			missing++
+			continue
+		}
+		shards[idx] = shard
+	}
+
+	if missing > o.profile.ParityShards {
+		return nil, fmt.Errorf("insufficient shards for reconstruction: missing %d shards", missing)
+	}
+	return decodeUnstriped(o.pipeline, shards, o.key)
+}
@@ -0,0 +1,241 @@
+package datastorage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/compression"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/encryption"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/erasurecoding"
+)
+
+// AdditionalDataVersion is the layout of the additional data new versions authenticate every stripe with
+// Versions that don't record a layout were encrypted without additional data
+const AdditionalDataVersion = 1
+
+// DefaultCodecs are the codecs new versions are stored with
+var DefaultCodecs = bucket.Codecs{
+	Compression:    compression.LZ4ID,
+	Encryption:     encryption.AESGCMID,
+	ErasureCoding:  erasurecoding.ReedSolomonID,
+	AdditionalData: AdditionalDataVersion,
+}
+
+const (
+	// DefaultCompressionMinGain is the smallest saving adaptive compression keeps compressing for
+	DefaultCompressionMinGain = 0.1
+	// compressionSampleSize is how much of an object adaptive compression test compresses
+	compressionSampleSize = 128 << 10
+)
+
+// legacyCodecs are the codecs every version was stored with before codecs were recorded
+var legacyCodecs = bucket.Codecs{
+	Compression:   compression.LZ4ID,
+	Encryption:    encryption.AESGCMID,
+	ErasureCoding: erasurecoding.ReedSolomonID,
+}
+
+// Pipeline is the chain of stages a stripe goes through, assembled from registered codecs
+// A stripe is compressed, then encrypted, then erasure coded, and decoded in the reverse order
+type Pipeline struct {
+	Codecs      bucket.Codecs
+	Compressor  compression.Compressor
+	Encryptor   encryption.Encryptor
+	ErasureCode erasurecoding.ErasureCode
+
+	profile erasurecoding.Profile
+	// binding is the additional data shared by every stripe, nil until the pipeline is bound to a version
+	binding []byte
+}
+
+// NewPipeline assembles a pipeline from the codecs registered under the given IDs
+func NewPipeline(codecs bucket.Codecs, profile erasurecoding.Profile) (*Pipeline, error) {
+	compressor, err := compression.New(codecs.Compression, codecs.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	encryptor, err := encryption.Lookup(codecs.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	code, err := erasurecoding.New(codecs.ErasureCoding, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	if codecs.AdditionalData > AdditionalDataVersion {
+		return nil, fmt.Errorf("unknown additional data layout %d", codecs.AdditionalData)
+	}
+
+	return &Pipeline{
+		Codecs:      codecs,
+		Compressor:  compressor,
+		Encryptor:   encryptor,
+		ErasureCode: code,
+		profile:     profile,
+	}, nil
+}
+
+// Bind ties the ciphertext of every stripe to the version it belongs to and to the codecs it is stored with
+// The bucket, object and version IDs, the codec parameters and the index of the stripe are authenticated
+// as additional data, so shards of another version or another stripe fail to decrypt instead of being returned
+// Pipelines whose codecs don't record an additional data layout are left unbound, for versions stored before
+func (p *Pipeline) Bind(bucketID, objectID, versionID string, stripeSize int) {
+	if p.Codecs.AdditionalData == 0 {
+		return
+	}
+
+	// Every field is length prefixed, so no two identities encode to the same bytes
+	var b []byte
+	appendField := func(field string) {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(field)))
+		b = append(b, field...)
+	}
+	appendField("vault-stripe")
+	b = binary.BigEndian.AppendUint32(b, uint32(p.Codecs.AdditionalData))
+	appendField(bucketID)
+	appendField(objectID)
+	appendField(versionID)
+	appendField(p.Codecs.Compression)
+	b = binary.BigEndian.AppendUint64(b, uint64(int64(p.Codecs.CompressionLevel)))
+	appendField(p.Codecs.Encryption)
+	appendField(p.Codecs.ErasureCoding)
+	b = binary.BigEndian.AppendUint32(b, uint32(p.profile.DataShards))
+	b = binary.BigEndian.AppendUint32(b, uint32(p.profile.ParityShards))
+	b = binary.BigEndian.AppendUint64(b, uint64(stripeSize))
+	p.binding = b
+}
+
+// additionalData returns the additional data stripe stripeIdx is authenticated with
+func (p *Pipeline) additionalData(stripeIdx int) []byte {
+	if p.binding == nil {
+		return nil
+	}
+	return binary.BigEndian.AppendUint64(append([]byte(nil), p.binding...), uint64(stripeIdx))
+}
+
+// chooseCodecs picks the codecs a new version is stored with
+// With adaptive compression, the content type and a sample from the start of the object
+// decide whether compressing is worth it, data that doesn't compress well is stored raw
+func chooseCodecs(cfg *config.Config, filePath string, sample []byte) (bucket.Codecs, error) {
+	codecs := DefaultCodecs
+	if cfg.Compression != "" {
+		codecs.Compression = cfg.Compression
+		codecs.CompressionLevel = cfg.CompressionLevel
+	}
+	if !cfg.AdaptiveCompression || codecs.Compression == compression.NoneID {
+		return codecs, nil
+	}
+
+	raw := codecs
+	raw.Compression = compression.NoneID
+	raw.CompressionLevel = 0
+
+	if compression.IsCompressedType(mime.TypeByExtension(filepath.Ext(filePath))) {
+		return raw, nil
+	}
+	if len(sample) == 0 {
+		return codecs, nil
+	}
+	if compression.IsCompressedType(http.DetectContentType(sample)) {
+		return raw, nil
+	}
+
+	compressor, err := compression.New(codecs.Compression, codecs.CompressionLevel)
+	if err != nil {
+		return bucket.Codecs{}, err
+	}
+	if len(sample) > compressionSampleSize {
+		sample = sample[:compressionSampleSize]
+	}
+	gain, err := compression.Gain(compressor, sample)
+	if err != nil {
+		return bucket.Codecs{}, fmt.Errorf("compression failed, %w", err)
+	}
+
+	minGain := cfg.CompressionMinGain
+	if minGain == 0 {
+		minGain = DefaultCompressionMinGain
+	}
+	if gain < minGain {
+		return raw, nil
+	}
+	return codecs, nil
+}
+
+// versionPipeline assembles the pipeline a version was stored with, bound to the version
+func versionPipeline(metadata *bucket.VersionMetadata) (*Pipeline, error) {
+	codecs := legacyCodecs
+	if metadata.Codecs != nil {
+		codecs = *metadata.Codecs
+	}
+	pipeline, err := NewPipeline(codecs, metadata.ErasureProfile())
+	if err != nil {
+		return nil, err
+	}
+	pipeline.Bind(metadata.BucketID, metadata.ObjectID, metadata.VersionID, metadata.StripeSize)
+	return pipeline, nil
+}
+
+// EncodeStripe compresses, encrypts and erasure codes stripe stripeIdx of a version
+func (p *Pipeline) EncodeStripe(stripeIdx int, plainText, key []byte) ([][]byte, bucket.StripeMetadata, error) {
+	compressedData, err := p.Compressor.Compress(plainText)
+	if err != nil {
+		return nil, bucket.StripeMetadata{}, fmt.Errorf("compression failed, %w", err)
+	}
+
+	cipherText, err := p.Encryptor.Encrypt(compressedData, key, p.additionalData(stripeIdx))
+	if err != nil {
+		return nil, bucket.StripeMetadata{}, fmt.Errorf("encryption failed: %w", err)
+	}
+
+	shards, err := p.ErasureCode.Encode(cipherText)
+	if err != nil {
+		return nil, bucket.StripeMetadata{}, fmt.Errorf("erasure coding failed: %w", err)
+	}
+
+	stripe := bucket.StripeMetadata{
+		PlainSize:  int64(len(plainText)),
+		CipherSize: int64(len(cipherText)),
+		ShardSize:  int64(len(shards[0])),
+	}
+	return shards, stripe, nil
+}
+
+// DecodeStripe reconstructs, decrypts and decompresses stripe stripeIdx of a version
+// Missing shards are expected to be nil
+func (p *Pipeline) DecodeStripe(stripeIdx int, shards [][]byte, stripe bucket.StripeMetadata, key []byte) ([]byte, error) {
+	var cipherText []byte
+	var err error
+	if sized, ok := p.ErasureCode.(erasurecoding.SizedErasureCode); ok {
+		cipherText, err = sized.DecodeSize(shards, int(stripe.CipherSize))
+	} else {
+		cipherText, err = p.ErasureCode.Decode(shards)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("erasure decoding failed: %w", err)
+	}
+	if int64(len(cipherText)) != stripe.CipherSize {
+		return nil, fmt.Errorf("erasure decoding failed: decoded %d bytes, expected %d", len(cipherText), stripe.CipherSize)
+	}
+
+	data, err := p.Encryptor.Decrypt(cipherText, key, p.additionalData(stripeIdx))
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+
+	plainText, err := p.Compressor.Decompress(data)
+	if err != nil {
+		return nil, fmt.Errorf("decompression failed, %w", err)
+	}
+
+	if int64(len(plainText)) != stripe.PlainSize {
+		return nil, fmt.Errorf("stripe size mismatch: expected %d bytes, got %d", stripe.PlainSize, len(plainText))
+	}
+	return plainText, nil
+}
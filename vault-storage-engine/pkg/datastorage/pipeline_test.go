@@ -0,0 +1,116 @@
+package datastorage
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/compression"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/encryption"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/erasurecoding"
+)
+
+func TestDecodeStripeAuthenticatesIdentity(t *testing.T) {
+	const stripeSize = 64 << 10
+	key, err := encryption.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := bytes.Repeat([]byte("stripe contents "), 1000)
+
+	codecs := DefaultCodecs
+	codecs.Compression = compression.ZstdID
+	codecs.CompressionLevel = 3
+
+	stored, err := NewPipeline(codecs, erasurecoding.StandardProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.Bind("bucket", "object", "v1", stripeSize)
+	shards, stripe, err := stored.EncodeStripe(2, plain, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherLevel := codecs
+	otherLevel.CompressionLevel = 9
+	otherCompression := codecs
+	otherCompression.Compression = compression.LZ4ID
+	otherCompression.CompressionLevel = 0
+
+	tests := []struct {
+		name       string
+		codecs     bucket.Codecs
+		bucketID   string
+		objectID   string
+		versionID  string
+		stripeIdx  int
+		stripeSize int
+		swapped    bool
+	}{
+		{name: "same identity", codecs: codecs, bucketID: "bucket", objectID: "object", versionID: "v1", stripeIdx: 2, stripeSize: stripeSize},
+		{name: "other version", codecs: codecs, bucketID: "bucket", objectID: "object", versionID: "v2", stripeIdx: 2, stripeSize: stripeSize, swapped: true},
+		{name: "other object", codecs: codecs, bucketID: "bucket", objectID: "other", versionID: "v1", stripeIdx: 2, stripeSize: stripeSize, swapped: true},
+		{name: "other bucket", codecs: codecs, bucketID: "other", objectID: "object", versionID: "v1", stripeIdx: 2, stripeSize: stripeSize, swapped: true},
+		{name: "other stripe", codecs: codecs, bucketID: "bucket", objectID: "object", versionID: "v1", stripeIdx: 3, stripeSize: stripeSize, swapped: true},
+		{name: "other stripe size", codecs: codecs, bucketID: "bucket", objectID: "object", versionID: "v1", stripeIdx: 2, stripeSize: 2 * stripeSize, swapped: true},
+		{name: "other compression level", codecs: otherLevel, bucketID: "bucket", objectID: "object", versionID: "v1", stripeIdx: 2, stripeSize: stripeSize, swapped: true},
+		{name: "other compression codec", codecs: otherCompression, bucketID: "bucket", objectID: "object", versionID: "v1", stripeIdx: 2, stripeSize: stripeSize, swapped: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline, err := NewPipeline(tt.codecs, erasurecoding.StandardProfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pipeline.Bind(tt.bucketID, tt.objectID, tt.versionID, tt.stripeSize)
+
+			got, err := pipeline.DecodeStripe(tt.stripeIdx, shards, stripe, key)
+			if tt.swapped {
+				if !errors.Is(err, encryption.ErrAuthentication) {
+					t.Fatalf("DecodeStripe returned %v, want an authentication error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatal("decoded stripe differs")
+			}
+		})
+	}
+}
+
+func TestUnboundPipelineDecodesLegacyStripes(t *testing.T) {
+	key, err := encryption.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte("stored before stripes were bound")
+
+	legacy, err := NewPipeline(legacyCodecs, erasurecoding.StandardProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy.Bind("bucket", "object", "v1", 64<<10)
+	shards, stripe, err := legacy.EncodeStripe(0, plain, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stripes of legacy versions carry no identity, any binding decodes them
+	other, err := NewPipeline(legacyCodecs, erasurecoding.StandardProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Bind("bucket", "object", "v2", 64<<10)
+	got, err := other.DecodeStripe(5, shards, stripe, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatal("decoded stripe differs")
+	}
+}
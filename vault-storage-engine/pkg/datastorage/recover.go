@@ -0,0 +1,683 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/manifest"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/proofofinclusion"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// RecoveredBucketOwner owns the buckets rebuilt from manifests that don't record their owner
+const RecoveredBucketOwner = "recovered"
+
+// ListedShard is a shard found at a location, storage nodes list their shards in this form
+type ListedShard struct {
+	ObjectID  string `json:"object_id"`
+	VersionID string `json:"version_id"`
+	Index     int    `json:"index"`
+	Size      int64  `json:"size"`
+}
+
+// ListedShards converts the shards listed by a ShardStoreV2
+func ListedShards(infos []sharding.ShardInfo) []ListedShard {
+	shards := make([]ListedShard, len(infos))
+	for i, info := range infos {
+		shards[i] = ListedShard{ObjectID: info.Key.ObjectID, VersionID: info.Key.VersionID, Index: info.Key.Index, Size: info.Size}
+	}
+	return shards
+}
+
+// shardLister is a backend that can list every shard kept at a location
+type shardLister interface {
+	shardBackend
+	listShards(location string) ([]ListedShard, error)
+}
+
+func (b *storeBackend) listShards(location string) ([]ListedShard, error) {
+	var store sharding.ShardStoreV2
+	switch s := b.store.(type) {
+	case *sharding.LocalShardStore:
+		store = sharding.NewLocalShardStoreV2(s)
+	case *sharding.S3ShardStore:
+		store = sharding.NewS3ShardStoreV2(s)
+	default:
+		return nil, fmt.Errorf("shard store %T can't list its shards", b.store)
+	}
+
+	infos, err := store.ListShards(context.Background(), location, "")
+	if err != nil {
+		return nil, err
+	}
+	return ListedShards(infos), nil
+}
+
+// listShards asks the storage node for every shard it keeps
+func (b *nodeBackend) listShards(nodeURL string) ([]ListedShard, error) {
+	resp, err := b.streamClient.Get(nodeURL + "/shards")
+	if err != nil {
+		return nil, fmt.Errorf("failed to contact storage node %s: %w", nodeURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("storage node %s responded with %s", nodeURL, resp.Status)
+	}
+
+	var shards []ListedShard
+	if err := json.NewDecoder(resp.Body).Decode(&shards); err != nil {
+		return nil, fmt.Errorf("failed to decode shard list of %s: %w", nodeURL, err)
+	}
+	return shards, nil
+}
+
+// RecoveryReport is what rebuilding the metadata from the manifests found
+type RecoveryReport struct {
+	Locations        []ScannedLocation
+	BucketsCreated   []string
+	VersionsRestored int
+	VersionsExisting int // versions that were already recorded, they are left as they are
+	ChunksRestored   int
+	Incomplete       []IncompleteVersion
+	Conflicts        []RecoveryConflict
+	InvalidManifests []InvalidManifest
+	// Orphans are the shards no restored or recorded version or chunk accounts for
+	Orphans []sharding.ShardKey
+}
+
+// ScannedLocation is a location that was crawled, Err is set when it couldn't be listed
+type ScannedLocation struct {
+	Location  string
+	Shards    int
+	Manifests int
+	Err       string
+}
+
+// IncompleteVersion is a restored or recorded version, or chunk, missing some of its data
+// Shards kept at locations that weren't crawled are unchecked and assumed to be there
+type IncompleteVersion struct {
+	Kind              string
+	ObjectID          string
+	VersionID         string
+	MissingShards     []int
+	TruncatedShards   []int
+	UncheckedShards   []int
+	MissingChunks     []string
+	Stripes           int
+	IncompleteStripes int // stripes missing at least one shard, repair can rebuild them
+	UnreadableStripes int // stripes left with fewer shards than the data shards, they are lost
+}
+
+// RecoveryConflict is a version or chunk that wasn't restored as its manifests disagree with each other or with the database
+type RecoveryConflict struct {
+	ObjectID  string
+	VersionID string
+	Reason    string
+}
+
+// InvalidManifest is a stored manifest that couldn't be read or verified
+type InvalidManifest struct {
+	Location  string
+	ObjectID  string
+	VersionID string
+	Err       string
+}
+
+// ErrNoTrustedKey is returned when metadata recovery isn't given a key manifests have to be signed with
+// Manifests carry the key they are signed with, trusting that key would let anyone with write access to the shards forge metadata
+var ErrNoTrustedKey = errors.New("no trusted public key to verify manifests with")
+
+// RecoverMetadata rebuilds the buckets, objects, versions and chunks of the database from the manifests
+// kept in the local shard store at the given locations, only manifests signed by one of the trusted keys are restored
+func RecoverMetadata(db *sql.DB, store sharding.ShardStore, locations []string, trusted []ed25519.PublicKey, logger *zap.Logger) (*RecoveryReport, error) {
+	return recoverMetadata(db, &storeBackend{store: store}, locations, trusted, logger)
+}
+
+// RecoverMetadataFromNodes rebuilds the database from the manifests kept by the given storage nodes
+func RecoverMetadataFromNodes(db *sql.DB, nodes []string, trusted []ed25519.PublicKey, logger *zap.Logger) (*RecoveryReport, error) {
+	return recoverMetadata(db, newNodeBackend(nodes, logger), nodes, trusted, logger)
+}
+
+// storedID is the object and version shards are stored under
+type storedID struct {
+	objectID  string
+	versionID string
+}
+
+// recoveryScan is what crawling the locations found
+type recoveryScan struct {
+	// shards holds the size of every shard found, by stored ID, location and shard index
+	shards  map[storedID]map[string]map[int]int64
+	crawled map[string]bool
+}
+
+func (s *recoveryScan) shardSize(id storedID, location string, idx int) (int64, bool) {
+	size, ok := s.shards[id][location][idx]
+	return size, ok
+}
+
+// validManifest is a verified manifest, with the bytes that were signed so copies can be compared
+type validManifest struct {
+	body     []byte
+	manifest *manifest.Manifest
+}
+
+// recoveredChunk is the chunk manifest chosen for a hash of a bucket
+type recoveredChunk struct {
+	id       storedID
+	manifest *manifest.Manifest
+}
+
+func recoverMetadata(db *sql.DB, lister shardLister, locations []string, trusted []ed25519.PublicKey, logger *zap.Logger) (*RecoveryReport, error) {
+	if len(trusted) == 0 {
+		return nil, ErrNoTrustedKey
+	}
+	report := &RecoveryReport{}
+	scan := &recoveryScan{shards: make(map[storedID]map[string]map[int]int64), crawled: make(map[string]bool)}
+
+	for _, location := range locations {
+		scanned := ScannedLocation{Location: location}
+		shards, err := lister.listShards(location)
+		if err != nil {
+			logger.Warn("Failed to list shards", zap.String("location", location), zap.Error(err))
+			scanned.Err = err.Error()
+			report.Locations = append(report.Locations, scanned)
+			continue
+		}
+
+		scan.crawled[location] = true
+		for _, shard := range shards {
+			id := storedID{shard.ObjectID, shard.VersionID}
+			if scan.shards[id] == nil {
+				scan.shards[id] = make(map[string]map[int]int64)
+			}
+			if scan.shards[id][location] == nil {
+				scan.shards[id][location] = make(map[int]int64)
+			}
+			scan.shards[id][location][shard.Index] = shard.Size
+			if shard.Index == manifest.ShardIndex {
+				scanned.Manifests++
+			} else {
+				scanned.Shards++
+			}
+		}
+		report.Locations = append(report.Locations, scanned)
+	}
+
+	manifests := readRecoveryManifests(scan, lister, trusted, report)
+
+	// Versions are restored oldest first, so every object ends up with its latest version
+	var versions []*manifest.Manifest
+	chunkManifests := make(map[string][]recoveredChunk)
+	for id, m := range manifests {
+		switch m.Kind {
+		case manifest.KindChunk:
+			addChunkManifest(chunkManifests, id, m)
+		case manifest.KindChunkSet:
+			// Every chunk of the set is restored as if it had a manifest of its own
+			for _, chunk := range m.Chunks {
+				addChunkManifest(chunkManifests, storedID{chunk.Metadata.ChunkID, bucket.ChunkVersionID}, chunkManifest(m.BucketID, chunk.Hash, chunk.Size, chunk.Metadata))
+			}
+		default:
+			versions = append(versions, m)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		a, b := versions[i], versions[j]
+		if a.CreatedAt != b.CreatedAt {
+			return a.CreatedAt < b.CreatedAt
+		}
+		if a.ObjectID != b.ObjectID {
+			return a.ObjectID < b.ObjectID
+		}
+		return a.VersionID < b.VersionID
+	})
+
+	versions = dropSplitObjects(versions, report)
+	if err := restoreBuckets(db, versions, report); err != nil {
+		return report, err
+	}
+
+	// accounted holds every stored ID whose shards belong to a restored or recorded version or chunk
+	accounted := make(map[storedID]bool)
+	refs := make(map[string]int)
+	referenced := make(map[string]bool)
+	var kept []*manifest.Manifest
+	for _, m := range versions {
+		restored, err := bucket.RestoreVersion(db, m.RootVersion, *m.Version)
+		if errors.Is(err, bucket.ErrObjectConflict) {
+			report.Conflicts = append(report.Conflicts, RecoveryConflict{m.ObjectID, m.VersionID, err.Error()})
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+
+		if restored {
+			report.VersionsRestored++
+		} else {
+			report.VersionsExisting++
+		}
+		for _, ref := range m.Version.Chunks {
+			key := m.BucketID + "/" + ref.Hash
+			referenced[key] = true
+			if restored {
+				refs[key]++
+			}
+		}
+		accounted[storedID{m.ObjectID, m.VersionID}] = true
+		kept = append(kept, m)
+	}
+
+	chunks, err := restoreChunks(db, chunkManifests, refs, referenced, scan, report)
+	if err != nil {
+		return report, err
+	}
+	for _, chunk := range chunks {
+		accounted[chunk.id] = true
+		if set := chunk.manifest.Chunk.Metadata.ChunkSet; set != nil {
+			accounted[storedID{set.ID, bucket.ChunkSetVersionID}] = true
+		}
+		// Chunks found in their set are placed by the manifest made up for them
+		if _, ok := manifests[chunk.id]; !ok {
+			manifests[chunk.id] = chunk.manifest
+		}
+	}
+
+	for _, m := range kept {
+		if err := checkRecoveredVersion(db, m, chunks, scan, report); err != nil {
+			return report, err
+		}
+	}
+	for _, key := range sortedKeys(chunks) {
+		chunk := chunks[key]
+		metadata := chunk.manifest.Chunk.Metadata
+		incomplete := checkShards(manifest.KindChunk, chunk.id, metadata.ShardLocations, metadata.DataShards, metadata.ParityShards, []bucket.StripeMetadata{metadata.Stripe}, scan)
+		if incomplete != nil {
+			report.Incomplete = append(report.Incomplete, *incomplete)
+		}
+	}
+
+	if err := findOrphans(db, scan, manifests, accounted, report); err != nil {
+		return report, err
+	}
+
+	logger.Info("Recovered metadata",
+		zap.Int("versions_restored", report.VersionsRestored),
+		zap.Int("chunks_restored", report.ChunksRestored),
+		zap.Int("conflicts", len(report.Conflicts)),
+		zap.Int("orphans", len(report.Orphans)))
+	return report, nil
+}
+
+// addChunkManifest adds the manifest of a chunk to those found for its hash
+// A chunk found in its chunk set and in a manifest of its own is only added once
+func addChunkManifest(chunkManifests map[string][]recoveredChunk, id storedID, m *manifest.Manifest) {
+	key := m.BucketID + "/" + m.Chunk.Hash
+	for _, found := range chunkManifests[key] {
+		if found.id == id {
+			return
+		}
+	}
+	chunkManifests[key] = append(chunkManifests[key], recoveredChunk{id, m})
+}
+
+// readRecoveryManifests reads and verifies every manifest copy found, copies of a manifest have to be identical
+func readRecoveryManifests(scan *recoveryScan, lister shardLister, trusted []ed25519.PublicKey, report *RecoveryReport) map[storedID]*manifest.Manifest {
+	manifests := make(map[storedID]*manifest.Manifest)
+	for _, id := range sortedIDs(scan.shards) {
+		var copies []validManifest
+		for _, location := range sortedKeys(scan.shards[id]) {
+			if _, ok := scan.shardSize(id, location, manifest.ShardIndex); !ok {
+				continue
+			}
+			m, err := readRecoveryManifest(id, location, lister, trusted)
+			if err != nil {
+				report.InvalidManifests = append(report.InvalidManifests, InvalidManifest{location, id.objectID, id.versionID, err.Error()})
+				continue
+			}
+			copies = append(copies, m)
+		}
+		if len(copies) == 0 {
+			continue
+		}
+
+		conflict := false
+		for _, c := range copies[1:] {
+			if !bytes.Equal(c.body, copies[0].body) {
+				conflict = true
+				break
+			}
+		}
+		if conflict {
+			report.Conflicts = append(report.Conflicts, RecoveryConflict{id.objectID, id.versionID, "copies of the manifest differ"})
+			continue
+		}
+		manifests[id] = copies[0].manifest
+	}
+	return manifests
+}
+
+// readRecoveryManifest reads and verifies a manifest copy, and checks it describes what it is stored under
+func readRecoveryManifest(id storedID, location string, lister shardLister, trusted []ed25519.PublicKey) (validManifest, error) {
+	data, err := lister.readShard(id.objectID, id.versionID, manifest.ShardIndex, location)
+	if err != nil {
+		return validManifest{}, err
+	}
+	signed, err := manifest.Parse(data)
+	if err != nil {
+		return validManifest{}, err
+	}
+	m, err := signed.Verify(trusted...)
+	if err != nil {
+		return validManifest{}, err
+	}
+
+	if m.ObjectID != id.objectID || m.VersionID != id.versionID {
+		return validManifest{}, fmt.Errorf("manifest describes %s/%s", m.ObjectID, m.VersionID)
+	}
+	switch {
+	case m.Kind == manifest.KindVersion && m.Version != nil:
+		if m.Version.BucketID != m.BucketID || m.Version.ObjectID != m.ObjectID || m.Version.VersionID != m.VersionID {
+			return validManifest{}, errors.New("version metadata doesn't match the manifest")
+		}
+	case m.Kind == manifest.KindChunk && m.Chunk != nil:
+		if m.Chunk.Metadata.ChunkID != m.ObjectID || m.VersionID != bucket.ChunkVersionID {
+			return validManifest{}, errors.New("chunk metadata doesn't match the manifest")
+		}
+	case m.Kind == manifest.KindChunkSet && len(m.Chunks) > 0:
+		if m.VersionID != bucket.ChunkSetVersionID {
+			return validManifest{}, errors.New("chunk set metadata doesn't match the manifest")
+		}
+		for _, chunk := range m.Chunks {
+			if set := chunk.Metadata.ChunkSet; chunk.Metadata.ChunkID == "" || set == nil || set.ID != m.ObjectID {
+				return validManifest{}, fmt.Errorf("chunk %s isn't part of the set", chunk.Hash)
+			}
+		}
+	default:
+		return validManifest{}, fmt.Errorf("invalid %q manifest", m.Kind)
+	}
+	return validManifest{body: signed.Manifest, manifest: m}, nil
+}
+
+// dropSplitObjects leaves out the objects whose versions claim different buckets
+func dropSplitObjects(versions []*manifest.Manifest, report *RecoveryReport) []*manifest.Manifest {
+	buckets := make(map[string]map[string]bool)
+	for _, m := range versions {
+		if buckets[m.ObjectID] == nil {
+			buckets[m.ObjectID] = make(map[string]bool)
+		}
+		buckets[m.ObjectID][m.BucketID] = true
+	}
+
+	var kept []*manifest.Manifest
+	for _, m := range versions {
+		if len(buckets[m.ObjectID]) > 1 {
+			report.Conflicts = append(report.Conflicts, RecoveryConflict{m.ObjectID, m.VersionID,
+				fmt.Sprintf("versions of the object are in buckets %v", sortedKeys(buckets[m.ObjectID]))})
+			continue
+		}
+		kept = append(kept, m)
+	}
+	return kept
+}
+
+// restoreBuckets creates the buckets of the versions that aren't recorded
+// A bucket gets the owner, erasure profile and dedup mode of its latest version
+func restoreBuckets(db *sql.DB, versions []*manifest.Manifest, report *RecoveryReport) error {
+	latest := make(map[string]*manifest.Manifest)
+	for _, m := range versions {
+		latest[m.BucketID] = m
+	}
+
+	for _, bucketID := range sortedKeys(latest) {
+		exists, err := bucket.BucketExists(db, bucketID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		m := latest[bucketID]
+		owner := RecoveredBucketOwner
+		for _, v := range versions {
+			if v.BucketID == bucketID && v.BucketOwner != "" {
+				owner = v.BucketOwner
+			}
+		}
+		dedup := len(m.Version.Chunks) > 0
+		if err := bucket.CreateBucketWithOptions(db, bucketID, owner, m.Version.ErasureProfile(), dedup); err != nil {
+			return fmt.Errorf("failed to restore bucket %s: %w", bucketID, err)
+		}
+		report.BucketsCreated = append(report.BucketsCreated, bucketID)
+	}
+	return nil
+}
+
+// restoreChunks records the chunks referenced by the versions, by bucket and hash
+// Chunks stored twice under the same hash only keep the copy with the most shards found
+func restoreChunks(db *sql.DB, chunkManifests map[string][]recoveredChunk, refs map[string]int, referenced map[string]bool, scan *recoveryScan, report *RecoveryReport) (map[string]recoveredChunk, error) {
+	chunks := make(map[string]recoveredChunk)
+	for _, key := range sortedKeys(chunkManifests) {
+		if !referenced[key] {
+			// Shards of chunks no version refers to are reported as orphans
+			continue
+		}
+
+		candidates := chunkManifests[key]
+		sort.Slice(candidates, func(i, j int) bool {
+			a, b := foundShards(scan, candidates[i].id), foundShards(scan, candidates[j].id)
+			if a != b {
+				return a > b
+			}
+			return candidates[i].id.objectID < candidates[j].id.objectID
+		})
+		chosen := candidates[0]
+		for _, other := range candidates[1:] {
+			report.Conflicts = append(report.Conflicts, RecoveryConflict{other.id.objectID, other.id.versionID,
+				fmt.Sprintf("chunk %s is also stored as %s, which was kept", chosen.manifest.Chunk.Hash, chosen.id.objectID)})
+		}
+
+		m := chosen.manifest
+		if refs[key] > 0 {
+			if err := bucket.RestoreChunk(db, m.BucketID, m.Chunk.Hash, m.Chunk.Size, m.Chunk.Metadata, refs[key]); err != nil {
+				return nil, err
+			}
+			report.ChunksRestored++
+		}
+		chunks[key] = chosen
+	}
+	return chunks, nil
+}
+
+// foundShards counts the shards found for a stored ID
+func foundShards(scan *recoveryScan, id storedID) int {
+	n := 0
+	for _, shards := range scan.shards[id] {
+		n += len(shards)
+	}
+	return n
+}
+
+// checkRecoveredVersion reports a version whose shards or chunks weren't all found
+func checkRecoveredVersion(db *sql.DB, m *manifest.Manifest, chunks map[string]recoveredChunk, scan *recoveryScan, report *RecoveryReport) error {
+	metadata := m.Version
+	id := storedID{m.ObjectID, m.VersionID}
+	if len(metadata.Chunks) == 0 {
+		profile := metadata.ErasureProfile()
+		incomplete := checkShards(manifest.KindVersion, id, metadata.ShardLocations, profile.DataShards, profile.ParityShards, metadata.Stripes, scan)
+		if incomplete != nil {
+			report.Incomplete = append(report.Incomplete, *incomplete)
+		}
+		return nil
+	}
+
+	// Chunks neither found nor recorded are missing, a recorded chunk is checked by whoever recorded it
+	var unknown []string
+	seen := make(map[string]bool)
+	for _, ref := range metadata.Chunks {
+		if _, ok := chunks[m.BucketID+"/"+ref.Hash]; !ok && !seen[ref.Hash] {
+			seen[ref.Hash] = true
+			unknown = append(unknown, ref.Hash)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	recorded, err := bucket.GetChunks(db, m.BucketID, unknown)
+	if err != nil {
+		return err
+	}
+
+	incomplete := IncompleteVersion{Kind: manifest.KindVersion, ObjectID: m.ObjectID, VersionID: m.VersionID}
+	for _, hash := range unknown {
+		if _, ok := recorded[hash]; !ok {
+			incomplete.MissingChunks = append(incomplete.MissingChunks, hash)
+		}
+	}
+	if len(incomplete.MissingChunks) > 0 {
+		report.Incomplete = append(report.Incomplete, incomplete)
+	}
+	return nil
+}
+
+// checkShards compares the shards found with those a version or chunk was stored with
+// Every shard holds one shard of each stripe back to back, so a truncated shard only holds the first stripes
+func checkShards(kind string, id storedID, shardLocations map[string]string, dataShards, parityShards int, stripes []bucket.StripeMetadata, scan *recoveryScan) *IncompleteVersion {
+	incomplete := IncompleteVersion{Kind: kind, ObjectID: id.objectID, VersionID: id.versionID, Stripes: len(stripes)}
+
+	// covered counts, for every stripe, the shards that hold it
+	covered := make([]int, len(stripes))
+	for idx := 0; idx < dataShards+parityShards; idx++ {
+		location := shardLocations[proofofinclusion.ProofKey(idx)]
+		if location != "" && !scan.crawled[location] {
+			incomplete.UncheckedShards = append(incomplete.UncheckedShards, idx)
+			for s := range covered {
+				covered[s]++
+			}
+			continue
+		}
+		size, ok := scan.shardSize(id, location, idx)
+		if location == "" || !ok {
+			incomplete.MissingShards = append(incomplete.MissingShards, idx)
+			continue
+		}
+
+		var end int64
+		truncated := false
+		for s, stripe := range stripes {
+			end += stripe.ShardSize
+			if end > size {
+				truncated = true
+				break
+			}
+			covered[s]++
+		}
+		if truncated {
+			incomplete.TruncatedShards = append(incomplete.TruncatedShards, idx)
+		}
+	}
+
+	for _, n := range covered {
+		if n < dataShards+parityShards {
+			incomplete.IncompleteStripes++
+		}
+		if n < dataShards {
+			incomplete.UnreadableStripes++
+		}
+	}
+	if len(incomplete.MissingShards) == 0 && len(incomplete.TruncatedShards) == 0 {
+		return nil
+	}
+	return &incomplete
+}
+
+// findOrphans reports the shards found that nothing accounts for
+// Versions and chunks recorded without a manifest, stored before manifests existed, account for their shards
+func findOrphans(db *sql.DB, scan *recoveryScan, manifests map[storedID]*manifest.Manifest, accounted map[storedID]bool, report *RecoveryReport) error {
+	for _, id := range sortedIDs(scan.shards) {
+		if !accounted[id] {
+			recorded, err := isRecorded(db, id)
+			if err != nil {
+				return err
+			}
+			if recorded {
+				continue
+			}
+		}
+
+		// Shards of an accounted ID are only orphans when they aren't where its manifest places them,
+		// chunk sets have nothing but their manifest
+		var shardLocations map[string]string
+		if m := manifests[id]; accounted[id] && m != nil {
+			switch {
+			case m.Version != nil:
+				shardLocations = m.Version.ShardLocations
+			case m.Chunk != nil:
+				shardLocations = m.Chunk.Metadata.ShardLocations
+			}
+		}
+		for _, location := range sortedKeys(scan.shards[id]) {
+			for _, idx := range sortedKeys(scan.shards[id][location]) {
+				if accounted[id] && (idx == manifest.ShardIndex || shardLocations[proofofinclusion.ProofKey(idx)] == location) {
+					continue
+				}
+				report.Orphans = append(report.Orphans, sharding.ShardKey{Location: location, ObjectID: id.objectID, VersionID: id.versionID, Index: idx})
+			}
+		}
+	}
+	return nil
+}
+
+// isRecorded reports whether the database already records the version, chunk or chunk set shards are stored under
+func isRecorded(db *sql.DB, id storedID) (bool, error) {
+	if id.versionID == bucket.ChunkVersionID {
+		return bucket.ChunkIDExists(db, id.objectID)
+	}
+	if id.versionID == bucket.ChunkSetVersionID {
+		return bucket.ChunkSetInUse(db, id.objectID)
+	}
+	versions, err := bucket.ListObjectVersions(db, id.objectID)
+	if err != nil {
+		return false, err
+	}
+	for _, versionID := range versions {
+		if versionID == id.versionID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func sortedIDs[V any](m map[storedID]V) []storedID {
+	ids := make([]storedID, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].objectID != ids[j].objectID {
+			return ids[i].objectID < ids[j].objectID
+		}
+		return ids[i].versionID < ids[j].versionID
+	})
+	return ids
+}
+
+func sortedKeys[K int | string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
@@ -0,0 +1,271 @@
+package datastorage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/encryption"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/manifest"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// rewrapBatchSize is how many versions or chunks are re-wrapped between two progress records
+const rewrapBatchSize = 100
+
+// RewrapDataKeys re-wraps the data key of every version and every deduplicated chunk under the current key encryption key
+// Only the wrapped keys change, the object data is never re-encrypted
+// The manifests of a batch are re-signed and stored again with the new wrapped keys before the batch is committed,
+// so the database never names a key whose manifests still need the previous one. A batch whose manifests couldn't all
+// be stored is left as it is and stops the run
+// Progress is recorded after every batch, so an interrupted run resumes where it stopped
+func RewrapDataKeys(db *sql.DB, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (int, error) {
+	provider, err := keyProvider(cfg)
+	if err != nil {
+		return 0, err
+	}
+	target, err := provider.CurrentKeyID()
+	if err != nil {
+		return 0, err
+	}
+
+	backend := newRoutedBackend(store, logger)
+	versions, err := rewrapVersions(db, provider, target, backend, cfg, logger)
+	if err != nil {
+		return versions, err
+	}
+	chunks, err := rewrapChunks(db, provider, target, backend, cfg, logger)
+	return versions + chunks, err
+}
+
+// rewrap returns the data key wrapped under target, or nil when it already is or has no data key to re-wrap
+func rewrap(provider encryption.KeyProvider, target string, key *bucket.WrappedKey) (*bucket.WrappedKey, error) {
+	// Without a data key the data was encrypted with the master key or a customer key and can't be re-wrapped
+	if key == nil || key.KeyID == target {
+		return nil, nil
+	}
+
+	dek, err := provider.Unwrap(key.KeyID, key.Key)
+	if err != nil {
+		return nil, err
+	}
+	keyID, wrapped, err := provider.Wrap(dek)
+	if err != nil {
+		return nil, err
+	}
+	return &bucket.WrappedKey{KeyID: keyID, Key: wrapped}, nil
+}
+
+func rewrapVersions(db *sql.DB, provider encryption.KeyProvider, target string, backend shardBackend, cfg *config.Config, logger *zap.Logger) (int, error) {
+	after, err := bucket.GetRewrapProgress(db, target)
+	if err != nil {
+		return 0, err
+	}
+
+	rewrapped := 0
+	for {
+		versions, err := bucket.ListVersionsAfter(db, after, rewrapBatchSize)
+		if err != nil {
+			return rewrapped, err
+		}
+		if len(versions) == 0 {
+			return rewrapped, nil
+		}
+
+		var updated []bucket.VersionRow
+		for _, version := range versions {
+			metadata := version.Metadata
+			key, err := rewrap(provider, target, metadata.DataKey)
+			if err != nil {
+				return rewrapped, fmt.Errorf("version %s of object %s: %w", metadata.VersionID, metadata.ObjectID, err)
+			}
+			if key == nil {
+				continue
+			}
+
+			version.Metadata.DataKey = key
+			updated = append(updated, version)
+			locations, err := versionManifestLocations(db, &version.Metadata)
+			if err == nil {
+				err = writeManifest(versionManifest(db, version.Metadata, version.RootVersion), locations, backend, cfg, logger)
+			}
+			if err != nil {
+				return rewrapped, fmt.Errorf("failed to rewrite the manifest of version %s of object %s: %w", metadata.VersionID, metadata.ObjectID, err)
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return rewrapped, fmt.Errorf("failed to start transaction: %w", err)
+		}
+		for _, version := range updated {
+			if err := bucket.UpdateVersionMetadata(tx, version.Row, version.Metadata); err != nil {
+				tx.Rollback()
+				return rewrapped, err
+			}
+		}
+		batch := len(updated)
+
+		after = versions[len(versions)-1].Row
+		if err := bucket.SetRewrapProgress(tx, target, after); err != nil {
+			tx.Rollback()
+			return rewrapped, err
+		}
+		if err := tx.Commit(); err != nil {
+			return rewrapped, fmt.Errorf("failed to commit re-wrapped keys: %w", err)
+		}
+
+		rewrapped += batch
+		logger.Info("Re-wrapped data keys",
+			zap.String("key_id", target),
+			zap.Int("versions", batch),
+			zap.Int64("last_version_row", after))
+	}
+}
+
+func rewrapChunks(db *sql.DB, provider encryption.KeyProvider, target string, backend shardBackend, cfg *config.Config, logger *zap.Logger) (int, error) {
+	afterBucketID, afterHash, err := bucket.GetChunkRewrapProgress(db, target)
+	if err != nil {
+		return 0, err
+	}
+
+	rewrapped := 0
+	for {
+		chunks, err := bucket.ListChunksAfter(db, afterBucketID, afterHash, rewrapBatchSize)
+		if err != nil {
+			return rewrapped, err
+		}
+		if len(chunks) == 0 {
+			return rewrapped, nil
+		}
+
+		var updated []bucket.ChunkRow
+		for _, chunk := range chunks {
+			key, err := rewrap(provider, target, chunk.Metadata.DataKey)
+			if err != nil {
+				return rewrapped, fmt.Errorf("chunk %s of bucket %s: %w", chunk.Hash, chunk.BucketID, err)
+			}
+			if key == nil {
+				continue
+			}
+			chunk.Metadata.DataKey = key
+			updated = append(updated, chunk)
+		}
+		if err := rewriteChunkManifests(db, updated, backend, cfg, logger); err != nil {
+			return rewrapped, err
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return rewrapped, fmt.Errorf("failed to start transaction: %w", err)
+		}
+		for _, chunk := range updated {
+			if err := bucket.UpdateChunkMetadata(tx, chunk.BucketID, chunk.Hash, chunk.Metadata); err != nil {
+				tx.Rollback()
+				return rewrapped, err
+			}
+		}
+		batch := len(updated)
+
+		last := chunks[len(chunks)-1]
+		afterBucketID, afterHash = last.BucketID, last.Hash
+		if err := bucket.SetChunkRewrapProgress(tx, target, afterBucketID, afterHash); err != nil {
+			tx.Rollback()
+			return rewrapped, err
+		}
+		if err := tx.Commit(); err != nil {
+			return rewrapped, fmt.Errorf("failed to commit re-wrapped keys: %w", err)
+		}
+
+		rewrapped += batch
+		logger.Info("Re-wrapped chunk data keys",
+			zap.String("key_id", target),
+			zap.Int("chunks", batch),
+			zap.String("last_bucket_id", afterBucketID),
+			zap.String("last_hash", afterHash))
+	}
+}
+
+// rewriteChunkManifests stores the manifests of re-wrapped chunks again, with their new wrapped keys
+// A chunk set is rewritten whole, its chunks that aren't re-wrapped yet keep the key they are recorded with
+func rewriteChunkManifests(db *sql.DB, chunks []bucket.ChunkRow, backend shardBackend, cfg *config.Config, logger *zap.Logger) error {
+	sets := make(map[string]*bucket.ChunkSetRef)
+	rewrapped := make(map[string]bucket.ChunkRow)
+	for _, chunk := range chunks {
+		set := chunk.Metadata.ChunkSet
+		if set == nil {
+			// Chunks stored before chunk sets have a manifest of their own
+			m := chunkManifest(chunk.BucketID, chunk.Hash, chunk.Size, chunk.Metadata)
+			if err := writeManifest(m, manifestLocations(chunk.Metadata.ShardLocations, chunk.Metadata.DegradedShards), backend, cfg, logger); err != nil {
+				return fmt.Errorf("failed to rewrite the manifest of chunk %s: %w", chunk.Hash, err)
+			}
+			continue
+		}
+		sets[set.ID] = set
+		rewrapped[chunk.BucketID+"/"+chunk.Hash] = chunk
+	}
+
+	for _, setID := range sortedKeys(sets) {
+		stored, err := bucket.GetChunkSet(db, setID)
+		if err != nil {
+			return err
+		}
+
+		var bucketID string
+		entries := make([]manifest.ChunkManifest, 0, len(stored))
+		for _, hash := range sortedKeys(stored) {
+			chunk := stored[hash]
+			bucketID = chunk.BucketID
+			metadata := chunk.Metadata
+			if r, ok := rewrapped[chunk.BucketID+"/"+chunk.Hash]; ok {
+				metadata = r.Metadata
+			}
+			entries = append(entries, manifest.ChunkManifest{Hash: chunk.Hash, Size: chunk.Size, Metadata: metadata})
+		}
+		if err := writeManifest(chunkSetManifest(bucketID, sets[setID], entries), sets[setID].Locations, backend, cfg, logger); err != nil {
+			return fmt.Errorf("failed to rewrite the manifest of chunk set %s: %w", setID, err)
+		}
+	}
+	return nil
+}
+
+// CountDataKeysByKey returns how many data keys, of versions and of deduplicated chunks, are wrapped under each key version
+// Chunked versions aren't counted themselves since each of their chunks has a data key of its own
+func CountDataKeysByKey(db *sql.DB) (map[string]int, error) {
+	counts, err := bucket.CountVersionsByKey(db)
+	if err != nil {
+		return nil, err
+	}
+	delete(counts, bucket.ChunkedKeyID)
+
+	chunks, err := bucket.CountChunksByKey(db)
+	if err != nil {
+		return nil, err
+	}
+	for keyID, count := range chunks {
+		counts[keyID] += count
+	}
+	return counts, nil
+}
+
+// StartKeyRewrapper re-wraps data keys in the background whenever the key encryption key was rotated
+// Versions stored while it runs already use the current key, so every pass only has new rows to look at
+func StartKeyRewrapper(db *sql.DB, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger, interval time.Duration) {
+	go func() {
+		for {
+			rewrapped, err := RewrapDataKeys(db, store, cfg, logger)
+			if err != nil {
+				logger.Error("Re-wrapping data keys failed", zap.Error(err))
+			} else if rewrapped > 0 {
+				counts, err := CountDataKeysByKey(db)
+				if err == nil {
+					logger.Info("Data keys re-wrapped", zap.Int("data_keys", rewrapped), zap.Any("data_keys_by_key", counts))
+				}
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
@@ -0,0 +1,100 @@
+package datastorage
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+func TestRecoveryAfterRetiringRewrappedKey(t *testing.T) {
+	dir := t.TempDir()
+	key := make([]byte, 32)
+	rand.Read(key)
+	cfg := &config.Config{
+		EncryptionKey:   key,
+		KeyringPath:     filepath.Join(dir, "keyring.json"),
+		ManifestKeyPath: filepath.Join(dir, "manifest.key"),
+	}
+	logger := zap.NewNop()
+	profile := erasurecoding.StandardProfile
+	locations := make([]string, profile.Total())
+	for i := range locations {
+		locations[i] = fmt.Sprintf("node%d", i)
+	}
+	store := sharding.NewLocalShardStore(filepath.Join(dir, "shards"))
+
+	db, err := bucket.OpenDB(filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// One bucket keeps a data key per version, the other one per chunk
+	stored := make(map[string][]byte)
+	versions := make(map[string]string)
+	for _, bucketID := range []string{"plain", "dedup"} {
+		if err := bucket.CreateBucketWithOptions(db, bucketID, "owner", profile, bucketID == "dedup"); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, 1<<20)
+		rand.Read(data)
+		versionID, _, _, err := StoreData(db, data, bucketID, bucketID+"-object", "object.bin", store, cfg, locations, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored[bucketID], versions[bucketID] = data, versionID
+	}
+
+	provider, err := keyProvider(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKeyID, err := provider.CurrentKeyID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RotateKey(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := RetireKey(db, cfg, oldKeyID); err == nil {
+		t.Fatal("retired a key data keys are still wrapped under")
+	}
+	if _, err := RewrapDataKeys(db, store, cfg, logger); err != nil {
+		t.Fatal(err)
+	}
+	if err := RetireKey(db, cfg, oldKeyID); err != nil {
+		t.Fatal(err)
+	}
+
+	// The manifests carry the re-wrapped data keys, so the recovered versions can still be read
+	node, err := nodeKey(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := bucket.OpenDB(filepath.Join(dir, "recovered.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	if _, err := RecoverMetadata(recovered, store, locations, []ed25519.PublicKey{node.Public().(ed25519.PublicKey)}, logger); err != nil {
+		t.Fatal(err)
+	}
+	for bucketID, data := range stored {
+		got, _, err := RetrieveData(recovered, bucketID, bucketID+"-object", versions[bucketID], store, cfg, logger)
+		if err != nil {
+			t.Fatalf("version of bucket %s: %v", bucketID, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("recovered version of bucket %s differs", bucketID)
+		}
+	}
+}
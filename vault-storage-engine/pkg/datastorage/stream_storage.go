@@ -0,0 +1,352 @@
+package datastorage
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/encryption"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/proofofinclusion"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/proofofstorage"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// StoreDataStream stores an object read from r inside a bucket
+// The object is read one stripe at a time, each stripe is compressed, encrypted and erasure coded
+// and its shards are appended to the shards of the version, so the object never has to fit in memory
+func StoreDataStream(db *sql.DB, r io.Reader, bucketID, objectID, filePath string, store sharding.ShardStore, cfg *config.Config, locations []string, logger *zap.Logger) (string, map[string]string, []string, error) {
+	// Generate unique version ID
+	versionID := uuid.New().String()
+	return StoreDataStreamWithVersion(db, r, bucketID, objectID, versionID, filePath, store, cfg, locations, logger)
+}
+
+// StoreDataStreamWithVersion is an alternative function to StoreDataStream
+// It takes a pre-defined object version instead of defining it locally
+func StoreDataStreamWithVersion(db *sql.DB, r io.Reader, bucketID, objectID, versionID, filePath string, store sharding.ShardStore, cfg *config.Config, locations []string, logger *zap.Logger) (string, map[string]string, []string, error) {
+	backend := &storeBackend{store: store, locations: locations}
+	profile, err := bucket.GetBucketProfile(db, bucketID)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	shardLocations, proofs, err := storeStripes(db, r, bucketID, objectID, versionID, filePath, profile, backend, cfg, nil, logger)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	fmt.Printf("Stored %s as object %s (version %s) in bucket %s\n", filePath, objectID, versionID, bucketID)
+	return versionID, shardLocations, proofs, nil
+}
+
+// StoreDataStreamWithCustomerKey stores an object encrypted with a key supplied by the customer
+// Only a fingerprint of the key is recorded, the same key has to be supplied to read the object back
+func StoreDataStreamWithCustomerKey(db *sql.DB, r io.Reader, bucketID, objectID, filePath string, store sharding.ShardStore, cfg *config.Config, locations []string, customerKey []byte, logger *zap.Logger) (string, map[string]string, []string, error) {
+	if len(customerKey) != encryption.DataKeySize {
+		return "", nil, nil, encryption.ErrInvalidCustomerKey
+	}
+
+	versionID := uuid.New().String()
+	profile, err := bucket.GetBucketProfile(db, bucketID)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	backend := &storeBackend{store: store, locations: locations}
+	shardLocations, proofs, err := storeStripes(db, r, bucketID, objectID, versionID, filePath, profile, backend, cfg, customerKey, logger)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	fmt.Printf("Stored %s as object %s (version %s) in bucket %s\n", filePath, objectID, versionID, bucketID)
+	return versionID, shardLocations, proofs, nil
+}
+
+// NewStoreDataStream stores an object read from r by distributing its shards across storage nodes
+// Every shard is streamed to its storage node while the stripes are being encoded
+func NewStoreDataStream(db *sql.DB, r io.Reader, bucketID, objectID, filePath string, store sharding.ShardStore, cfg *config.Config, locations []string, logger *zap.Logger) (string, map[string]string, []string, error) {
+	versionID := uuid.New().String()
+	return NewStoreDataStreamWithVersion(db, r, bucketID, objectID, versionID, filePath, store, cfg, locations, logger)
+}
+
+// NewStoreDataStreamWithVersion stores data read from r with a specified version ID
+// It follows the same flow as NewStoreDataStream but uses the provided version ID instead of generating a new one
+func NewStoreDataStreamWithVersion(db *sql.DB, r io.Reader, bucketID, objectID, versionID, filePath string, store sharding.ShardStore, cfg *config.Config, locations []string, logger *zap.Logger) (string, map[string]string, []string, error) {
+	// Let's find available storage nodes through the discovey service instead of hardcoded location
+	storageNodes, err := LookupStorageNodes(logger)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to lookup storage nodes: %w", err)
+	}
+
+	profile, err := bucket.GetBucketProfile(db, bucketID)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	// Check if we have enough storage nodes available
+	totalShards := profile.Total()
+	if len(storageNodes) < totalShards {
+		return "", nil, nil, fmt.Errorf("not enough storage nodes availale: need %d, found %d", totalShards, len(storageNodes))
+	}
+	// Shards go to the nodes that passed their audits best, shard n is sent to the nth node
+	storageNodes = rankStorageNodes(db, storageNodes, totalShards, logger)
+
+	backend := newNodeBackend(storageNodes, logger)
+	shardLocations, proofs, err := storeStripes(db, r, bucketID, objectID, versionID, filePath, profile, backend, cfg, nil, logger)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	logger.Info("Object stored successfully across storage nodes",
+		zap.String("object_id", objectID),
+		zap.String("version_id", versionID))
+
+	return versionID, shardLocations, proofs, nil
+}
+
+// storeStripes runs the stripe pipeline for a version and records its metadata
+// Every version of a bucket is stored with profile, the erasure profile of the bucket
+// When customerKey is set the version is encrypted with it instead of a data key of its own
+func storeStripes(db *sql.DB, r io.Reader, bucketID, objectID, versionID, filePath string, profile erasurecoding.Profile, backend shardBackend, cfg *config.Config, customerKey []byte, logger *zap.Logger) (map[string]string, []string, error) {
+	// Deduplicated buckets store content-defined chunks shared between versions instead of stripes
+	dedup, err := bucket.GetBucketDedup(db, bucketID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dedup {
+		if customerKey != nil {
+			return nil, nil, ErrDedupCustomerKey
+		}
+		return storeChunkedVersion(db, r, bucketID, objectID, versionID, filePath, profile, backend, cfg, logger)
+	}
+
+	// The first stripe is read up front, adaptive compression picks the codecs from it
+	stripeSize := getStripeSize(cfg)
+	buf := make([]byte, stripeSize)
+	n, readErr := io.ReadFull(r, buf)
+	if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+		return nil, nil, fmt.Errorf("failed to read object data: %w", readErr)
+	}
+
+	codecs, err := chooseCodecs(cfg, filePath, buf[:n])
+	if err != nil {
+		return nil, nil, err
+	}
+	pipeline, err := NewPipeline(codecs, profile)
+	if err != nil {
+		return nil, nil, err
+	}
+	pipeline.Bind(bucketID, objectID, versionID, stripeSize)
+
+	// Every version is encrypted with its own data key, only the wrapped key is kept
+	var key []byte
+	var wrappedKey *bucket.WrappedKey
+	var fingerprint string
+	if customerKey != nil {
+		key = customerKey
+		fingerprint = encryption.CustomerKeyFingerprint(customerKey)
+	} else {
+		provider, err := keyProvider(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		dataKey, err := provider.GenerateDataKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		key = dataKey.Plaintext
+		wrappedKey = &bucket.WrappedKey{KeyID: dataKey.KeyID, Key: dataKey.Wrapped}
+	}
+	totalShards := profile.Total()
+
+	// Open every shard before reading any data, each shard receives its part of every stripe
+	// Shards are uploaded concurrently, the version is acknowledged once a write quorum of them is stored
+	uploads := newShardUploads(totalShards, writeQuorum(cfg, profile))
+	hashers := make([]*hashingWriter, totalShards)
+	// Shards kept by storage nodes are sampled for the challenges their nodes are audited with
+	samplers := make([]*proofofstorage.Sampler, totalShards)
+	shardLocations := make(map[string]string)
+	for idx := 0; idx < totalShards; idx++ {
+		hashers[idx] = newHashingWriter(io.Discard)
+		w, location, err := backend.openWriter(objectID, versionID, idx)
+		if err != nil {
+			logger.Warn("Failed to open shard", zap.Int("shard", idx), zap.Error(err))
+			uploads.errs[idx] = err
+			continue
+		}
+		uploads.uploads[idx] = startShardUpload(w)
+		shardLocations[fmt.Sprintf("shard_%d", idx)] = location
+		if isNodeLocation(location) {
+			samplers[idx] = proofofstorage.NewSampler(proofofstorage.ChallengesPerShard)
+			hashers[idx] = newHashingWriter(samplers[idx])
+		}
+	}
+	if err := uploads.checkQuorum(); err != nil {
+		uploads.abort()
+		return nil, nil, err
+	}
+
+	var stripes []bucket.StripeMetadata
+	var size, encodedSize int64
+	for {
+		if n > 0 {
+			shards, stripe, err := pipeline.EncodeStripe(len(stripes), buf[:n], key)
+			if err != nil {
+				uploads.abort()
+				return nil, nil, err
+			}
+
+			// Every shard is hashed here, even those that weren't stored, so repairs can be checked against the proofs
+			for idx, shard := range shards {
+				hashers[idx].Write(shard)
+			}
+			if err := uploads.write(shards); err != nil {
+				uploads.abort()
+				return nil, nil, err
+			}
+			stripes = append(stripes, stripe)
+			size += int64(n)
+			encodedSize += stripe.CipherSize
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			uploads.abort()
+			return nil, nil, fmt.Errorf("failed to read object data: %w", readErr)
+		}
+		n, readErr = io.ReadFull(r, buf)
+	}
+
+	// Every shard has to be closed, even after a failure, so no upload is left behind
+	degraded, err := uploads.close()
+	if err != nil {
+		// Shards that were stored before the quorum was lost would never be referenced
+		discardShards(objectID, versionID, shardLocations, uploads.errs, backend, logger)
+		return nil, nil, err
+	}
+	for _, idx := range degraded {
+		logger.Warn("Shard was not stored, the version is degraded",
+			zap.String("object_id", objectID),
+			zap.String("version_id", versionID),
+			zap.Int("shard", idx),
+			zap.Error(uploads.errs[idx]))
+	}
+
+	// The Merkle tree is built over the digests of the shards, as the shards are never held in full
+	// Only the root and the sibling path of every shard are kept, any shard can be verified against them on its own
+	digests := make([][]byte, totalShards)
+	for idx, hasher := range hashers {
+		digests[idx] = hasher.Sum()
+	}
+
+	tree, err := proofofinclusion.BuildMerkleTree(digests)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build Merkle tree: %w", err)
+	}
+
+	proofs := make([]string, totalShards)
+	proofMap := make(map[string]string, totalShards)
+	for idx := range digests {
+		proof, err := tree.GetProof(idx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get proof: %w", err)
+		}
+		proofs[idx] = proof.String()
+		proofMap[proofofinclusion.ProofKey(idx)] = proofs[idx]
+	}
+
+	// Save the object metadata in the database
+	metadata := bucket.VersionMetadata{
+		BucketID:       bucketID,
+		ObjectID:       objectID,
+		VersionID:      versionID,
+		Filename:       filepath.Base(filePath),
+		Filesize:       fmt.Sprintf("%d", size),
+		Format:         strings.TrimPrefix(filepath.Ext(filePath), "."),
+		CreationDate:   time.Now().Format(time.RFC3339),
+		ShardLocations: shardLocations,
+		Proofs:         proofMap,
+		MerkleRoot:     hex.EncodeToString(tree.Root()),
+		Codecs:         &pipeline.Codecs,
+		DataKey:        wrappedKey,
+		CustomerKey:    fingerprint,
+		DataShards:     profile.DataShards,
+		ParityShards:   profile.ParityShards,
+		EncodedSize:    encodedSize,
+		StripeSize:     stripeSize,
+		Stripes:        stripes,
+		DegradedShards: degraded,
+	}
+
+	// The ciphertext only lives in the shards, it is never held in full to be kept in the database
+	root_version, err := bucket.GetRootVersion(db, objectID)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = bucket.AddVersion(db, bucketID, objectID, versionID, root_version, metadata, []byte{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to add version to database: %w", err)
+	}
+
+	filename := filepath.Base(filePath)
+	// Ensure object exists in the database
+	err = bucket.AddObject(db, bucketID, objectID, filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to register object in bucket: %w", err)
+	}
+	recordChallenges(db, objectID, versionID, shardLocations, samplers, degraded, logger)
+	storeManifest(versionManifest(db, metadata, root_version), manifestLocations(shardLocations, degraded), backend, cfg, logger)
+
+	return shardLocations, proofs, nil
+}
+
+// discardShards deletes the shards of a version that was never recorded, shards with an error weren't stored
+func discardShards(objectID, versionID string, shardLocations map[string]string, errs []error, backend shardBackend, logger *zap.Logger) {
+	for idx, err := range errs {
+		location, ok := shardLocations[fmt.Sprintf("shard_%d", idx)]
+		if err != nil || !ok {
+			continue
+		}
+		if err := backend.deleteShard(objectID, versionID, idx, location); err != nil {
+			logger.Warn("Failed to delete shard", zap.String("object_id", objectID), zap.String("version_id", versionID), zap.Int("shard", idx), zap.String("location", location), zap.Error(err))
+		}
+	}
+}
+
+// decodeUnstriped decodes versions stored before objects were split into stripes
+// Those versions were encoded with the legacy profile as a single unit without a recorded length,
+// the zero padding is dropped one byte at a time until the ciphertext authenticates
+func decodeUnstriped(pipeline *Pipeline, shards [][]byte, key []byte) ([]byte, error) {
+	padded, err := erasurecoding.LegacyProfile.DecodePadded(shards)
+	if err != nil {
+		return nil, fmt.Errorf("erasure decoding failed: %w", err)
+	}
+
+	var data []byte
+	cipherText := padded
+	for {
+		data, err = pipeline.Encryptor.Decrypt(cipherText, key, nil)
+		if err == nil {
+			break
+		}
+		// The padding is shorter than a byte per data shard
+		if len(cipherText) == 0 || cipherText[len(cipherText)-1] != 0 || len(padded)-len(cipherText) >= erasurecoding.LegacyProfile.DataShards-1 {
+			return nil, fmt.Errorf("decryption failed: %w", err)
+		}
+		cipherText = cipherText[:len(cipherText)-1]
+	}
+
+	plainText, err := pipeline.Compressor.Decompress(data)
+	if err != nil {
+		return nil, fmt.Errorf("decompression failed, %w", err)
+	}
+	return plainText, nil
+}
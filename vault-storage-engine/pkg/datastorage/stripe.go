@@ -0,0 +1,41 @@
+package datastorage
+
+import (
+	"crypto/sha256"
+	"hash"
+	"io"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+)
+
+// DefaultStripeSize is the amount of plaintext that is compressed, encrypted and erasure coded at a time
+// Peak memory of a store is bounded by the stripe size times the shard count, not by the object size
+const DefaultStripeSize = 4 << 20
+
+// getStripeSize returns the configured stripe size, or the default one
+func getStripeSize(cfg *config.Config) int {
+	if cfg.StripeSize > 0 {
+		return cfg.StripeSize
+	}
+	return DefaultStripeSize
+}
+
+// hashingWriter keeps a running SHA-256 digest of everything written to a shard
+type hashingWriter struct {
+	w    io.Writer
+	hash hash.Hash
+}
+
+func newHashingWriter(w io.Writer) *hashingWriter {
+	return &hashingWriter{w: w, hash: sha256.New()}
+}
+
+func (hw *hashingWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.hash.Write(p[:n])
+	return n, err
+}
+
+func (hw *hashingWriter) Sum() []byte {
+	return hw.hash.Sum(nil)
+}
@@ -0,0 +1,220 @@
+package datastorage
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/erasurecoding"
+)
+
+const (
+	// shardQueueStripes is how many stripes a shard may fall behind the encoder before the encoder waits for it
+	shardQueueStripes = 4
+	// shardStallTimeout is how long the encoder waits for a shard that fell behind,
+	// after that the shard is dropped as long as the write quorum still holds
+	shardStallTimeout = 30 * time.Second
+)
+
+// errShardDropped is what shards dropped by the encoder are aborted with
+var errShardDropped = errors.New("shard dropped, it fell too far behind the other shards")
+
+// writeQuorum returns how many shards of a version have to be stored before the version is acknowledged
+// Without a configured quorum every shard has to be stored, a quorum can't be lower than the shards needed to read the version back
+func writeQuorum(cfg *config.Config, profile erasurecoding.Profile) int {
+	quorum := cfg.WriteQuorum
+	if quorum <= 0 || quorum > profile.Total() {
+		return profile.Total()
+	}
+	if quorum < profile.DataShards {
+		return profile.DataShards
+	}
+	return quorum
+}
+
+// shardUpload writes one shard on its own goroutine, so every shard of a version is uploaded concurrently
+// and a slow shard only holds the others back once its queue is full
+// The goroutine owns the shard writer, it closes the writer once the queue is closed, or aborts it if the upload was cancelled
+type shardUpload struct {
+	queue    chan []byte
+	result   chan error
+	failed   atomic.Bool
+	cancel   atomic.Bool
+	finished bool
+}
+
+func startShardUpload(w shardWriter) *shardUpload {
+	u := &shardUpload{
+		queue:  make(chan []byte, shardQueueStripes),
+		result: make(chan error, 1),
+	}
+
+	go func() {
+		var err error
+		for shard := range u.queue {
+			if err != nil {
+				// Keep draining, so the encoder never blocks on a failed shard
+				continue
+			}
+			if _, err = w.Write(shard); err != nil {
+				u.failed.Store(true)
+			}
+		}
+
+		if err == nil && u.cancel.Load() {
+			err = errShardDropped
+		}
+		if err != nil {
+			w.Abort(err)
+			u.result <- err
+			return
+		}
+		u.result <- w.Close()
+	}()
+	return u
+}
+
+// send queues the shard of the next stripe, waiting up to timeout for room in the queue
+// It reports false when the shard can't keep up
+func (u *shardUpload) send(shard []byte, timeout time.Duration) bool {
+	select {
+	case u.queue <- shard:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case u.queue <- shard:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// finish ends the queue of the shard, a cancelled shard is aborted instead of being stored
+// The outcome of the upload is read from result
+func (u *shardUpload) finish(cancel bool) {
+	if u.finished {
+		return
+	}
+	u.finished = true
+	if cancel {
+		u.cancel.Store(true)
+	}
+	close(u.queue)
+}
+
+// shardUploads tracks the uploads of every shard of a version
+// Shards that can't be written are dropped, the version is only lost once fewer than quorum shards are left
+type shardUploads struct {
+	uploads []*shardUpload // nil for shards that couldn't be opened
+	errs    []error
+	quorum  int
+	stall   time.Duration
+}
+
+func newShardUploads(total, quorum int) *shardUploads {
+	return &shardUploads{
+		uploads: make([]*shardUpload, total),
+		errs:    make([]error, total),
+		quorum:  quorum,
+		stall:   shardStallTimeout,
+	}
+}
+
+// live returns how many shards are still being uploaded
+func (s *shardUploads) live() int {
+	n := 0
+	for idx, u := range s.uploads {
+		if u != nil && s.errs[idx] == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// drop gives up on a shard, the version can do without it as long as the quorum holds
+// Without an error of its own, the shard is dropped with the error its upload failed with
+func (s *shardUploads) drop(idx int, err error) {
+	if u := s.uploads[idx]; u != nil {
+		u.finish(true)
+		if err == nil {
+			err = <-u.result
+		}
+	}
+	s.errs[idx] = err
+}
+
+// checkQuorum fails once too few shards are left for the version to be acknowledged
+func (s *shardUploads) checkQuorum() error {
+	if live := s.live(); live < s.quorum {
+		return fmt.Errorf("write quorum lost: %d of %d shards left, %d required: %w", live, len(s.uploads), s.quorum, s.firstErr())
+	}
+	return nil
+}
+
+func (s *shardUploads) firstErr() error {
+	for idx, err := range s.errs {
+		if err != nil {
+			return fmt.Errorf("failed to store shard %d: %w", idx, err)
+		}
+	}
+	return errors.New("no shard failed")
+}
+
+// write hands the shards of one stripe to their uploads
+func (s *shardUploads) write(shards [][]byte) error {
+	for idx, u := range s.uploads {
+		if u == nil || s.errs[idx] != nil {
+			continue
+		}
+		if u.failed.Load() {
+			s.drop(idx, nil)
+			continue
+		}
+		if !u.send(shards[idx], s.stall) {
+			s.drop(idx, errShardDropped)
+		}
+	}
+	return s.checkQuorum()
+}
+
+// abort cancels every upload, no shard of the version is stored
+// Shards that were dropped for falling behind abort on their own once their last write returns
+func (s *shardUploads) abort() {
+	for idx, u := range s.uploads {
+		if u != nil && s.errs[idx] == nil {
+			u.finish(true)
+			s.errs[idx] = <-u.result
+		}
+	}
+}
+
+// close completes every remaining upload and returns the indexes of the shards that weren't stored
+func (s *shardUploads) close() ([]int, error) {
+	for idx, u := range s.uploads {
+		if u != nil && s.errs[idx] == nil {
+			u.finish(false)
+		}
+	}
+	for idx, u := range s.uploads {
+		if u != nil && s.errs[idx] == nil {
+			s.errs[idx] = <-u.result
+		}
+	}
+
+	var degraded []int
+	for idx, err := range s.errs {
+		if err != nil {
+			degraded = append(degraded, idx)
+		}
+	}
+	if err := s.checkQuorum(); err != nil {
+		return nil, err
+	}
+	return degraded, nil
+}
@@ -0,0 +1,66 @@
+package datastorage
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding/shardtest"
+	"go.uber.org/zap"
+)
+
+// failingStore stores whole shards only, and fails to store the shards with index failIdx
+type failingStore struct {
+	sharding.ShardStore
+	failIdx int
+}
+
+func (s failingStore) StoreShard(objectID, versionID string, shardIdx int, shard []byte, location string) error {
+	if shardIdx == s.failIdx {
+		return errors.New("disk full")
+	}
+	return s.ShardStore.StoreShard(objectID, versionID, shardIdx, shard, location)
+}
+
+func TestLostQuorumDeletesStoredShards(t *testing.T) {
+	dir := t.TempDir()
+	key := make([]byte, 32)
+	rand.Read(key)
+	cfg := &config.Config{
+		EncryptionKey:   key,
+		KeyringPath:     filepath.Join(dir, "keyring.json"),
+		ManifestKeyPath: filepath.Join(dir, "manifest.key"),
+	}
+	profile := erasurecoding.StandardProfile
+	locations := make([]string, profile.Total())
+	for i := range locations {
+		locations[i] = fmt.Sprintf("node%d", i)
+	}
+
+	db, err := bucket.OpenDB(filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := bucket.CreateBucketWithOptions(db, "bucket", "owner", profile, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every shard has to be stored without a write quorum, the last one only fails once it is closed
+	memory := shardtest.NewMemoryShardStore()
+	store := failingStore{ShardStore: memory, failIdx: profile.Total() - 1}
+	data := make([]byte, 100<<10)
+	rand.Read(data)
+	if _, _, _, err := StoreData(db, data, "bucket", "object", "object.bin", store, cfg, locations, zap.NewNop()); err == nil {
+		t.Fatal("StoreData succeeded without its write quorum")
+	}
+	if keys := memory.Keys(); len(keys) != 0 {
+		t.Fatalf("shards left behind by a version that was never recorded: %v", keys)
+	}
+}
@@ -0,0 +1,61 @@
+package encryption
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// CustomerKeyAlgorithm is the only algorithm accepted for customer supplied keys
+const CustomerKeyAlgorithm = "AES256"
+
+// ErrInvalidCustomerKey is returned when a customer supplied key can't be used
+var ErrInvalidCustomerKey = errors.New("invalid customer key")
+
+// ParseCustomerKey decodes a base64 customer supplied key and checks it against its base64 digest
+// The digest is either the MD5 or the SHA-256 of the key, told apart by its length
+func ParseCustomerKey(encodedKey, encodedDigest string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key is not valid base64", ErrInvalidCustomerKey)
+	}
+	if len(key) != DataKeySize {
+		return nil, fmt.Errorf("%w: key must be %d bytes, got %d", ErrInvalidCustomerKey, DataKeySize, len(key))
+	}
+
+	digest, err := base64.StdEncoding.DecodeString(encodedDigest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key digest is not valid base64", ErrInvalidCustomerKey)
+	}
+	var expected []byte
+	switch len(digest) {
+	case md5.Size:
+		sum := md5.Sum(key)
+		expected = sum[:]
+	case sha256.Size:
+		sum := sha256.Sum256(key)
+		expected = sum[:]
+	default:
+		return nil, fmt.Errorf("%w: key digest must be an MD5 or a SHA-256", ErrInvalidCustomerKey)
+	}
+	if subtle.ConstantTimeCompare(digest, expected) != 1 {
+		return nil, fmt.Errorf("%w: key doesn't match its digest", ErrInvalidCustomerKey)
+	}
+	return key, nil
+}
+
+// CustomerKeyFingerprint returns the fingerprint recorded for a customer supplied key
+// It identifies the key a version was encrypted with without the key ever being stored
+func CustomerKeyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// MatchesCustomerKey reports whether key is the key a fingerprint was taken from
+func MatchesCustomerKey(fingerprint string, key []byte) bool {
+	return subtle.ConstantTimeCompare([]byte(fingerprint), []byte(CustomerKeyFingerprint(key))) == 1
+}
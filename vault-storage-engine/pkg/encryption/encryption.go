@@ -4,18 +4,34 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 )
 
+// ErrAuthentication is returned when data fails to decrypt, because it was tampered with, or its key
+// or its additional data differ from those it was encrypted with
+var ErrAuthentication = errors.New("message authentication failed")
+
 // Encryptor inerface for encryption
+// additionalData is authenticated along with the data, decrypting fails unless the same additional data is given
 type Encryptor interface {
-	Encrypt(data []byte, key []byte) ([]byte, error)
-	Decrypt(data []byte, key []byte) ([]byte, error)
+	Encrypt(data, key, additionalData []byte) ([]byte, error)
+	Decrypt(data, key, additionalData []byte) ([]byte, error)
 }
 
 // Encrypt uses AES-GCM algorithm to properly encrypt data
 func Encrypt(data, key []byte) ([]byte, error) {
+	return EncryptWithAdditionalData(data, key, nil)
+}
+
+// Decrypt decrypts data using AES-GCM algorithm
+func Decrypt(data, key []byte) ([]byte, error) {
+	return DecryptWithAdditionalData(data, key, nil)
+}
+
+// EncryptWithAdditionalData encrypts data with AES-GCM and authenticates additionalData along with it
+func EncryptWithAdditionalData(data, key, additionalData []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create new cipher key, %w", err)
@@ -30,12 +46,13 @@ func Encrypt(data, key []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
+	ciphertext := gcm.Seal(nonce, nonce, data, additionalData)
 	return ciphertext, nil
 }
 
-// Decrypt decrypts data using AES-GCM algorithm
-func Decrypt(data, key []byte) ([]byte, error) {
+// DecryptWithAdditionalData decrypts data sealed by EncryptWithAdditionalData
+// It fails when additionalData differs from what the data was encrypted with
+func DecryptWithAdditionalData(data, key, additionalData []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create new cipher key, %w", err)
@@ -52,9 +69,9 @@ func Decrypt(data, key []byte) ([]byte, error) {
 	}
 
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt data, %w", err)
+		return nil, fmt.Errorf("failed to decrypt data, %w", ErrAuthentication)
 	}
 
 	return plaintext, nil
@@ -0,0 +1,170 @@
+// Package fakekms is an in-process key management service speaking the protocol of encryption.KMSClient
+// It keeps its keys in memory and is meant for tests and local development only
+package fakekms
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/encryption"
+)
+
+// DefaultKeyName is the key used by requests that don't name one
+const DefaultKeyName = "default"
+
+// Server is a fake KMS listening on a local address
+type Server struct {
+	*httptest.Server
+	token string
+
+	mu       sync.Mutex
+	keys     map[string][]byte
+	current  map[string]string
+	versions map[string]int
+	requests map[string]int
+}
+
+type request struct {
+	KeyID      string `json:"key_id"`
+	Size       int    `json:"size"`
+	Plaintext  []byte `json:"plaintext"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type response struct {
+	KeyID      string `json:"key_id,omitempty"`
+	Plaintext  []byte `json:"plaintext,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// NewServer starts a fake KMS, requests must carry token as a bearer token when it isn't empty
+// The server has to be closed with Close
+func NewServer(token string) *Server {
+	s := &Server{
+		token:    token,
+		keys:     make(map[string][]byte),
+		current:  make(map[string]string),
+		versions: make(map[string]int),
+		requests: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Rotate creates a new version of a key and returns its ID, data keys are wrapped with it from then on
+func (s *Server) Rotate(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rotate(name)
+}
+
+func (s *Server) rotate(name string) string {
+	kek, err := encryption.NewDataKey()
+	if err != nil {
+		panic(err)
+	}
+	s.versions[name]++
+	id := fmt.Sprintf("%s/v%d", name, s.versions[name])
+	s.keys[id] = kek
+	s.current[name] = id
+	return id
+}
+
+// RequestCount returns how many requests were served on a path, like /v1/unwrap
+func (s *Server) RequestCount(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// currentKey returns the current version of a key, creating the key on first use
+func (s *Server) currentKey(name string) (string, []byte) {
+	if name == "" {
+		name = DefaultKeyName
+	}
+	id, ok := s.current[name]
+	if !ok {
+		id = s.rotate(name)
+	}
+	return id, s.keys[id]
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" && r.Header.Get("Authorization") != "Bearer "+s.token {
+		writeJSON(w, http.StatusUnauthorized, response{Error: "invalid token"})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[r.URL.Path]++
+
+	var req request
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, response{Error: "invalid json"})
+			return
+		}
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/v1/current-key":
+		id, _ := s.currentKey(r.URL.Query().Get("key_id"))
+		writeJSON(w, http.StatusOK, response{KeyID: id})
+
+	case r.Method == "POST" && r.URL.Path == "/v1/generate-data-key":
+		if req.Size <= 0 || req.Size > 64 {
+			writeJSON(w, http.StatusBadRequest, response{Error: "invalid key size"})
+			return
+		}
+		dek, err := encryption.NewDataKey()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, response{Error: err.Error()})
+			return
+		}
+		dek = dek[:min(req.Size, len(dek))]
+		id, kek := s.currentKey(req.KeyID)
+		wrapped, err := encryption.Encrypt(dek, kek)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, response{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, response{KeyID: id, Plaintext: dek, Ciphertext: wrapped})
+
+	case r.Method == "POST" && r.URL.Path == "/v1/wrap":
+		id, kek := s.currentKey(req.KeyID)
+		wrapped, err := encryption.Encrypt(req.Plaintext, kek)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, response{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, response{KeyID: id, Ciphertext: wrapped})
+
+	case r.Method == "POST" && r.URL.Path == "/v1/unwrap":
+		// Unwrapping needs the exact key version, not just the key name
+		kek, ok := s.keys[req.KeyID]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, response{Error: fmt.Sprintf("unknown key %q", req.KeyID)})
+			return
+		}
+		dek, err := encryption.Decrypt(req.Ciphertext, kek)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, response{Error: "ciphertext does not unwrap under this key"})
+			return
+		}
+		writeJSON(w, http.StatusOK, response{Plaintext: dek})
+
+	default:
+		writeJSON(w, http.StatusNotFound, response{Error: "not found"})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, resp response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
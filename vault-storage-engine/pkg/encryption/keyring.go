@@ -0,0 +1,253 @@
+package encryption
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keyring holds every version of the key encryption key
+// The master key from the configuration is part of it as ConfigKeyID until it is retired,
+// rotated keys are kept in a keyring file, wrapped under the master key,
+// so data keys wrapped by older versions can still be unwrapped
+type Keyring struct {
+	path   string
+	master []byte
+	active string
+	keys   map[string][]byte
+	file   keyringFile
+}
+
+type keyringFile struct {
+	Active string `json:"active"`
+	// ConfigRetired is set once no data key is wrapped under the master key anymore
+	ConfigRetired bool            `json:"config_retired,omitempty"`
+	Keys          []keyringRecord `json:"keys"`
+}
+
+type keyringRecord struct {
+	ID string `json:"id"`
+	// Key is the plaintext key of keyrings written before keys were wrapped, it is replaced by Wrapped when the keyring is loaded
+	Key       string `json:"key,omitempty"`
+	Wrapped   string `json:"wrapped,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+// LoadKeyring loads the keyring file at path, a missing file is a keyring holding only the master key
+func LoadKeyring(path string, masterKey []byte) (*Keyring, error) {
+	if len(masterKey) == 0 {
+		return nil, fmt.Errorf("encryption key not found in configuration")
+	}
+	if !validKeySize(masterKey) {
+		return nil, fmt.Errorf("invalid master key size: %d bytes", len(masterKey))
+	}
+	k := &Keyring{
+		path:   path,
+		master: masterKey,
+		active: ConfigKeyID,
+		keys:   map[string][]byte{ConfigKeyID: masterKey},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring, %w", err)
+	}
+
+	if err := json.Unmarshal(data, &k.file); err != nil {
+		return nil, fmt.Errorf("failed to decode keyring, %w", err)
+	}
+	plaintext := false
+	for i, record := range k.file.Keys {
+		var key []byte
+		if record.Wrapped != "" {
+			wrapped, err := hex.DecodeString(record.Wrapped)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key %q in keyring", record.ID)
+			}
+			if key, err = Decrypt(wrapped, masterKey); err != nil {
+				return nil, fmt.Errorf("failed to unwrap key %q, the keyring was written with another master key", record.ID)
+			}
+		} else {
+			plaintext = true
+			if key, err = hex.DecodeString(record.Key); err != nil {
+				return nil, fmt.Errorf("invalid key %q in keyring", record.ID)
+			}
+			if k.file.Keys[i], err = k.record(record.ID, key, record.CreatedAt); err != nil {
+				return nil, err
+			}
+		}
+		if !validKeySize(key) {
+			return nil, fmt.Errorf("invalid key %q in keyring", record.ID)
+		}
+		k.keys[record.ID] = key
+	}
+	if k.file.ConfigRetired {
+		delete(k.keys, ConfigKeyID)
+	}
+	if k.file.Active != "" {
+		k.active = k.file.Active
+	}
+	if _, ok := k.keys[k.active]; !ok {
+		return nil, fmt.Errorf("active key %q is not in the keyring", k.active)
+	}
+
+	// Keyrings written before keys were wrapped are rewritten right away so no plaintext key stays on disk
+	if plaintext {
+		if err := saveKeyring(path, k.file); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// record returns the keyring record of a key version, with the key wrapped under the master key
+func (k *Keyring) record(id string, key []byte, createdAt string) (keyringRecord, error) {
+	wrapped, err := Encrypt(key, k.master)
+	if err != nil {
+		return keyringRecord{}, fmt.Errorf("failed to wrap key %q, %w", id, err)
+	}
+	return keyringRecord{ID: id, Wrapped: hex.EncodeToString(wrapped), CreatedAt: createdAt}, nil
+}
+
+// KeyIDs returns the ID of every key version in the keyring
+func (k *Keyring) KeyIDs() []string {
+	var ids []string
+	if _, ok := k.keys[ConfigKeyID]; ok {
+		ids = append(ids, ConfigKeyID)
+	}
+	for _, record := range k.file.Keys {
+		ids = append(ids, record.ID)
+	}
+	return ids
+}
+
+// Rotate adds a new random key version, makes it the active one and saves the keyring
+func (k *Keyring) Rotate() (string, error) {
+	key, err := NewDataKey()
+	if err != nil {
+		return "", err
+	}
+
+	// Key versions are numbered v1, v2, ... in the order they were created
+	next := 1
+	for _, record := range k.file.Keys {
+		if n, err := strconv.Atoi(strings.TrimPrefix(record.ID, "v")); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+	id := fmt.Sprintf("v%d", next)
+
+	record, err := k.record(id, key, time.Now().Format(time.RFC3339))
+	if err != nil {
+		return "", err
+	}
+	file := k.file
+	file.Active = id
+	file.Keys = append(append([]keyringRecord(nil), k.file.Keys...), record)
+	if err := saveKeyring(k.path, file); err != nil {
+		return "", err
+	}
+
+	k.file = file
+	k.keys[id] = key
+	k.active = id
+	return id, nil
+}
+
+// Retire removes a key version from the keyring, data keys still wrapped under it can't be unwrapped anymore
+// The master key stays in the configuration to wrap the other versions, it is only no longer used for data keys
+func (k *Keyring) Retire(keyID string) error {
+	if _, ok := k.keys[keyID]; !ok {
+		return fmt.Errorf("unknown key encryption key %q", keyID)
+	}
+	if keyID == k.active {
+		return fmt.Errorf("key %q is the active key, rotate the key before retiring it", keyID)
+	}
+
+	file := k.file
+	file.Active = k.active
+	file.Keys = nil
+	for _, record := range k.file.Keys {
+		if record.ID != keyID {
+			file.Keys = append(file.Keys, record)
+		}
+	}
+	if keyID == ConfigKeyID {
+		file.ConfigRetired = true
+	}
+	if err := saveKeyring(k.path, file); err != nil {
+		return err
+	}
+
+	k.file = file
+	delete(k.keys, keyID)
+	return nil
+}
+
+// saveKeyring replaces the keyring file, it is never left half written
+func saveKeyring(path string, file keyringFile) error {
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode keyring, %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create keyring directory, %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".keyring-*")
+	if err != nil {
+		return fmt.Errorf("failed to write keyring, %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write keyring, %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write keyring, %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write keyring, %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (k *Keyring) CurrentKeyID() (string, error) {
+	return k.active, nil
+}
+
+func (k *Keyring) GenerateDataKey() (*DataKey, error) {
+	return generateDataKey(k.Wrap)
+}
+
+func (k *Keyring) Wrap(dek []byte) (string, []byte, error) {
+	wrapped, err := Encrypt(dek, k.keys[k.active])
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to wrap data key, %w", err)
+	}
+	return k.active, wrapped, nil
+}
+
+func (k *Keyring) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	kek, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key encryption key %q", keyID)
+	}
+
+	dek, err := Decrypt(wrapped, kek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key, %w", err)
+	}
+	return dek, nil
+}
@@ -0,0 +1,138 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testMasterKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestKeyringStoresWrappedKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	master := testMasterKey(t)
+
+	k, err := LoadKeyring(path, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := k.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dek := testMasterKey(t)
+	keyID, wrapped, err := k.Wrap(dek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != id {
+		t.Fatalf("data key wrapped under %q, want %q", keyID, id)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), hex.EncodeToString(k.keys[id])) {
+		t.Fatal("keyring file holds the plaintext key")
+	}
+
+	reloaded, err := LoadKeyring(path, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := reloaded.Unwrap(keyID, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dek) {
+		t.Fatal("unwrapped data key differs")
+	}
+
+	if _, err := LoadKeyring(path, testMasterKey(t)); err == nil {
+		t.Fatal("keyring loaded with another master key")
+	}
+}
+
+func TestKeyringWrapsPlaintextKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	master := testMasterKey(t)
+	kek := testMasterKey(t)
+
+	legacy, err := json.Marshal(keyringFile{
+		Active: "v1",
+		Keys:   []keyringRecord{{ID: "v1", Key: hex.EncodeToString(kek), CreatedAt: "2024-01-01T00:00:00Z"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, legacy, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := LoadKeyring(path, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(k.keys["v1"], kek) {
+		t.Fatal("plaintext key not loaded")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), hex.EncodeToString(kek)) {
+		t.Fatal("plaintext key left in the keyring file")
+	}
+	if _, err := LoadKeyring(path, master); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyringRetire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	master := testMasterKey(t)
+
+	k, err := LoadKeyring(path, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Retire(ConfigKeyID); err == nil {
+		t.Fatal("active key retired")
+	}
+
+	if _, err := k.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{ConfigKeyID, "v1"} {
+		if err := k.Retire(id); err != nil {
+			t.Fatalf("retiring %s: %v", id, err)
+		}
+	}
+
+	reloaded, err := LoadKeyring(path, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := reloaded.KeyIDs(); len(ids) != 1 || ids[0] != "v2" {
+		t.Fatalf("key IDs after retiring = %v, want [v2]", ids)
+	}
+	if _, err := reloaded.Unwrap(ConfigKeyID, []byte("wrapped")); err == nil {
+		t.Fatal("retired master key still unwraps data keys")
+	}
+}
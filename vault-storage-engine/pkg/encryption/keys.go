@@ -0,0 +1,59 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// DataKeySize is the size of the data keys versions are encrypted with, AES-256
+const DataKeySize = 32
+
+// ConfigKeyID is the key ID of the master key taken from encryption_key in config.yaml
+const ConfigKeyID = "config"
+
+// DataKey is a data encryption key along with the same key wrapped by a key encryption key
+// Only the wrapped key is ever stored
+type DataKey struct {
+	Plaintext []byte
+	KeyID     string
+	Wrapped   []byte
+}
+
+// KeyProvider hands out data keys and wraps them with versioned key encryption keys
+type KeyProvider interface {
+	// GenerateDataKey returns a new random data key, wrapped under the current key encryption key
+	GenerateDataKey() (*DataKey, error)
+	// Wrap wraps a data key under the current key encryption key and returns that key's ID
+	Wrap(dek []byte) (string, []byte, error)
+	// Unwrap returns the plaintext of a data key wrapped under the key encryption key keyID
+	Unwrap(keyID string, wrapped []byte) ([]byte, error)
+	// CurrentKeyID returns the ID of the key encryption key new data keys are wrapped with
+	CurrentKeyID() (string, error)
+}
+
+// NewDataKey returns a random data key
+func NewDataKey() ([]byte, error) {
+	dek := make([]byte, DataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, fmt.Errorf("failed to generate data key, %w", err)
+	}
+	return dek, nil
+}
+
+// generateDataKey creates a data key and wraps it with wrap
+func generateDataKey(wrap func(dek []byte) (string, []byte, error)) (*DataKey, error) {
+	dek, err := NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+	keyID, wrapped, err := wrap(dek)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{Plaintext: dek, KeyID: keyID, Wrapped: wrapped}, nil
+}
+
+func validKeySize(key []byte) bool {
+	return len(key) == 16 || len(key) == 24 || len(key) == 32
+}
@@ -0,0 +1,142 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// KMSClient is a KeyProvider backed by a key management service reached over HTTP
+// Key encryption keys never leave the KMS, data keys are sent to it to be wrapped and unwrapped
+//
+// The KMS is expected to answer JSON requests on:
+//
+//	POST /v1/generate-data-key {"key_id", "size"} -> {"key_id", "plaintext", "ciphertext"}
+//	POST /v1/wrap              {"key_id", "plaintext"} -> {"key_id", "ciphertext"}
+//	POST /v1/unwrap            {"key_id", "ciphertext"} -> {"plaintext"}
+//	GET  /v1/current-key?key_id=... -> {"key_id"}
+//
+// Requests carry the key name configured in kms_key_id, responses carry the exact key version used.
+// Binary values are base64 encoded, failures are answered with a non 2xx status and {"error"}.
+type KMSClient struct {
+	baseURL string
+	token   string
+	keyID   string
+	client  *http.Client
+}
+
+type kmsRequest struct {
+	KeyID      string `json:"key_id,omitempty"`
+	Size       int    `json:"size,omitempty"`
+	Plaintext  []byte `json:"plaintext,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+}
+
+type kmsResponse struct {
+	KeyID      string `json:"key_id"`
+	Plaintext  []byte `json:"plaintext"`
+	Ciphertext []byte `json:"ciphertext"`
+	Error      string `json:"error"`
+}
+
+// NewKMSClient creates a client for the KMS at baseURL, token is sent as a bearer token when set
+func NewKMSClient(baseURL, token, keyID string) (*KMSClient, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("kms url not found in configuration")
+	}
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid kms url, %w", err)
+	}
+
+	return &KMSClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		keyID:   keyID,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+func (k *KMSClient) GenerateDataKey() (*DataKey, error) {
+	resp, err := k.do("POST", "/v1/generate-data-key", &kmsRequest{KeyID: k.keyID, Size: DataKeySize})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate data key, %w", err)
+	}
+	if len(resp.Plaintext) != DataKeySize || len(resp.Ciphertext) == 0 || resp.KeyID == "" {
+		return nil, fmt.Errorf("failed to generate data key, incomplete response from kms")
+	}
+	return &DataKey{Plaintext: resp.Plaintext, KeyID: resp.KeyID, Wrapped: resp.Ciphertext}, nil
+}
+
+func (k *KMSClient) Wrap(dek []byte) (string, []byte, error) {
+	resp, err := k.do("POST", "/v1/wrap", &kmsRequest{KeyID: k.keyID, Plaintext: dek})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to wrap data key, %w", err)
+	}
+	if len(resp.Ciphertext) == 0 || resp.KeyID == "" {
+		return "", nil, fmt.Errorf("failed to wrap data key, incomplete response from kms")
+	}
+	return resp.KeyID, resp.Ciphertext, nil
+}
+
+func (k *KMSClient) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	resp, err := k.do("POST", "/v1/unwrap", &kmsRequest{KeyID: keyID, Ciphertext: wrapped})
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key, %w", err)
+	}
+	// Every data key is generated with DataKeySize, anything else means the KMS unwrapped something that isn't one
+	if len(resp.Plaintext) != DataKeySize {
+		return nil, fmt.Errorf("failed to unwrap data key, kms returned a %d byte key", len(resp.Plaintext))
+	}
+	return resp.Plaintext, nil
+}
+
+func (k *KMSClient) CurrentKeyID() (string, error) {
+	resp, err := k.do("GET", "/v1/current-key?key_id="+url.QueryEscape(k.keyID), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to get current key, %w", err)
+	}
+	return resp.KeyID, nil
+}
+
+func (k *KMSClient) do(method, path string, body *kmsRequest) (*kmsResponse, error) {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, k.baseURL+path, &payload)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+
+	httpResp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	var resp kmsResponse
+	decodeErr := json.NewDecoder(httpResp.Body).Decode(&resp)
+	if httpResp.StatusCode < 200 || httpResp.StatusCode > 299 {
+		if resp.Error != "" {
+			return nil, fmt.Errorf("kms responded with %s: %s", httpResp.Status, resp.Error)
+		}
+		return nil, fmt.Errorf("kms responded with %s", httpResp.Status)
+	}
+	if decodeErr != nil {
+		return nil, fmt.Errorf("failed to decode kms response, %w", decodeErr)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,122 @@
+package encryption_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/encryption"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/encryption/fakekms"
+)
+
+func newKMSClient(t *testing.T, token string) (*fakekms.Server, *encryption.KMSClient) {
+	t.Helper()
+	server := fakekms.NewServer(token)
+	t.Cleanup(server.Close)
+
+	client, err := encryption.NewKMSClient(server.URL, token, "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+func TestKMSClientGenerateAndUnwrap(t *testing.T) {
+	_, client := newKMSClient(t, "secret")
+
+	dataKey, err := client.GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dataKey.Plaintext) != encryption.DataKeySize {
+		t.Fatalf("data key is %d bytes, want %d", len(dataKey.Plaintext), encryption.DataKeySize)
+	}
+
+	dek, err := client.Unwrap(dataKey.KeyID, dataKey.Wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dek, dataKey.Plaintext) {
+		t.Fatal("unwrapped data key differs")
+	}
+}
+
+func TestKMSClientRotation(t *testing.T) {
+	server, client := newKMSClient(t, "")
+
+	dek, err := encryption.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID, wrapped, err := client.Wrap(dek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newID := server.Rotate("vault")
+	current, err := client.CurrentKeyID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != newID || current == oldID {
+		t.Fatalf("current key is %q after rotating from %q to %q", current, oldID, newID)
+	}
+
+	// Data keys wrapped by the previous version still unwrap, new ones are wrapped by the current version
+	got, err := client.Unwrap(oldID, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dek) {
+		t.Fatal("unwrapped data key differs")
+	}
+	keyID, _, err := client.Wrap(dek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != newID {
+		t.Fatalf("data key wrapped under %q, want %q", keyID, newID)
+	}
+}
+
+func TestKMSClientErrors(t *testing.T) {
+	server, client := newKMSClient(t, "secret")
+
+	dek, err := encryption.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, wrapped, err := client.Wrap(dek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shortID, short, err := client.Wrap(dek[:16])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte(nil), wrapped...)
+	tampered[len(tampered)-1] ^= 1
+
+	unauthorized, err := encryption.NewKMSClient(server.URL, "wrong", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		client  *encryption.KMSClient
+		keyID   string
+		wrapped []byte
+	}{
+		{name: "unknown key version", client: client, keyID: "vault/v9", wrapped: wrapped},
+		{name: "tampered ciphertext", client: client, keyID: keyID, wrapped: tampered},
+		{name: "wrong token", client: unauthorized, keyID: keyID, wrapped: wrapped},
+		{name: "short data key", client: client, keyID: shortID, wrapped: short},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.client.Unwrap(tt.keyID, tt.wrapped); err == nil {
+				t.Fatal("Unwrap succeeded")
+			}
+		})
+	}
+}
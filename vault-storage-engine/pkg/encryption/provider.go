@@ -0,0 +1,72 @@
+package encryption
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Names of the built in key providers
+const (
+	LocalKeyProvider = "local"
+	KMSKeyProvider   = "kms"
+)
+
+// KeyProviderOptions configure a key provider, each provider only reads the options it needs
+type KeyProviderOptions struct {
+	// MasterKey and KeyringPath configure the local keyring
+	MasterKey   []byte
+	KeyringPath string
+	// URL, Token and KeyID configure a KMS reached over HTTP
+	URL   string
+	Token string
+	KeyID string
+}
+
+// KeyProviderFactory creates a key provider from its options
+type KeyProviderFactory func(opts KeyProviderOptions) (KeyProvider, error)
+
+// KeyRotator is implemented by key providers that can create a new key encryption key version themselves
+type KeyRotator interface {
+	Rotate() (string, error)
+}
+
+// KeyRetirer is implemented by key providers that can drop a key encryption key version no data key is wrapped under anymore
+type KeyRetirer interface {
+	Retire(keyID string) error
+}
+
+var (
+	providersMu sync.RWMutex
+	providers   = make(map[string]KeyProviderFactory)
+)
+
+func init() {
+	RegisterKeyProvider(LocalKeyProvider, func(opts KeyProviderOptions) (KeyProvider, error) {
+		return LoadKeyring(opts.KeyringPath, opts.MasterKey)
+	})
+	RegisterKeyProvider(KMSKeyProvider, func(opts KeyProviderOptions) (KeyProvider, error) {
+		return NewKMSClient(opts.URL, opts.Token, opts.KeyID)
+	})
+}
+
+// RegisterKeyProvider makes a key provider available under a name
+// Providers for other key management services are plugged in this way, without changing this package
+func RegisterKeyProvider(name string, factory KeyProviderFactory) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	if _, exists := providers[name]; exists {
+		panic(fmt.Sprintf("encryption: key provider %q registered twice", name))
+	}
+	providers[name] = factory
+}
+
+// NewKeyProvider creates the key provider registered under a name
+func NewKeyProvider(name string, opts KeyProviderOptions) (KeyProvider, error) {
+	providersMu.RLock()
+	factory, ok := providers[name]
+	providersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown key provider %q", name)
+	}
+	return factory(opts)
+}
@@ -0,0 +1,51 @@
+package encryption
+
+import (
+	"fmt"
+	"sync"
+)
+
+// AESGCMID is the codec ID of the AES-GCM encryptor
+const AESGCMID = "aes-gcm"
+
+var (
+	registryMu sync.RWMutex
+	encryptors = make(map[string]Encryptor)
+)
+
+func init() {
+	Register(AESGCMID, AESGCM{})
+}
+
+// Register makes an encryptor available under a codec ID
+// The ID is recorded with every version encrypted by it, so it must never be reused for another format
+func Register(id string, e Encryptor) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := encryptors[id]; exists {
+		panic(fmt.Sprintf("encryption: codec %q registered twice", id))
+	}
+	encryptors[id] = e
+}
+
+// Lookup returns the encryptor registered under a codec ID
+func Lookup(id string) (Encryptor, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	e, ok := encryptors[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption codec %q", id)
+	}
+	return e, nil
+}
+
+// AESGCM is the Encryptor for AES-GCM with a random nonce prepended to the ciphertext
+type AESGCM struct{}
+
+func (AESGCM) Encrypt(data, key, additionalData []byte) ([]byte, error) {
+	return EncryptWithAdditionalData(data, key, additionalData)
+}
+
+func (AESGCM) Decrypt(data, key, additionalData []byte) ([]byte, error) {
+	return DecryptWithAdditionalData(data, key, additionalData)
+}
@@ -2,8 +2,8 @@ package erasurecoding
 
 import (
 	"bytes"
-
-	"github.com/klauspost/reedsolomon"
+	"encoding/binary"
+	"errors"
 )
 
 type ErasureCode interface {
@@ -11,43 +11,50 @@ type ErasureCode interface {
 	Decode(shards [][]byte) ([]byte, error)
 }
 
+// SizedErasureCode is an erasure code that can check the length of the data against the one recorded
+// outside of the shards before decoding it
+type SizedErasureCode interface {
+	ErasureCode
+	DecodeSize(shards [][]byte, size int) ([]byte, error)
+}
+
+// DataShards and ParityShards make up the default profile of new buckets
+// Versions record the profile they were stored with, so changing these never affects stored data
 var (
 	DataShards   = 4
 	ParityShards = 2
 )
 
-// Encode splits and encodes the data into shards.
+// ShardHeaderSize is the size of the header at the start of every shard
+// The header holds a magic value and the length of the data before it was encoded,
+// so the padding added to the last data shard can be dropped exactly
+const ShardHeaderSize = 12
+
+var shardMagic = []byte("VEC\x01")
+
+// ErrMissingHeader is returned when shards were encoded without a header
+var ErrMissingHeader = errors.New("shard has no header")
+
+// Encode splits and encodes the data into shards with the default profile.
 func Encode(data []byte) ([][]byte, error) {
-	enc, err := reedsolomon.New(DataShards, ParityShards)
-	if err != nil {
-		return nil, err
-	}
-	shards, err := enc.Split(data)
-	if err != nil {
-		return nil, err
-	}
-	if err = enc.Encode(shards); err != nil {
-		return nil, err
-	}
-	return shards, nil
+	return DefaultProfile().Encode(data)
 }
 
-// Decode reconstructs the original data from shards.
+// Decode reconstructs the original data from shards encoded with the default profile.
 func Decode(shards [][]byte) ([]byte, error) {
-	enc, err := reedsolomon.New(DataShards, ParityShards)
-	if err != nil {
-		return nil, err
-	}
-	if err = enc.Reconstruct(shards); err != nil {
-		return nil, err
-	}
-	// Join shards back into a single byte slice.
-	var buf bytes.Buffer
-	if err = enc.Join(&buf, shards, len(shards[0])*DataShards); err != nil {
-		return nil, err
-	}
+	return DefaultProfile().Decode(shards)
+}
 
-	//return buf.Bytes(), nil
+// DecodeSize reconstructs the original data from shards encoded with the default profile
+// and checks it is exactly size bytes long.
+func DecodeSize(shards [][]byte, size int) ([]byte, error) {
+	return DefaultProfile().DecodeSize(shards, size)
+}
 
-	return bytes.Trim(buf.Bytes(), "\x00"), nil
+// ReadHeader returns the data length recorded in the header of a shard
+func ReadHeader(shard []byte) (int64, error) {
+	if len(shard) < ShardHeaderSize || !bytes.Equal(shard[:len(shardMagic)], shardMagic) {
+		return 0, ErrMissingHeader
+	}
+	return int64(binary.BigEndian.Uint64(shard[len(shardMagic):ShardHeaderSize])), nil
 }
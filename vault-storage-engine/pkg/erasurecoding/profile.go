@@ -0,0 +1,198 @@
+package erasurecoding
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Profile is the durability profile of a bucket, how many data and parity shards every stripe is split into
+// A version can be read back as long as any DataShards of its shards survive
+type Profile struct {
+	DataShards   int `json:"data_shards"`
+	ParityShards int `json:"parity_shards"`
+}
+
+// Common profiles, from cheap scratch data to archives and large media
+var (
+	ScratchProfile  = Profile{DataShards: 2, ParityShards: 1}
+	StandardProfile = Profile{DataShards: 4, ParityShards: 2}
+	ArchiveProfile  = Profile{DataShards: 6, ParityShards: 3}
+	MediaProfile    = Profile{DataShards: 10, ParityShards: 4}
+)
+
+// LegacyProfile is the profile every version was stored with before profiles were recorded
+// It must never change, old versions are decoded with it
+var LegacyProfile = Profile{DataShards: 4, ParityShards: 2}
+
+var namedProfiles = map[string]Profile{
+	"scratch":  ScratchProfile,
+	"standard": StandardProfile,
+	"archive":  ArchiveProfile,
+	"media":    MediaProfile,
+}
+
+// DefaultProfile returns the profile of buckets created without one
+func DefaultProfile() Profile {
+	return Profile{DataShards: DataShards, ParityShards: ParityShards}
+}
+
+// ParseProfile reads a profile given by name (scratch, standard, archive, media) or as "<data>+<parity>"
+// An empty string selects the default profile
+func ParseProfile(s string) (Profile, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if s == "" {
+		return DefaultProfile(), nil
+	}
+	if p, ok := namedProfiles[s]; ok {
+		return p, nil
+	}
+
+	data, parity, ok := strings.Cut(s, "+")
+	if !ok {
+		return Profile{}, fmt.Errorf("invalid erasure profile %q, expected a name or <data>+<parity>", s)
+	}
+	var p Profile
+	var err error
+	if p.DataShards, err = strconv.Atoi(data); err != nil {
+		return Profile{}, fmt.Errorf("invalid erasure profile %q: %w", s, err)
+	}
+	if p.ParityShards, err = strconv.Atoi(parity); err != nil {
+		return Profile{}, fmt.Errorf("invalid erasure profile %q: %w", s, err)
+	}
+	return p, p.Validate()
+}
+
+// Validate checks the profile can be used to encode data
+func (p Profile) Validate() error {
+	if p.DataShards < 1 || p.ParityShards < 1 {
+		return fmt.Errorf("invalid erasure profile %s: at least one data and one parity shard are needed", p)
+	}
+	if p.Total() > 256 {
+		return fmt.Errorf("invalid erasure profile %s: at most 256 shards are supported", p)
+	}
+	return nil
+}
+
+// Total returns the number of shards of the profile
+func (p Profile) Total() int {
+	return p.DataShards + p.ParityShards
+}
+
+func (p Profile) String() string {
+	return fmt.Sprintf("%d+%d", p.DataShards, p.ParityShards)
+}
+
+// Encode splits and encodes the data into shards.
+// Every shard starts with a header recording len(data).
+func (p Profile) Encode(data []byte) ([][]byte, error) {
+	enc, err := reedsolomon.New(p.DataShards, p.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	// Split needs at least one byte, an empty input is encoded as padding only
+	padded := data
+	if len(padded) == 0 {
+		padded = make([]byte, 1)
+	}
+	shards, err := enc.Split(padded)
+	if err != nil {
+		return nil, err
+	}
+	if err = enc.Encode(shards); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, ShardHeaderSize)
+	copy(header, shardMagic)
+	binary.BigEndian.PutUint64(header[len(shardMagic):], uint64(len(data)))
+	for i, shard := range shards {
+		shards[i] = append(append(make([]byte, 0, ShardHeaderSize+len(shard)), header...), shard...)
+	}
+	return shards, nil
+}
+
+// Decode reconstructs the original data from shards.
+// Missing shards are expected to be nil, the length of the data is taken from the shard headers.
+func (p Profile) Decode(shards [][]byte) ([]byte, error) {
+	return p.decode(shards, -1)
+}
+
+// DecodeSize reconstructs the original data from shards and checks it is exactly size bytes long.
+// It is used when the length of the encoded data is also recorded outside of the shards.
+func (p Profile) DecodeSize(shards [][]byte, size int) ([]byte, error) {
+	return p.decode(shards, int64(size))
+}
+
+// decode reconstructs the data, expected is the length recorded outside of the shards or -1
+// The headers aren't authenticated, so the length they record is checked before anything is allocated for it
+func (p Profile) decode(shards [][]byte, expected int64) ([]byte, error) {
+	size := int64(-1)
+	shardSize := -1
+	payloads := make([][]byte, len(shards))
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		length, err := ReadHeader(shard)
+		if err != nil {
+			return nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+		if size >= 0 && length != size {
+			return nil, fmt.Errorf("shard %d records a length of %d bytes, other shards record %d", i, length, size)
+		}
+		if shardSize >= 0 && len(shard)-ShardHeaderSize != shardSize {
+			return nil, fmt.Errorf("shard %d is %d bytes, other shards are %d", i, len(shard)-ShardHeaderSize, shardSize)
+		}
+		size = length
+		shardSize = len(shard) - ShardHeaderSize
+		payloads[i] = shard[ShardHeaderSize:]
+	}
+	if shardSize < 0 {
+		return nil, errors.New("no shards to decode")
+	}
+	if size < 0 || size > int64(shardSize)*int64(p.DataShards) {
+		return nil, fmt.Errorf("shard headers record a length of %d bytes, the shards hold at most %d", size, int64(shardSize)*int64(p.DataShards))
+	}
+	if expected >= 0 && size != expected {
+		return nil, fmt.Errorf("shard headers record a length of %d bytes, expected %d", size, expected)
+	}
+
+	enc, err := reedsolomon.New(p.DataShards, p.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	if err = enc.Reconstruct(payloads); err != nil {
+		return nil, err
+	}
+	// Join shards back into a single byte slice.
+	var buf bytes.Buffer
+	buf.Grow(int(size))
+	if err = enc.Join(&buf, payloads, int(size)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodePadded reconstructs data from shards encoded before shards had a header
+// Those shards don't record the data length, so the data is returned with its zero padding
+func (p Profile) DecodePadded(shards [][]byte) ([]byte, error) {
+	enc, err := reedsolomon.New(p.DataShards, p.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	if err = enc.Reconstruct(shards); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = enc.Join(&buf, shards, len(shards[0])*p.DataShards); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,85 @@
+package erasurecoding
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestDecodeKeepsTrailingZeros(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"single zero", []byte{0}},
+		{"only zeros", make([]byte, 1000)},
+		{"ends with zeros", append([]byte("payload"), make([]byte, 13)...)},
+		{"ends with one zero", []byte("payload\x00")},
+		{"exact multiple of the data shards", append(bytes.Repeat([]byte{1}, 12), 0, 0, 0, 0)},
+	}
+	profiles := []Profile{ScratchProfile, StandardProfile, ArchiveProfile, MediaProfile}
+
+	for _, profile := range profiles {
+		for _, tt := range tests {
+			t.Run(profile.String()+"/"+tt.name, func(t *testing.T) {
+				shards, err := profile.Encode(tt.data)
+				if err != nil {
+					t.Fatalf("Encode: %v", err)
+				}
+				// Drop as many shards as the profile tolerates
+				for i := 0; i < profile.ParityShards; i++ {
+					shards[i] = nil
+				}
+
+				got, err := profile.DecodeSize(shards, len(tt.data))
+				if err != nil {
+					t.Fatalf("DecodeSize: %v", err)
+				}
+				if !bytes.Equal(got, tt.data) {
+					t.Fatalf("decoded %x, want %x", got, tt.data)
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeRejectsInvalidHeaderLength(t *testing.T) {
+	profile := StandardProfile
+	data := []byte("some data that is long enough to fill every shard")
+
+	tests := []struct {
+		name   string
+		length func(capacity uint64) uint64
+	}{
+		{"negative", func(uint64) uint64 { return 1 << 63 }},
+		{"huge", func(uint64) uint64 { return 1 << 40 }},
+		{"one byte more than the shards hold", func(capacity uint64) uint64 { return capacity + 1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shards, err := profile.Encode(data)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			capacity := uint64(len(shards[0])-ShardHeaderSize) * uint64(profile.DataShards)
+			for _, shard := range shards {
+				binary.BigEndian.PutUint64(shard[len(shardMagic):], tt.length(capacity))
+			}
+
+			if _, err := profile.Decode(shards); err == nil {
+				t.Fatal("Decode accepted an invalid length")
+			}
+		})
+	}
+}
+
+func TestDecodeSizeRejectsMismatchedLength(t *testing.T) {
+	shards, err := StandardProfile.Encode([]byte("hello world"))
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if _, err := StandardProfile.DecodeSize(shards, 10); err == nil {
+		t.Fatal("DecodeSize accepted a length that doesn't match the headers")
+	}
+}
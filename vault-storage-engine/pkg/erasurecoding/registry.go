@@ -0,0 +1,48 @@
+package erasurecoding
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ReedSolomonID is the codec ID of Reed-Solomon coding with shard headers
+const ReedSolomonID = "reed-solomon"
+
+// Constructor creates an ErasureCode splitting data according to a profile
+type Constructor func(profile Profile) (ErasureCode, error)
+
+var (
+	registryMu sync.RWMutex
+	codes      = make(map[string]Constructor)
+)
+
+func init() {
+	Register(ReedSolomonID, func(profile Profile) (ErasureCode, error) {
+		if err := profile.Validate(); err != nil {
+			return nil, err
+		}
+		return profile, nil
+	})
+}
+
+// Register makes an erasure code available under a codec ID
+// The ID is recorded with every version encoded by it, so it must never be reused for another format
+func Register(id string, constructor Constructor) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := codes[id]; exists {
+		panic(fmt.Sprintf("erasurecoding: codec %q registered twice", id))
+	}
+	codes[id] = constructor
+}
+
+// New returns the erasure code registered under a codec ID for a profile
+func New(id string, profile Profile) (ErasureCode, error) {
+	registryMu.RLock()
+	constructor, ok := codes[id]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown erasure codec %q", id)
+	}
+	return constructor(profile)
+}
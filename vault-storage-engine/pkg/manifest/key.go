@@ -0,0 +1,66 @@
+package manifest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadOrCreateKey loads the node key kept at path, a new key is generated and saved there the first time
+// The file holds the hex encoded seed of the key and is only readable by its owner
+func LoadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	key, err := LoadKey(path)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return key, err
+	}
+
+	_, key, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate node key: %w", err)
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create node key directory: %w", err)
+		}
+	}
+	// O_EXCL keeps a key written concurrently by another process, that one is loaded instead
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return LoadKey(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to save node key: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(hex.EncodeToString(key.Seed()) + "\n"); err != nil {
+		return nil, fmt.Errorf("failed to save node key: %w", err)
+	}
+	return key, f.Sync()
+}
+
+// LoadKey loads the node key kept at path
+func LoadKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid node key in %s", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ParsePublicKey decodes a hex public key, as printed for a node key
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	pub, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key %q", s)
+	}
+	return pub, nil
+}
@@ -0,0 +1,141 @@
+// Package manifest describes stored versions well enough to find their data again without the metadata database
+// Every version, and the chunks every version of a deduplicated bucket stores, get a manifest signed with the Ed25519 key
+// of the node that stored them. A copy of the manifest is kept next to each shard, under ShardIndex
+package manifest
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+)
+
+// ShardIndex is the shard index manifests are stored under, no erasure profile has that many shards
+const ShardIndex = 1 << 16
+
+// FormatVersion is the version of the manifest format written by this package
+const FormatVersion = 1
+
+// Kinds of manifests
+const (
+	KindVersion = "version"
+	KindChunk   = "chunk"
+	// KindChunkSet records every chunk a version stored, chunks of older versions have a KindChunk manifest each
+	KindChunkSet = "chunk_set"
+)
+
+// Manifest describes a version of an object or a chunk shared by the versions of a deduplicated bucket
+type Manifest struct {
+	Format    int    `json:"format"`
+	Kind      string `json:"kind"`
+	BucketID  string `json:"bucket_id"`
+	ObjectID  string `json:"object_id"`  // the chunk ID for chunks, the set ID for chunk sets
+	VersionID string `json:"version_id"` // bucket.ChunkVersionID for chunks, bucket.ChunkSetVersionID for chunk sets
+	CreatedAt string `json:"created_at"`
+
+	// Set for versions. The metadata holds the filename, size, codec chain, erasure profile, wrapped data key,
+	// Merkle root and shard placement of the version, and the chunks it is made of for deduplicated buckets
+	RootVersion string                  `json:"root_version,omitempty"`
+	BucketOwner string                  `json:"bucket_owner,omitempty"` // owner of the bucket when the version was stored
+	Version     *bucket.VersionMetadata `json:"version,omitempty"`
+
+	// Set for chunks
+	Chunk *ChunkManifest `json:"chunk,omitempty"`
+
+	// Set for chunk sets
+	Chunks []ChunkManifest `json:"chunks,omitempty"`
+}
+
+// ChunkManifest describes a chunk, versions refer to it by its hash
+type ChunkManifest struct {
+	Hash     string               `json:"hash"`
+	Size     int64                `json:"size"`
+	Metadata bucket.ChunkMetadata `json:"metadata"`
+}
+
+// Signed is a manifest as it is stored, the exact bytes that were signed are kept so they verify as they are
+type Signed struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	KeyID     string          `json:"key_id"`
+	PublicKey string          `json:"public_key"` // hex
+	Signature string          `json:"signature"`  // hex
+}
+
+// ErrInvalidSignature is returned for manifests whose signature doesn't verify
+var ErrInvalidSignature = errors.New("manifest signature is invalid")
+
+// KeyID identifies a node key by the first bytes of the SHA-256 of its public key
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Sign encodes and signs a manifest
+func Sign(m *Manifest, key ed25519.PrivateKey) ([]byte, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	return json.Marshal(Signed{
+		Manifest:  body,
+		KeyID:     KeyID(pub),
+		PublicKey: hex.EncodeToString(pub),
+		Signature: hex.EncodeToString(ed25519.Sign(key, body)),
+	})
+}
+
+// Parse decodes a stored manifest without checking its signature
+func Parse(data []byte) (*Signed, error) {
+	var s Signed
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if len(s.Manifest) == 0 || s.Signature == "" {
+		return nil, errors.New("not a signed manifest")
+	}
+	return &s, nil
+}
+
+// Verify checks the signature of the manifest and decodes it
+// When trusted is set the manifest has to be signed by one of those keys, otherwise the key it carries is used,
+// which only proves the manifest wasn't changed since it was signed
+func (s *Signed) Verify(trusted ...ed25519.PublicKey) (*Manifest, error) {
+	pub, err := hex.DecodeString(s.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("manifest carries an invalid public key")
+	}
+	sig, err := hex.DecodeString(s.Signature)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	if len(trusted) > 0 {
+		known := false
+		for _, key := range trusted {
+			if key.Equal(ed25519.PublicKey(pub)) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("manifest is signed by key %s, which isn't trusted", KeyID(pub))
+		}
+	}
+	if !ed25519.Verify(pub, s.Manifest, sig) {
+		return nil, ErrInvalidSignature
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(s.Manifest, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if m.Format != FormatVersion {
+		return nil, fmt.Errorf("unsupported manifest format %d", m.Format)
+	}
+	return &m, nil
+}
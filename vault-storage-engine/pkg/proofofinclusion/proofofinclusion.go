@@ -1,53 +1,153 @@
+// Package proofofinclusion builds Merkle trees over the shards of a version and proves that a shard belongs to it
+// The leaves are the SHA-256 hashes of the shards in shard order. Leaves and inner nodes are hashed with different
+// prefixes, so a leaf can never pass for an inner node, and a node without a sibling is carried up a level unchanged
 package proofofinclusion
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"strings"
+)
 
-	"github.com/cbergoon/merkletree"
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
 )
 
-// Content represents the content stored in the Merkle tree
-type Content struct {
-	X string
+// ErrEmptyTree is returned when a tree is built without any shard
+var ErrEmptyTree = errors.New("a Merkle tree needs at least one shard")
+
+// Tree is a Merkle tree over the hashes of the shards of a version
+type Tree struct {
+	// levels[0] holds the leaves, the last level holds the root
+	levels [][][]byte
+}
+
+// ProofStep is one sibling on the path from a shard to the root
+type ProofStep struct {
+	Hash []byte
+	// Left is set when the sibling is the left child, the node being proven is then the right one
+	Left bool
 }
 
-// CalculateHash hashes the values of a Content
-func (c Content) CalculateHash() ([]byte, error) {
+// Proof is the path of siblings from a shard up to the root, leaf level first
+// A tree over a single shard has an empty proof
+type Proof []ProofStep
+
+func hashLeaf(shardHash []byte) []byte {
 	h := sha256.New()
-	if _, err := h.Write([]byte(c.X)); err != nil {
-		return nil, fmt.Errorf("failed to hash content: %w", err)
+	h.Write([]byte{leafPrefix})
+	h.Write(shardHash)
+	return h.Sum(nil)
+}
+
+func hashNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// BuildMerkleTree builds a Merkle tree over the SHA-256 hashes of the shards of a version, in shard order
+func BuildMerkleTree(shardHashes [][]byte) (*Tree, error) {
+	if len(shardHashes) == 0 {
+		return nil, ErrEmptyTree
+	}
+
+	level := make([][]byte, len(shardHashes))
+	for i, shardHash := range shardHashes {
+		level[i] = hashLeaf(shardHash)
+	}
+	tree := &Tree{levels: [][][]byte{level}}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, hashNode(level[i], level[i+1]))
+		}
+		tree.levels = append(tree.levels, next)
+		level = next
 	}
-	return h.Sum(nil), nil
+	return tree, nil
 }
 
-// Equals tests for equality of two Contents
-func (c Content) Equals(other merkletree.Content) (bool, error) {
-	return c.X == other.(Content).X, nil
+// Root returns the root of the tree
+func (t *Tree) Root() []byte {
+	return t.levels[len(t.levels)-1][0]
 }
 
-// BuildMerkleTree builds a Merkle tree from the given shards
-func BuildMerkleTree(shards [][]byte) (*merkletree.MerkleTree, error) {
-	var list []merkletree.Content
-	for _, shard := range shards {
-		list = append(list, Content{X: hex.EncodeToString(shard)})
+// GetProof returns the proof of inclusion of shard shardIdx
+func (t *Tree) GetProof(shardIdx int) (Proof, error) {
+	if shardIdx < 0 || shardIdx >= len(t.levels[0]) {
+		return nil, fmt.Errorf("shard %d is not in the tree, it has %d shards", shardIdx, len(t.levels[0]))
 	}
 
-	tree, err := merkletree.NewTree(list)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create Merkle tree: %w", err)
+	proof := Proof{}
+	idx := shardIdx
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := idx ^ 1
+		if sibling < len(level) {
+			proof = append(proof, ProofStep{Hash: level[sibling], Left: sibling < idx})
+		}
+		idx /= 2
 	}
+	return proof, nil
+}
 
-	return tree, nil
+// VerifyProof checks that a shard with the given SHA-256 hash is included in the tree with the given root
+func VerifyProof(root, shardHash []byte, proof Proof) bool {
+	node := hashLeaf(shardHash)
+	for _, step := range proof {
+		if step.Left {
+			node = hashNode(step.Hash, node)
+		} else {
+			node = hashNode(node, step.Hash)
+		}
+	}
+	return bytes.Equal(node, root)
 }
 
-// GetProof generates a proof of inclusion for a given shard
-func GetProof(tree *merkletree.MerkleTree, shard []byte) (string, error) {
-	proof, _, err := tree.GetMerklePath(Content{X: hex.EncodeToString(shard)})
-	if err != nil {
-		return "", fmt.Errorf("failed to get Merkle proof: %w", err)
+// String encodes a proof as comma separated steps, each the side of the sibling, L or R, and its hex hash
+func (p Proof) String() string {
+	steps := make([]string, len(p))
+	for i, step := range p {
+		side := "R"
+		if step.Left {
+			side = "L"
+		}
+		steps[i] = side + ":" + hex.EncodeToString(step.Hash)
 	}
+	return strings.Join(steps, ",")
+}
+
+// ParseProof decodes a proof encoded by Proof.String
+func ParseProof(s string) (Proof, error) {
+	proof := Proof{}
+	if s == "" {
+		return proof, nil
+	}
+	for _, encoded := range strings.Split(s, ",") {
+		side, hash, ok := strings.Cut(encoded, ":")
+		if !ok || (side != "L" && side != "R") {
+			return nil, fmt.Errorf("invalid proof step %q", encoded)
+		}
+		sibling, err := hex.DecodeString(hash)
+		if err != nil || len(sibling) != sha256.Size {
+			return nil, fmt.Errorf("invalid proof step %q", encoded)
+		}
+		proof = append(proof, ProofStep{Hash: sibling, Left: side == "L"})
+	}
+	return proof, nil
+}
 
-	return hex.EncodeToString(proof[len(proof)-1]), nil // Corrected to retrieve the last element in the proof path
+// ProofKey is the key the proof of shard shardIdx is recorded under, the same as its shard location
+func ProofKey(shardIdx int) string {
+	return fmt.Sprintf("shard_%d", shardIdx)
 }
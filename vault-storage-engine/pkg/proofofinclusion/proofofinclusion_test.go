@@ -0,0 +1,133 @@
+package proofofinclusion
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func shardHashes(n int) [][]byte {
+	hashes := make([][]byte, n)
+	for i := range hashes {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("shard %d", i)))
+		hashes[i] = sum[:]
+	}
+	return hashes
+}
+
+// cloneProof copies a proof along with the hashes of its steps, so they can be tampered with
+func cloneProof(proof Proof) Proof {
+	clone := make(Proof, len(proof))
+	for i, step := range proof {
+		clone[i] = ProofStep{Hash: bytes.Clone(step.Hash), Left: step.Left}
+	}
+	return clone
+}
+
+func TestProofs(t *testing.T) {
+	for _, leaves := range []int{1, 2, 3, 6, 14} {
+		hashes := shardHashes(leaves)
+		tree, err := BuildMerkleTree(hashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root := tree.Root()
+
+		for idx := range hashes {
+			t.Run(fmt.Sprintf("%d leaves/shard %d", leaves, idx), func(t *testing.T) {
+				proof, err := tree.GetProof(idx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !VerifyProof(root, hashes[idx], proof) {
+					t.Fatal("proof of an included shard doesn't verify")
+				}
+
+				parsed, err := ParseProof(proof.String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if parsed.String() != proof.String() || !VerifyProof(root, hashes[idx], parsed) {
+					t.Fatalf("proof %q changed in a String and ParseProof round trip", proof)
+				}
+
+				other := hashes[(idx+1)%leaves]
+				if leaves == 1 {
+					other = shardHashes(2)[1]
+				}
+				wrongRoot := bytes.Clone(root)
+				wrongRoot[0] ^= 0xff
+				type failure struct {
+					name  string
+					root  []byte
+					shard []byte
+					proof Proof
+				}
+				failures := []failure{
+					{name: "wrong root", root: wrongRoot, shard: hashes[idx], proof: proof},
+					{name: "wrong shard", root: root, shard: other, proof: proof},
+				}
+				// A tree over a single shard has no steps to tamper with
+				if len(proof) > 0 {
+					tampered := cloneProof(proof)
+					tampered[0].Hash[0] ^= 0xff
+					flipped := cloneProof(proof)
+					flipped[len(flipped)-1].Left = !flipped[len(flipped)-1].Left
+					failures = append(failures,
+						failure{name: "tampered sibling", root: root, shard: hashes[idx], proof: tampered},
+						failure{name: "flipped side", root: root, shard: hashes[idx], proof: flipped},
+						failure{name: "truncated", root: root, shard: hashes[idx], proof: proof[:len(proof)-1]},
+					)
+				}
+				for _, f := range failures {
+					if VerifyProof(f.root, f.shard, f.proof) {
+						t.Errorf("%s: proof verifies", f.name)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestParseProofRejectsInvalidSteps(t *testing.T) {
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte("sibling")))
+	tests := []struct {
+		name  string
+		proof string
+	}{
+		{name: "no side", proof: hash},
+		{name: "unknown side", proof: "X:" + hash},
+		{name: "not hex", proof: "L:" + hash[:62] + "zz"},
+		{name: "short hash", proof: "R:" + hash[:62]},
+		{name: "empty step", proof: "L:" + hash + ","},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseProof(tt.proof); err == nil {
+				t.Fatalf("ParseProof accepted %q", tt.proof)
+			}
+		})
+	}
+
+	proof, err := ParseProof("")
+	if err != nil || len(proof) != 0 {
+		t.Fatalf("ParseProof of an empty proof returned %v, %v", proof, err)
+	}
+}
+
+func TestBuildMerkleTreeBounds(t *testing.T) {
+	if _, err := BuildMerkleTree(nil); !errors.Is(err, ErrEmptyTree) {
+		t.Fatalf("BuildMerkleTree without shards returned %v, want ErrEmptyTree", err)
+	}
+	tree, err := BuildMerkleTree(shardHashes(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, idx := range []int{-1, 3} {
+		if _, err := tree.GetProof(idx); err == nil {
+			t.Fatalf("GetProof(%d) succeeded on a tree over 3 shards", idx)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Package proofofstorage lets a storage node prove it still holds a shard without sending it back
+// A challenge is a random nonce and byte ranges of the shard, the node answers with H(nonce || shard[range]...).
+// The answers are only known to whoever saw the shard, so challenges are prepared while the shard is written:
+// a Sampler keeps random blocks of the shard as it streams past and turns them into single use challenges
+package proofofstorage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	mathrand "math/rand"
+	"sort"
+)
+
+const (
+	// BlockSize is the length of the ranges challenges are made of, the last block of a shard can be shorter
+	BlockSize = 1024
+	// ChallengesPerShard is how many challenges are prepared for a shard by default
+	ChallengesPerShard = 16
+	// RangesPerChallenge is how many ranges of the shard a single challenge covers
+	RangesPerChallenge = 4
+	// NonceSize is the length of the nonce of a challenge
+	NonceSize = 16
+
+	// MaxRanges and MaxRangeLength bound what a node agrees to hash for a single challenge
+	MaxRanges      = 64
+	MaxRangeLength = 1 << 20
+)
+
+// Range is a byte range of a shard
+type Range struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// Challenge is what a storage node is asked to answer
+type Challenge struct {
+	Nonce  string  `json:"nonce"` // hex
+	Ranges []Range `json:"ranges"`
+}
+
+// Response is the answer of a storage node to a challenge
+type Response struct {
+	Proof string `json:"proof"` // hex H(nonce || shard[range]...)
+}
+
+// Prepared is a challenge together with the answer expected from a node holding the shard
+type Prepared struct {
+	Challenge
+	Expected string // hex
+}
+
+// Validate checks a challenge received by a node before any shard is read
+func (c Challenge) Validate() error {
+	if _, err := hex.DecodeString(c.Nonce); err != nil || c.Nonce == "" {
+		return errors.New("challenge needs a hex nonce")
+	}
+	if len(c.Ranges) == 0 || len(c.Ranges) > MaxRanges {
+		return fmt.Errorf("challenge needs between 1 and %d ranges", MaxRanges)
+	}
+	for _, r := range c.Ranges {
+		if r.Offset < 0 || r.Length <= 0 || r.Length > MaxRangeLength {
+			return fmt.Errorf("invalid range %d+%d", r.Offset, r.Length)
+		}
+	}
+	return nil
+}
+
+// NewHash returns the hash answers are computed with, already fed the nonce
+// The ranges are written to it in the order of the challenge
+func NewHash(nonce []byte) hash.Hash {
+	h := sha256.New()
+	h.Write(nonce)
+	return h
+}
+
+// block is a block of the shard kept by a Sampler
+type block struct {
+	offset int64
+	data   []byte
+}
+
+// Sampler prepares challenges for a shard from the data written to it
+// It keeps challenges*RangesPerChallenge blocks picked uniformly over the whole shard with reservoir sampling,
+// so the length of the shard doesn't need to be known up front and only the kept blocks are held in memory
+type Sampler struct {
+	challenges int
+	rng        *mathrand.Rand
+	offset     int64 // bytes written so far
+	current    []byte
+	seen       int // full blocks offered to the reservoir
+	kept       []block
+}
+
+// NewSampler returns a sampler preparing up to challenges challenges for a shard about to be written
+func NewSampler(challenges int) *Sampler {
+	return &Sampler{
+		challenges: challenges,
+		rng:        mathrand.New(mathrand.NewSource(seed())),
+		current:    make([]byte, 0, BlockSize),
+	}
+}
+
+func seed() int64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+// Write never fails, it only looks at the data
+func (s *Sampler) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := min(BlockSize-len(s.current), len(p))
+		s.current = append(s.current, p[:take]...)
+		p = p[take:]
+		if len(s.current) == BlockSize {
+			s.offer()
+		}
+	}
+	return n, nil
+}
+
+// offer hands the current block to the reservoir, it is kept with probability size/seen
+func (s *Sampler) offer() {
+	size := s.challenges * RangesPerChallenge
+	b := block{offset: s.offset, data: s.current}
+	s.offset += int64(len(s.current))
+	s.seen++
+
+	switch {
+	case len(s.kept) < size:
+		s.kept = append(s.kept, b)
+		s.current = make([]byte, 0, BlockSize)
+	default:
+		if j := s.rng.Intn(s.seen); j < size {
+			// The evicted block is reused for the next one
+			evicted := s.kept[j].data
+			s.kept[j] = b
+			s.current = evicted[:0]
+		} else {
+			s.current = s.current[:0]
+		}
+	}
+}
+
+// Challenges prepares the challenges of the shard once all of it was written, none for an empty shard
+// Shards with fewer blocks than needed get fewer challenges, every one covers at least one block
+func (s *Sampler) Challenges() ([]Prepared, error) {
+	if len(s.current) > 0 {
+		s.offer()
+	}
+	if len(s.kept) == 0 {
+		return nil, nil
+	}
+
+	s.rng.Shuffle(len(s.kept), func(i, j int) { s.kept[i], s.kept[j] = s.kept[j], s.kept[i] })
+	count := min(s.challenges, len(s.kept))
+	challenges := make([]Prepared, 0, count)
+	for i := 0; i < count; i++ {
+		var blocks []block
+		for j := i; j < len(s.kept); j += count {
+			blocks = append(blocks, s.kept[j])
+		}
+		sort.Slice(blocks, func(a, b int) bool { return blocks[a].offset < blocks[b].offset })
+
+		nonce := make([]byte, NonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, fmt.Errorf("failed to generate challenge nonce: %w", err)
+		}
+		h := NewHash(nonce)
+		ranges := make([]Range, len(blocks))
+		for j, b := range blocks {
+			h.Write(b.data)
+			ranges[j] = Range{Offset: b.offset, Length: int64(len(b.data))}
+		}
+		challenges = append(challenges, Prepared{
+			Challenge: Challenge{Nonce: hex.EncodeToString(nonce), Ranges: ranges},
+			Expected:  hex.EncodeToString(h.Sum(nil)),
+		})
+	}
+	return challenges, nil
+}
@@ -0,0 +1,238 @@
+// Package fakes3 is an in-process S3-compatible server covering what sharding.S3ShardStore uses
+// It checks SigV4 signatures and payload hashes, keeps objects in memory and is meant for tests and local development only
+package fakes3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding/sigv4"
+)
+
+// maxKeys is the most keys returned by a single listing, kept small so continuation tokens get exercised
+const maxKeys = 100
+
+// Server is a fake S3 endpoint listening on a local address
+// Buckets are addressed path-style, or virtual-hosted style through the Host header
+type Server struct {
+	*httptest.Server
+	accessKey string
+	secretKey string
+
+	mu       sync.Mutex
+	buckets  map[string]map[string]object
+	requests map[string]int
+}
+
+type object struct {
+	data     []byte
+	modified time.Time
+}
+
+// NewServer starts a fake S3 endpoint accepting requests signed with the given credentials
+// The server has to be closed with Close
+func NewServer(accessKey, secretKey string) *Server {
+	s := &Server{
+		accessKey: accessKey,
+		secretKey: secretKey,
+		buckets:   make(map[string]map[string]object),
+		requests:  make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// CreateBucket creates an empty bucket, requests to buckets that weren't created fail with NoSuchBucket
+func (s *Server) CreateBucket(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[name]; !ok {
+		s.buckets[name] = make(map[string]object)
+	}
+}
+
+// Keys returns the keys stored in a bucket, sorted
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Object returns a copy of a stored object
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.buckets[bucket][key]
+	return bytes.Clone(obj.data), ok
+}
+
+// RequestCount returns how many requests were served with a method, like GET
+func (s *Server) RequestCount(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method]
+}
+
+type errorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(errorResponse{Code: code, Message: message})
+}
+
+// route splits a request into its bucket and key
+func route(r *http.Request) (string, string) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	host, _, _ := strings.Cut(r.Host, ":")
+	// Virtual-hosted style requests name the bucket in the first label of the host
+	if bucket, _, ok := strings.Cut(host, "."); ok && !isIP(host) {
+		return bucket, path
+	}
+	bucket, key, _ := strings.Cut(path, "/")
+	return bucket, key
+}
+
+func isIP(host string) bool {
+	return strings.Trim(host, "0123456789.") == "" || strings.Contains(host, ":")
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.Method]++
+	s.mu.Unlock()
+
+	if _, err := sigv4.Verify(r, func(accessKey string) (string, bool) {
+		return s.secretKey, accessKey == s.accessKey
+	}); err != nil {
+		code := "AccessDenied"
+		if err == sigv4.ErrSignatureMismatch {
+			code = "SignatureDoesNotMatch"
+		}
+		writeError(w, http.StatusForbidden, code, err.Error())
+		return
+	}
+
+	bucket, key := route(r)
+	s.mu.Lock()
+	objects, ok := s.buckets[bucket]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, r, objects)
+	case key == "":
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "Unsupported bucket operation")
+	case r.Method == http.MethodPut:
+		s.put(w, r, objects, key)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.mu.Lock()
+		obj, ok := objects[key]
+		s.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", obj.modified, bytes.NewReader(obj.data))
+	case r.Method == http.MethodDelete:
+		s.mu.Lock()
+		delete(objects, key)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "Unsupported object operation")
+	}
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, objects map[string]object, key string) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if hash := r.Header.Get("X-Amz-Content-Sha256"); hash != sigv4.UnsignedPayload && hash != sigv4.HashPayload(data) {
+		writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided content hash does not match the body")
+		return
+	}
+
+	s.mu.Lock()
+	objects[key] = object{data: data, modified: time.Now()}
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Prefix                string   `xml:"Prefix"`
+	KeyCount              int      `xml:"KeyCount"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken,omitempty"`
+	Contents              []listEntry
+}
+
+type listEntry struct {
+	XMLName      xml.Name `xml:"Contents"`
+	Key          string   `xml:"Key"`
+	Size         int      `xml:"Size"`
+	LastModified string   `xml:"LastModified"`
+}
+
+// list answers ListObjectsV2, the continuation token is the last key of the previous page
+func (s *Server) list(w http.ResponseWriter, r *http.Request, objects map[string]object) {
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "Only ListObjectsV2 is supported")
+		return
+	}
+	prefix := query.Get("prefix")
+	after := query.Get("continuation-token")
+	limit := maxKeys
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n > 0 && n < limit {
+		limit = n
+	}
+
+	s.mu.Lock()
+	var keys []string
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	result := listBucketResult{Prefix: prefix}
+	if len(keys) > limit {
+		keys = keys[:limit]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[limit-1]
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, listEntry{Key: key, Size: len(objects[key].data), LastModified: objects[key].modified.UTC().Format(time.RFC3339)})
+	}
+	s.mu.Unlock()
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
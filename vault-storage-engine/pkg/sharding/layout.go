@@ -0,0 +1,152 @@
+package sharding
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LocalShardStore fans shards out over hash-prefixed directories, one directory per object and version:
+//
+//	<location>/ab/cd/<objectID>/<versionID>/<shardIdx>
+//
+// where abcd are the first hex digits of the SHA-256 of the object ID. Listing, stating or deleting
+// the shards of an object only touches the directory of that object, however many shards a node holds.
+// Stores created before the fan-out kept every shard of a location in one flat directory,
+// MigrateFlatLayout moves those into place.
+
+// objectDir returns the directory holding every version of an object
+func (store *LocalShardStore) objectDir(objectID, location string) string {
+	sum := sha256.Sum256([]byte(objectID))
+	prefix := hex.EncodeToString(sum[:2])
+	return filepath.Join(store.BasePath, location, prefix[:2], prefix[2:], objectID)
+}
+
+// flatShardPath returns where a shard was kept before the fan-out layout
+func (store *LocalShardStore) flatShardPath(objectID, versionID string, shardIdx int, location string) string {
+	return filepath.Join(store.BasePath, location, shardName(objectID, versionID, shardIdx))
+}
+
+// parseShardPath is the reverse of shardPath, for a path relative to a location
+func parseShardPath(rel string) (objectID, versionID string, shardIdx int, ok bool) {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) != 5 || strings.HasPrefix(parts[4], ".") {
+		return "", "", 0, false
+	}
+	shardIdx, err := strconv.Atoi(parts[4])
+	if err != nil || shardIdx < 0 {
+		return "", "", 0, false
+	}
+	return parts[2], parts[3], shardIdx, true
+}
+
+// removeEmptyDirs removes dir and its parents up to, but not including, stop, as long as they are empty
+func removeEmptyDirs(dir, stop string) {
+	for dir != stop && strings.HasPrefix(dir, stop) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// MigrationResult counts the shards handled by MigrateFlatLayout
+type MigrationResult struct {
+	Migrated int
+	// Conflicts lists flat shards left in place because a shard was already stored at their new path
+	Conflicts []string
+}
+
+// MigrateFlatLayout moves the shards of every location under basePath from the flat layout,
+// <location>/<objectID>-v(<versionID>)_shard_<n>, to the fan-out layout
+// Shards written before shard files had a header are given one first, the fan-out layout only holds files with a header.
+// It is meant to be run offline, while no node is using basePath. Shards are rewritten and renamed atomically,
+// so an interrupted migration can simply be run again
+func MigrateFlatLayout(basePath string) (MigrationResult, error) {
+	var result MigrationResult
+	store := NewLocalShardStore(basePath)
+
+	locations, err := os.ReadDir(basePath)
+	if err != nil {
+		return result, fmt.Errorf("failed to read shard store directory: %w", err)
+	}
+	for _, location := range locations {
+		if !location.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(basePath, location.Name()))
+		if err != nil {
+			return result, fmt.Errorf("failed to read shard directory: %w", err)
+		}
+
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			objectID, versionID, shardIdx, ok := parseShardName(entry.Name())
+			if !ok {
+				continue
+			}
+			from := store.flatShardPath(objectID, versionID, shardIdx, location.Name())
+			to := store.shardPath(objectID, versionID, shardIdx, location.Name())
+
+			if _, err := os.Stat(to); err == nil {
+				result.Conflicts = append(result.Conflicts, from)
+				continue
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return result, err
+			}
+			if err := addShardHeader(from, objectID, versionID, shardIdx); err != nil {
+				return result, fmt.Errorf("failed to add a header to shard %s: %w", from, err)
+			}
+			if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+				return result, fmt.Errorf("failed to create directory for shard: %w", err)
+			}
+			if err := os.Rename(from, to); err != nil {
+				return result, fmt.Errorf("failed to move shard %s: %w", from, err)
+			}
+			if err := syncDir(filepath.Dir(to)); err != nil {
+				return result, err
+			}
+			result.Migrated++
+		}
+		if err := syncDir(filepath.Join(basePath, location.Name())); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// addShardHeader rewrites a flat shard written before shard files had a header as a shard file with a header
+// Files that already have a header, valid or not, are left as they are
+func addShardHeader(path, objectID, versionID string, shardIdx int) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := readShardHeader(file, path); err != errNoShardHeader {
+		return nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// The writer replaces the file by renaming its temporary file over it
+	w, err := newLocalShardWriter(path, objectID, versionID, shardIdx)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, file); err != nil {
+		w.abort()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,151 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// localShardStoreV2 adapts a LocalShardStore to ShardStoreV2
+type localShardStoreV2 struct {
+	store *LocalShardStore
+}
+
+// NewLocalShardStoreV2 returns the ShardStoreV2 view of a LocalShardStore, both share the same files
+func NewLocalShardStoreV2(store *LocalShardStore) ShardStoreV2 {
+	return &localShardStoreV2{store: store}
+}
+
+func (s *localShardStoreV2) PutShard(ctx context.Context, key ShardKey, r io.Reader, size int64) error {
+	w, err := newLocalShardWriter(s.store.shardPath(key.ObjectID, key.VersionID, key.Index, key.Location), key.ObjectID, key.VersionID, key.Index)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(w, &contextReader{ctx, r})
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("%w: got %d bytes, expected %d", errSizeMismatch, n, size)
+	}
+	if err != nil {
+		// Nothing was renamed into place yet, dropping the temporary file is enough
+		w.abort()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write shard to file: %w", err)
+	}
+	return nil
+}
+
+func (s *localShardStoreV2) GetShard(ctx context.Context, key ShardKey) (io.ReadCloser, error) {
+	sf, err := openShardFile(s.store.shardPath(key.ObjectID, key.VersionID, key.Index, key.Location), key.ObjectID, key.VersionID, key.Index)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return withContext(ctx, struct {
+		io.Reader
+		io.Closer
+	}{sf.payload(), sf.File}), nil
+}
+
+func (s *localShardStoreV2) GetShardRange(ctx context.Context, key ShardKey, offset, length int64) (io.ReadCloser, error) {
+	rc, err := s.store.OpenShardReader(key.ObjectID, key.VersionID, key.Index, key.Location, offset, length)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return withContext(ctx, rc), nil
+}
+
+func (s *localShardStoreV2) StatShard(ctx context.Context, key ShardKey) (ShardInfo, error) {
+	return s.stat(key)
+}
+
+// stat reports the payload size of a shard, without its header
+func (s *localShardStoreV2) stat(key ShardKey) (ShardInfo, error) {
+	sf, err := openShardFile(s.store.shardPath(key.ObjectID, key.VersionID, key.Index, key.Location), key.ObjectID, key.VersionID, key.Index)
+	if err != nil {
+		return ShardInfo{}, notFound(err)
+	}
+	defer sf.Close()
+
+	fi, err := sf.Stat()
+	if err != nil {
+		return ShardInfo{}, err
+	}
+	return ShardInfo{Key: key, Size: sf.length, ModTime: fi.ModTime()}, nil
+}
+
+func (s *localShardStoreV2) ListShards(ctx context.Context, location, objectID string) ([]ShardInfo, error) {
+	// Listing the shards of one object only walks the directory of that object
+	locationDir := filepath.Join(s.store.BasePath, location)
+	root := locationDir
+	if objectID != "" {
+		root = s.store.objectDir(objectID, location)
+	}
+
+	var shards []ShardInfo
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// Nothing is stored, or the directory was deleted while listing
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(locationDir, path)
+		if err != nil {
+			return err
+		}
+		// Temporary files of shards being written start with a dot and don't parse
+		object, version, idx, ok := parseShardPath(rel)
+		if !ok {
+			return nil
+		}
+
+		key := ShardKey{Location: location, ObjectID: object, VersionID: version, Index: idx}
+		info, err := s.stat(key)
+		if IsCorruptShard(err) {
+			// Corrupt shards are still listed, with the size of their file, so they can be found and repaired
+			fi, statErr := entry.Info()
+			if statErr != nil {
+				return nil
+			}
+			info, err = ShardInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+		}
+		if errors.Is(err, ErrShardNotFound) {
+			// The shard was deleted while listing
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		shards = append(shards, info)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list shards: %w", err)
+	}
+	return shards, nil
+}
+
+func (s *localShardStoreV2) DeleteShard(ctx context.Context, key ShardKey) error {
+	return s.store.DeleteShardByVersion(key.ObjectID, key.VersionID, key.Index, key.Location)
+}
+
+// notFound maps a missing file to ErrShardNotFound
+func notFound(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrShardNotFound
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding/sigv4"
+)
+
+// s3ShardStoreV2 adapts an S3ShardStore to ShardStoreV2
+type s3ShardStoreV2 struct {
+	store *S3ShardStore
+}
+
+// NewS3ShardStoreV2 returns the ShardStoreV2 view of an S3ShardStore, both share the same objects
+func NewS3ShardStoreV2(store *S3ShardStore) ShardStoreV2 {
+	return &s3ShardStoreV2{store: store}
+}
+
+func (s *s3ShardStoreV2) key(key ShardKey) string {
+	return s.store.shardKey(key.ObjectID, key.VersionID, key.Index, key.Location)
+}
+
+func (s *s3ShardStoreV2) PutShard(ctx context.Context, key ShardKey, r io.Reader, size int64) error {
+	if size >= 0 {
+		// With a known size the body is streamed straight through, unsigned as its hash isn't known up front
+		counted := &countingReader{r: r}
+		if err := s.store.putKey(ctx, s.key(key), counted, size, sigv4.UnsignedPayload); err != nil {
+			// The store may have taken the object before the upload failed on our side
+			s.store.deleteKey(context.Background(), s.key(key))
+			return err
+		}
+		// Only size bytes are sent, a longer body is only noticed by reading past them
+		if extra, _ := io.ReadFull(r, make([]byte, 1)); counted.n != size || extra > 0 {
+			s.store.deleteKey(context.Background(), s.key(key))
+			return fmt.Errorf("%w: expected %d bytes", errSizeMismatch, size)
+		}
+		return nil
+	}
+
+	w, err := s.store.openSpool(ctx, s.key(key))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, &contextReader{ctx, r}); err != nil {
+		w.discard()
+		return err
+	}
+	return w.Close()
+}
+
+func (s *s3ShardStoreV2) GetShard(ctx context.Context, key ShardKey) (io.ReadCloser, error) {
+	return s.store.getKey(ctx, s.key(key))
+}
+
+func (s *s3ShardStoreV2) GetShardRange(ctx context.Context, key ShardKey, offset, length int64) (io.ReadCloser, error) {
+	return s.store.getRange(ctx, s.key(key), offset, length)
+}
+
+func (s *s3ShardStoreV2) StatShard(ctx context.Context, key ShardKey) (ShardInfo, error) {
+	size, modTime, err := s.store.headKey(ctx, s.key(key))
+	if err != nil {
+		return ShardInfo{}, err
+	}
+	return ShardInfo{Key: key, Size: size, ModTime: modTime}, nil
+}
+
+func (s *s3ShardStoreV2) ListShards(ctx context.Context, location, objectID string) ([]ShardInfo, error) {
+	dir := s.store.config.Prefix + location + "/"
+	prefix := dir
+	if objectID != "" {
+		prefix += objectID + "-v("
+	}
+	objects, err := s.store.listKeys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var shards []ShardInfo
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, dir)
+		// Keys further down belong to another location
+		if strings.Contains(name, "/") {
+			continue
+		}
+		objID, version, idx, ok := parseShardName(name)
+		if !ok || (objectID != "" && objID != objectID) {
+			continue
+		}
+		shards = append(shards, ShardInfo{
+			Key:     ShardKey{Location: location, ObjectID: objID, VersionID: version, Index: idx},
+			Size:    object.Size,
+			ModTime: object.LastModified,
+		})
+	}
+	return shards, nil
+}
+
+func (s *s3ShardStoreV2) DeleteShard(ctx context.Context, key ShardKey) error {
+	return s.store.deleteKey(ctx, s.key(key))
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
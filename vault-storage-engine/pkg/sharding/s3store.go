@@ -1,37 +1,386 @@
 package sharding
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
 	"fmt"
-	// Uncomment and import AWS SDK packages if you intend to implement S3 integration.
-	// "github.com/aws/aws-sdk-go/aws"
-	// "github.com/aws/aws-sdk-go/aws/session"
-	// "github.com/aws/aws-sdk-go/service/s3"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding/sigv4"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/utils"
 )
 
-// S3ShardStore is a skeleton for an S3-based shard store.
+// DefaultS3Region is the region requests are signed for when none is configured
+const DefaultS3Region = "us-east-1"
+
+// S3Config is how an S3ShardStore reaches its bucket
+type S3Config struct {
+	// Endpoint is the base URL of the S3-compatible API, like https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// SessionToken is only set for temporary credentials
+	SessionToken string
+	// PathStyle addresses the bucket as <endpoint>/<bucket>/<key> instead of <bucket>.<endpoint>/<key>,
+	// most self-hosted S3-compatible stores need it
+	PathStyle bool
+	// Prefix is prepended to the key of every shard, so several clusters can share a bucket
+	Prefix string
+}
+
+// S3ShardStore stores shards as objects of an S3-compatible bucket
+// Shards are kept under <prefix><location>/<objectID>-v(<versionID>)_shard_<n>, the same layout as LocalShardStore
 type S3ShardStore struct {
-	// client *s3.S3
-	Bucket   string
-	Endpoint string
+	config S3Config
+	base   *url.URL
+	client *http.Client
 }
 
-func NewS3ShardStore(bucket, endpoint string) *S3ShardStore {
-	// Initialize AWS session and S3 client here.
+// NewS3ShardStore creates a shard store on the bucket described by cfg
+func NewS3ShardStore(cfg S3Config) (*S3ShardStore, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3: no bucket configured")
+	}
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("s3: no endpoint configured")
+	}
+	base, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Region == "" {
+		cfg.Region = DefaultS3Region
+	}
+
 	return &S3ShardStore{
-		Bucket:   bucket,
-		Endpoint: endpoint,
+		config: cfg,
+		base:   base,
+		// Shards are streamed, so only the wait for a response is bounded
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				ResponseHeaderTimeout: 30 * time.Second,
+			},
+		},
+	}, nil
+}
+
+// shardKey returns the object key of a shard
+func (s *S3ShardStore) shardKey(objectID, versionID string, shardIdx int, location string) string {
+	return s.config.Prefix + location + "/" + shardName(objectID, versionID, shardIdx)
+}
+
+// objectURL returns the URL of an object of the bucket, or of the bucket itself for an empty key
+func (s *S3ShardStore) objectURL(key string, query url.Values) *url.URL {
+	u := *s.base
+	path := strings.TrimSuffix(u.Path, "/")
+	if s.config.PathStyle {
+		path += "/" + s.config.Bucket
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+	path += "/" + key
+
+	u.Path = path
+	// Keys are escaped the way they are signed, which is stricter than what net/url does
+	u.RawPath = sigv4.URIEncode(path, false)
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// do signs and sends a request, body is sent with its length and its hash
+func (s *S3ShardStore) do(ctx context.Context, method, key string, query url.Values, body io.Reader, length int64, payloadHash string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key, query).String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("s3: failed to create request: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = length
+	}
+
+	creds := sigv4.Credentials{AccessKey: s.config.AccessKey, SecretKey: s.config.SecretKey, SessionToken: s.config.SessionToken}
+	sigv4.Sign(req, creds, s.config.Region, "s3", payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3: %s %s failed: %w", method, key, err)
+	}
+	return resp, nil
+}
+
+// s3Error is the error document S3 answers failed requests with
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// responseError turns a failed response into an error and closes it
+// A missing object wraps os.ErrNotExist, like a missing shard of LocalShardStore
+func responseError(resp *http.Response, key string) error {
+	defer resp.Body.Close()
+	var doc s3Error
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(body, &doc)
+
+	if resp.StatusCode == http.StatusNotFound && doc.Code != "NoSuchBucket" {
+		return fmt.Errorf("s3: %s: %w", key, ErrShardNotFound)
+	}
+	if doc.Code != "" {
+		return fmt.Errorf("s3: %s: %s: %s", key, doc.Code, doc.Message)
 	}
+	return fmt.Errorf("s3: %s: responded with %s", key, resp.Status)
 }
 
-func (s *S3ShardStore) StoreShard(dataID string, index int, shard []byte) error {
-	// Implement S3 PutObject logic here.
-	fmt.Printf("S3: Stored shard %d for DataID: %s in bucket %s\n", index, dataID, s.Bucket)
+// StoreShard uploads a shard
+func (s *S3ShardStore) StoreShard(objectID, versionID string, shardIdx int, shard []byte, location string) error {
+	key := s.shardKey(objectID, versionID, shardIdx, location)
+	return s.putKey(context.Background(), key, bytes.NewReader(shard), int64(len(shard)), sigv4.HashPayload(shard))
+}
+
+// putKey uploads an object of size bytes, payloadHash is the hex SHA-256 of body or sigv4.UnsignedPayload
+func (s *S3ShardStore) putKey(ctx context.Context, key string, body io.Reader, size int64, payloadHash string) error {
+	resp, err := s.do(ctx, http.MethodPut, key, nil, body, size, payloadHash, http.Header{
+		"Content-Type": {"application/octet-stream"},
+	})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp, key)
+	}
+	resp.Body.Close()
 	return nil
 }
 
-func (s *S3ShardStore) RetrieveShard(dataID string, index int) ([]byte, error) {
-	// Implement S3 GetObject logic here.
-	fmt.Printf("S3: Retrieved shard %d for DataID: %s from bucket %s\n", index, dataID, s.Bucket)
-	// Return a dummy value for demonstration.
-	return []byte("dummy"), nil
+// OpenShardWriter returns a writer for a shard, the shard is uploaded when the writer is closed
+// S3 needs the length of an object up front, so the shard is spooled to a temporary file meanwhile
+func (s *S3ShardStore) OpenShardWriter(objectID, versionID string, shardIdx int, location string) (io.WriteCloser, error) {
+	return s.openSpool(context.Background(), s.shardKey(objectID, versionID, shardIdx, location))
+}
+
+func (s *S3ShardStore) openSpool(ctx context.Context, key string) (*s3ShardWriter, error) {
+	spool, err := os.CreateTemp("", "vault-s3-shard-*")
+	if err != nil {
+		return nil, fmt.Errorf("s3: failed to create spool file: %w", err)
+	}
+	return &s3ShardWriter{
+		ctx:   ctx,
+		store: s,
+		key:   key,
+		spool: spool,
+		hash:  sha256.New(),
+	}, nil
+}
+
+type s3ShardWriter struct {
+	ctx    context.Context
+	store  *S3ShardStore
+	key    string
+	spool  *os.File
+	hash   hash.Hash
+	size   int64
+	closed bool
+}
+
+func (w *s3ShardWriter) Write(p []byte) (int, error) {
+	n, err := w.spool.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *s3ShardWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.discard()
+
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("s3: failed to rewind spool file: %w", err)
+	}
+	return w.store.putKey(w.ctx, w.key, w.spool, w.size, hex.EncodeToString(w.hash.Sum(nil)))
+}
+
+// discard drops the spool file without uploading it
+func (w *s3ShardWriter) discard() {
+	w.closed = true
+	w.spool.Close()
+	os.Remove(w.spool.Name())
+}
+
+// RetrieveShard downloads a shard
+func (s *S3ShardStore) RetrieveShard(objectID, versionID string, shardIdx int, location string) ([]byte, error) {
+	key := s.shardKey(objectID, versionID, shardIdx, location)
+	body, err := s.getKey(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	shard, err := utils.ReadAllWithBuffer(body)
+	if err != nil {
+		return nil, fmt.Errorf("s3: failed to read shard %s: %w", key, err)
+	}
+	return shard, nil
+}
+
+// getKey opens an object for reading
+func (s *S3ShardStore) getKey(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, 0, sigv4.EmptyPayload, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, key)
+	}
+	return resp.Body, nil
+}
+
+// OpenShardReader opens length bytes of a shard starting at offset with a ranged GET
+func (s *S3ShardStore) OpenShardReader(objectID, versionID string, shardIdx int, location string, offset, length int64) (io.ReadCloser, error) {
+	return s.getRange(context.Background(), s.shardKey(objectID, versionID, shardIdx, location), offset, length)
+}
+
+func (s *S3ShardStore) getRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	if length <= 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, 0, sigv4.EmptyPayload, http.Header{
+		"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK && offset == 0:
+		// The store ignored the range and sent the whole shard
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(resp.Body, length), resp.Body}, nil
+	case resp.StatusCode == http.StatusOK:
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3: %s: range request was ignored", key)
+	}
+	return nil, responseError(resp, key)
+}
+
+// headKey returns the size and the modification time of an object
+func (s *S3ShardStore) headKey(ctx context.Context, key string) (int64, time.Time, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, 0, sigv4.EmptyPayload, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, time.Time{}, responseError(resp, key)
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.ContentLength, modTime, nil
+}
+
+// DeleteShardByVersion deletes the shard of one version of an object
+func (s *S3ShardStore) DeleteShardByVersion(objectID, versionID string, shardIdx int, location string) error {
+	if location == "" {
+		return fmt.Errorf("invalid storage location")
+	}
+	return s.deleteKey(context.Background(), s.shardKey(objectID, versionID, shardIdx, location))
+}
+
+// DeleteShard deletes shard shardIdx of every version of an object
+func (s *S3ShardStore) DeleteShard(objectID string, shardIdx int, location string) error {
+	if location == "" {
+		return fmt.Errorf("invalid storage location")
+	}
+
+	ctx := context.Background()
+	objects, err := s.listKeys(ctx, fmt.Sprintf("%s%s/%s-v(", s.config.Prefix, location, objectID))
+	if err != nil {
+		return err
+	}
+	suffix := ")_shard_" + strconv.Itoa(shardIdx)
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, suffix) {
+			continue
+		}
+		if err := s.deleteKey(ctx, object.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteKey deletes an object, deleting an object that doesn't exist succeeds
+func (s *S3ShardStore) deleteKey(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, 0, sigv4.EmptyPayload, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return responseError(resp, key)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type listEntry struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type listBucketResult struct {
+	Contents              []listEntry `xml:"Contents"`
+	IsTruncated           bool        `xml:"IsTruncated"`
+	NextContinuationToken string      `xml:"NextContinuationToken"`
+}
+
+// listKeys lists every object whose key starts with prefix, following continuation tokens
+func (s *S3ShardStore) listKeys(ctx context.Context, prefix string) ([]listEntry, error) {
+	var objects []listEntry
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, 0, sigv4.EmptyPayload, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, responseError(resp, prefix)
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: failed to decode listing of %s: %w", prefix, err)
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
 }
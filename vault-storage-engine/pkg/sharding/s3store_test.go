@@ -0,0 +1,213 @@
+package sharding
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding/fakes3"
+)
+
+func newTestS3Store(t *testing.T) (*fakes3.Server, *S3ShardStore) {
+	t.Helper()
+	server := fakes3.NewServer("access", "secret")
+	t.Cleanup(server.Close)
+	server.CreateBucket("shards")
+
+	store, err := NewS3ShardStore(S3Config{
+		Endpoint:  server.URL,
+		Bucket:    "shards",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PathStyle: true,
+		Prefix:    "cluster/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, store
+}
+
+func TestS3ShardStoreRoundTrip(t *testing.T) {
+	server, store := newTestS3Store(t)
+	shard := bytes.Repeat([]byte("shard "), 1000)
+
+	if err := store.StoreShard("obj", "ver", 3, shard, "node1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.Object("shards", "cluster/node1/obj-v(ver)_shard_3"); !ok {
+		t.Fatalf("shard not stored under the expected key, bucket holds %v", server.Keys("shards"))
+	}
+	got, err := store.RetrieveShard("obj", "ver", 3, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, shard) {
+		t.Fatal("retrieved shard differs")
+	}
+
+	if err := store.DeleteShardByVersion("obj", "ver", 3, "node1"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := server.Keys("shards"); len(keys) != 0 {
+		t.Fatalf("bucket holds %v after deleting the shard", keys)
+	}
+}
+
+func TestS3ShardStoreRanges(t *testing.T) {
+	_, store := newTestS3Store(t)
+	shard := make([]byte, 10000)
+	for i := range shard {
+		shard[i] = byte(i)
+	}
+	if err := store.StoreShard("obj", "ver", 0, shard, "node1"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		offset, length int64
+	}{
+		{name: "whole shard", offset: 0, length: int64(len(shard))},
+		{name: "start", offset: 0, length: 100},
+		{name: "middle", offset: 4321, length: 1234},
+		{name: "end", offset: int64(len(shard)) - 7, length: 7},
+		{name: "single byte", offset: 5000, length: 1},
+		{name: "empty", offset: 100, length: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc, err := store.OpenShardReader("obj", "ver", 0, "node1", tt.offset, tt.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, shard[tt.offset:tt.offset+tt.length]) {
+				t.Fatalf("read %d bytes at %d differing from the shard", len(got), tt.offset)
+			}
+		})
+	}
+}
+
+func TestS3ShardStoreMissingShards(t *testing.T) {
+	server, store := newTestS3Store(t)
+	v2 := NewS3ShardStoreV2(store)
+	ctx := context.Background()
+	key := ShardKey{Location: "node1", ObjectID: "obj", VersionID: "ver", Index: 1}
+
+	lookups := []struct {
+		name string
+		get  func() error
+	}{
+		{name: "RetrieveShard", get: func() error {
+			_, err := store.RetrieveShard("obj", "ver", 1, "node1")
+			return err
+		}},
+		{name: "OpenShardReader", get: func() error {
+			_, err := store.OpenShardReader("obj", "ver", 1, "node1", 10, 20)
+			return err
+		}},
+		{name: "GetShard", get: func() error {
+			_, err := v2.GetShard(ctx, key)
+			return err
+		}},
+		{name: "StatShard", get: func() error {
+			_, err := v2.StatShard(ctx, key)
+			return err
+		}},
+	}
+	for _, tt := range lookups {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.get()
+			if !errors.Is(err, ErrShardNotFound) || !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("returned %v, want ErrShardNotFound", err)
+			}
+		})
+	}
+
+	// Deleting a shard that isn't stored succeeds
+	if err := store.DeleteShardByVersion("obj", "ver", 1, "node1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A missing bucket is a misconfiguration, not a missing shard
+	missingBucket, err := NewS3ShardStore(S3Config{Endpoint: server.URL, Bucket: "absent", AccessKey: "access", SecretKey: "secret", PathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := missingBucket.RetrieveShard("obj", "ver", 1, "node1"); err == nil || errors.Is(err, ErrShardNotFound) {
+		t.Fatalf("RetrieveShard from a missing bucket returned %v", err)
+	}
+}
+
+func TestS3ShardStoreListsEveryPage(t *testing.T) {
+	server, store := newTestS3Store(t)
+	v2 := NewS3ShardStoreV2(store)
+	ctx := context.Background()
+
+	// More shards than fit in one page of the fake server
+	const versions = 250
+	for v := 0; v < versions; v++ {
+		for idx := 0; idx < 2; idx++ {
+			if err := store.StoreShard("obj", fmt.Sprintf("v%03d", v), idx, []byte("shard"), "node1"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := store.StoreShard("other", "v000", 0, []byte("shard"), "node1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.StoreShard("obj", "v000", 0, []byte("shard"), "node2"); err != nil {
+		t.Fatal(err)
+	}
+
+	gets := server.RequestCount("GET")
+	shards, err := v2.ListShards(ctx, "node1", "obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shards) != 2*versions {
+		t.Fatalf("listed %d shards, want %d", len(shards), 2*versions)
+	}
+	if pages := server.RequestCount("GET") - gets; pages < 2 {
+		t.Fatalf("listing took %d pages", pages)
+	}
+	for _, shard := range shards {
+		if shard.Key.Location != "node1" || shard.Key.ObjectID != "obj" || shard.Size != int64(len("shard")) {
+			t.Fatalf("listed %+v", shard)
+		}
+	}
+
+	all, err := v2.ListShards(ctx, "node1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2*versions+1 {
+		t.Fatalf("listed %d shards of the location, want %d", len(all), 2*versions+1)
+	}
+
+	// Deleting a shard index of every version has to reach the versions past the first page
+	if err := store.DeleteShard("obj", 1, "node1"); err != nil {
+		t.Fatal(err)
+	}
+	shards, err = v2.ListShards(ctx, "node1", "obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shards) != versions {
+		t.Fatalf("%d shards left after deleting shard 1 of every version, want %d", len(shards), versions)
+	}
+	for _, shard := range shards {
+		if shard.Key.Index != 0 {
+			t.Fatalf("shard %+v left behind", shard)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package sharding
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Shard files written by LocalShardStore start with a header naming the shard and checksumming its payload
+//
+//	magic "VSHD" | format version (1 byte) | object ID length (uint16) | object ID | version ID length (uint16) | version ID
+//	| shard index (uint32) | payload length (uint64) | block size (uint32) | checksum (uint32) | header CRC32C (uint32)
+//
+// The payload is followed by the CRC32C of every block of the payload, so any range can be checked on its own,
+// and the checksum in the header is the CRC32C of that table.
+// Files written before headers were introduced hold the bare payload, MigrateFlatLayout gives them a header
+// as it moves them into the fan-out layout, so a file without a header is corrupt
+const (
+	shardFileMagic   = "VSHD"
+	shardFileVersion = 1
+	// shardBlockSize is how many payload bytes each checksum covers
+	shardBlockSize = 64 << 10
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptShardError is returned when a shard file fails its header or checksum checks
+type CorruptShardError struct {
+	Path   string
+	Reason string
+}
+
+func (e *CorruptShardError) Error() string {
+	return fmt.Sprintf("corrupt shard %s: %s", e.Path, e.Reason)
+}
+
+// IsCorruptShard reports whether err is, or wraps, a CorruptShardError
+func IsCorruptShard(err error) bool {
+	var corrupt *CorruptShardError
+	return errors.As(err, &corrupt)
+}
+
+type shardHeader struct {
+	Version   byte
+	ObjectID  string
+	VersionID string
+	Index     int
+	Length    uint64
+	BlockSize uint32
+	Checksum  uint32
+}
+
+// size is the length of the encoded header
+func (h shardHeader) size() int64 {
+	return int64(len(shardFileMagic) + 1 + 2 + len(h.ObjectID) + 2 + len(h.VersionID) + 4 + 8 + 4 + 4 + 4)
+}
+
+// blocks is how many checksummed blocks the payload is split into
+func (h shardHeader) blocks() int64 {
+	return (int64(h.Length) + int64(h.BlockSize) - 1) / int64(h.BlockSize)
+}
+
+func (h shardHeader) encode() []byte {
+	buf := make([]byte, 0, h.size())
+	buf = append(buf, shardFileMagic...)
+	buf = append(buf, h.Version)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(h.ObjectID)))
+	buf = append(buf, h.ObjectID...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(h.VersionID)))
+	buf = append(buf, h.VersionID...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(h.Index))
+	buf = binary.BigEndian.AppendUint64(buf, h.Length)
+	buf = binary.BigEndian.AppendUint32(buf, h.BlockSize)
+	buf = binary.BigEndian.AppendUint32(buf, h.Checksum)
+	return binary.BigEndian.AppendUint32(buf, crc32.Checksum(buf, crc32c))
+}
+
+// errNoShardHeader is returned by readShardHeader for files written without a header
+var errNoShardHeader = errors.New("shard file has no header")
+
+// readShardHeader reads the header at the start of a shard file
+func readShardHeader(r io.Reader, path string) (shardHeader, error) {
+	var h shardHeader
+	prefix := make([]byte, len(shardFileMagic)+1)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return h, errNoShardHeader
+		}
+		return h, err
+	}
+	if string(prefix[:len(shardFileMagic)]) != shardFileMagic {
+		return h, errNoShardHeader
+	}
+	h.Version = prefix[len(shardFileMagic)]
+	if h.Version != shardFileVersion {
+		return h, &CorruptShardError{Path: path, Reason: fmt.Sprintf("unknown format version %d", h.Version)}
+	}
+
+	digest := crc32.New(crc32c)
+	digest.Write(prefix)
+	hr := io.TeeReader(r, digest)
+	truncated := &CorruptShardError{Path: path, Reason: "truncated header"}
+
+	readID := func() (string, error) {
+		var n uint16
+		if err := binary.Read(hr, binary.BigEndian, &n); err != nil {
+			return "", truncated
+		}
+		id := make([]byte, n)
+		if _, err := io.ReadFull(hr, id); err != nil {
+			return "", truncated
+		}
+		return string(id), nil
+	}
+	var err error
+	if h.ObjectID, err = readID(); err != nil {
+		return h, err
+	}
+	if h.VersionID, err = readID(); err != nil {
+		return h, err
+	}
+
+	fixed := make([]byte, h.size()-int64(len(shardFileMagic)+1+2+len(h.ObjectID)+2+len(h.VersionID)+4))
+	if _, err := io.ReadFull(hr, fixed); err != nil {
+		return h, truncated
+	}
+	h.Index = int(binary.BigEndian.Uint32(fixed[0:4]))
+	h.Length = binary.BigEndian.Uint64(fixed[4:12])
+	h.BlockSize = binary.BigEndian.Uint32(fixed[12:16])
+	h.Checksum = binary.BigEndian.Uint32(fixed[16:20])
+
+	var sum [4]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return h, truncated
+	}
+	if binary.BigEndian.Uint32(sum[:]) != digest.Sum32() {
+		return h, &CorruptShardError{Path: path, Reason: "header checksum mismatch"}
+	}
+	if h.BlockSize == 0 {
+		return h, &CorruptShardError{Path: path, Reason: "zero block size"}
+	}
+	return h, nil
+}
+
+// checkHeader checks that a header names the expected shard
+func checkHeader(h shardHeader, path, objectID, versionID string, shardIdx int) error {
+	if h.ObjectID != objectID || h.VersionID != versionID || h.Index != shardIdx {
+		return &CorruptShardError{Path: path, Reason: fmt.Sprintf("header names shard %d of %s version %s", h.Index, h.ObjectID, h.VersionID)}
+	}
+	return nil
+}
+
+// parseChecksums decodes the block checksum table of a file and checks it against the header
+func parseChecksums(table []byte, h shardHeader, path string) ([]uint32, error) {
+	if crc32.Checksum(table, crc32c) != h.Checksum {
+		return nil, &CorruptShardError{Path: path, Reason: "block checksum table mismatch"}
+	}
+	sums := make([]uint32, len(table)/4)
+	for i := range sums {
+		sums[i] = binary.BigEndian.Uint32(table[i*4:])
+	}
+	return sums, nil
+}
+
+// shardFile is an open shard file, positioned at the start of its payload
+type shardFile struct {
+	*os.File
+	header shardHeader
+	// offset is where the payload starts
+	offset int64
+	length int64
+	// sums are the block checksums of the payload
+	sums []uint32
+}
+
+// openShardFile opens a shard file and checks that its header names the expected shard
+// and that the file holds as many bytes as the header records
+func openShardFile(path, objectID, versionID string, shardIdx int) (*shardFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sf, err := checkShardFile(file, path, objectID, versionID, shardIdx)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return sf, nil
+}
+
+func checkShardFile(file *os.File, path, objectID, versionID string, shardIdx int) (*shardFile, error) {
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := readShardHeader(file, path)
+	if err == errNoShardHeader {
+		return nil, &CorruptShardError{Path: path, Reason: "missing header"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHeader(header, path, objectID, versionID, shardIdx); err != nil {
+		return nil, err
+	}
+
+	sf := &shardFile{File: file, header: header, offset: header.size(), length: int64(header.Length)}
+	size := sf.offset + sf.length + header.blocks()*4
+	switch {
+	case fi.Size() < size:
+		return nil, &CorruptShardError{Path: path, Reason: fmt.Sprintf("truncated file, %d of %d bytes", fi.Size(), size)}
+	case fi.Size() > size:
+		return nil, &CorruptShardError{Path: path, Reason: "trailing data after payload"}
+	}
+
+	table := make([]byte, header.blocks()*4)
+	if _, err := file.ReadAt(table, sf.offset+sf.length); err != nil {
+		return nil, err
+	}
+	if sf.sums, err = parseChecksums(table, header, path); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(sf.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return sf, nil
+}
+
+// blockReader reads the payload of a shard file, checking every block it reads from against its checksum
+type blockReader struct {
+	f     *shardFile
+	pos   int64
+	block int64
+	buf   []byte
+}
+
+func (r *blockReader) Read(p []byte) (int, error) {
+	if r.pos >= r.f.length {
+		return 0, io.EOF
+	}
+	blockSize := int64(r.f.header.BlockSize)
+	block := r.pos / blockSize
+	if block != r.block || r.buf == nil {
+		start := block * blockSize
+		buf := make([]byte, min(blockSize, r.f.length-start))
+		if _, err := r.f.ReadAt(buf, r.f.offset+start); err != nil {
+			if err == io.EOF {
+				err = &CorruptShardError{Path: r.f.Name(), Reason: "truncated payload"}
+			}
+			return 0, err
+		}
+		if crc32.Checksum(buf, crc32c) != r.f.sums[block] {
+			return 0, &CorruptShardError{Path: r.f.Name(), Reason: fmt.Sprintf("payload checksum mismatch in block %d", block)}
+		}
+		r.block, r.buf = block, buf
+	}
+
+	n := copy(p, r.buf[r.pos-block*blockSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *blockReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.f.length
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// payload returns a seekable reader for the payload, checked against its checksums
+func (f *shardFile) payload() *blockReader {
+	return &blockReader{f: f}
+}
+
+// localShardWriter writes a shard to a temporary file next to it, the shard replaces any previous
+// version of the file only once Close has synced it, so a crash never leaves a partly written shard behind
+type localShardWriter struct {
+	file   *os.File
+	path   string
+	header shardHeader
+	// digest checksums the block being written, sums holds the checksums of the blocks before it
+	digest hash.Hash32
+	sums   []byte
+	n      uint64
+	done   bool
+}
+
+func newLocalShardWriter(path, objectID, versionID string, shardIdx int) (*localShardWriter, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for shard: %w", err)
+	}
+	file, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create shard file: %w", err)
+	}
+
+	w := &localShardWriter{
+		file:   file,
+		path:   path,
+		header: shardHeader{Version: shardFileVersion, ObjectID: objectID, VersionID: versionID, Index: shardIdx, BlockSize: shardBlockSize},
+		digest: crc32.New(crc32c),
+	}
+	// The header is written again with the payload length and checksum once they are known
+	if _, err := file.Write(w.header.encode()); err != nil {
+		w.abort()
+		return nil, fmt.Errorf("failed to write shard header: %w", err)
+	}
+	return w, nil
+}
+
+func (w *localShardWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	for written := p[:n]; len(written) > 0; {
+		m := min(len(written), shardBlockSize-int(w.n%shardBlockSize))
+		w.digest.Write(written[:m])
+		w.n += uint64(m)
+		written = written[m:]
+		if w.n%shardBlockSize == 0 {
+			w.endBlock()
+		}
+	}
+	return n, err
+}
+
+// endBlock adds the checksum of the block written so far to the table
+func (w *localShardWriter) endBlock() {
+	w.sums = binary.BigEndian.AppendUint32(w.sums, w.digest.Sum32())
+	w.digest.Reset()
+}
+
+// Close completes the shard: the header is filled in, the file synced and renamed into place
+func (w *localShardWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	if w.n%shardBlockSize != 0 {
+		w.endBlock()
+	}
+	w.header.Length = w.n
+	w.header.Checksum = crc32.Checksum(w.sums, crc32c)
+	err := func() error {
+		if _, err := w.file.Write(w.sums); err != nil {
+			return err
+		}
+		if _, err := w.file.WriteAt(w.header.encode(), 0); err != nil {
+			return err
+		}
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(w.file.Name(), w.path); err != nil {
+			return err
+		}
+		return syncDir(filepath.Dir(w.path))
+	}()
+	if err != nil {
+		w.file.Close()
+		os.Remove(w.file.Name())
+		return err
+	}
+	return nil
+}
+
+// abort drops the shard, leaving any previous version of it in place
+func (w *localShardWriter) abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// syncDir flushes a directory, so a rename into it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// decodeShardFile checks a shard file read in full and returns its payload
+func decodeShardFile(data []byte, path, objectID, versionID string, shardIdx int) ([]byte, error) {
+	header, err := readShardHeader(bytes.NewReader(data), path)
+	if err == errNoShardHeader {
+		return nil, &CorruptShardError{Path: path, Reason: "missing header"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHeader(header, path, objectID, versionID, shardIdx); err != nil {
+		return nil, err
+	}
+
+	body := data[header.size():]
+	if uint64(len(body)) < header.Length {
+		return nil, &CorruptShardError{Path: path, Reason: fmt.Sprintf("payload is %d bytes, header records %d", len(body), header.Length)}
+	}
+	payload, table := body[:header.Length], body[header.Length:]
+	if int64(len(table)) != header.blocks()*4 {
+		return nil, &CorruptShardError{Path: path, Reason: fmt.Sprintf("block checksum table is %d bytes, expected %d", len(table), header.blocks()*4)}
+	}
+	sums, err := parseChecksums(table, header, path)
+	if err != nil {
+		return nil, err
+	}
+	for i, sum := range sums {
+		block := payload[int64(i)*int64(header.BlockSize) : min(int64(i+1)*int64(header.BlockSize), int64(len(payload)))]
+		if crc32.Checksum(block, crc32c) != sum {
+			return nil, &CorruptShardError{Path: path, Reason: fmt.Sprintf("payload checksum mismatch in block %d", i)}
+		}
+	}
+	return payload, nil
+}
@@ -0,0 +1,128 @@
+package sharding
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func storeTestShard(t *testing.T, store *LocalShardStore, payload []byte) string {
+	t.Helper()
+	if err := store.StoreShard("obj", "ver", 2, payload, "loc"); err != nil {
+		t.Fatal(err)
+	}
+	return store.shardPath("obj", "ver", 2, "loc")
+}
+
+func flipByte(t *testing.T, path string, offset int64) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShardReadsDetectCorruption(t *testing.T) {
+	payload := make([]byte, 3*shardBlockSize+100)
+	rand.Read(payload)
+	header := shardHeader{Version: shardFileVersion, ObjectID: "obj", VersionID: "ver", BlockSize: shardBlockSize}.size()
+	corrupt := int64(shardBlockSize + 10)
+
+	tests := []struct {
+		name    string
+		offset  int64
+		length  int64
+		corrupt bool
+	}{
+		{name: "whole shard", offset: 0, length: int64(len(payload)), corrupt: true},
+		{name: "range over the corrupt block", offset: shardBlockSize, length: 20, corrupt: true},
+		{name: "range ending on the last byte", offset: corrupt, length: int64(len(payload)) - corrupt, corrupt: true},
+		{name: "range before the corrupt block", offset: 10, length: shardBlockSize - 10},
+		{name: "range after the corrupt block", offset: 2 * shardBlockSize, length: shardBlockSize + 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewLocalShardStore(t.TempDir())
+			path := storeTestShard(t, store, payload)
+			flipByte(t, path, header+corrupt)
+
+			rc, err := store.OpenShardReader("obj", "ver", 2, "loc", tt.offset, tt.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+			// Readers that know the length never read up to EOF
+			got := make([]byte, tt.length)
+			_, err = io.ReadFull(rc, got)
+			if tt.corrupt {
+				if !IsCorruptShard(err) {
+					t.Fatalf("read returned %v, want a CorruptShardError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, payload[tt.offset:tt.offset+tt.length]) {
+				t.Fatal("read bytes differ from the payload")
+			}
+		})
+	}
+}
+
+func TestShardFileWithoutHeaderIsCorrupt(t *testing.T) {
+	store := NewLocalShardStore(t.TempDir())
+	path := store.shardPath("obj", "ver", 2, "loc")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("bare payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.RetrieveShard("obj", "ver", 2, "loc"); !IsCorruptShard(err) {
+		t.Fatalf("RetrieveShard returned %v, want a CorruptShardError", err)
+	}
+	if _, err := store.OpenShardReader("obj", "ver", 2, "loc", 0, 12); !IsCorruptShard(err) {
+		t.Fatalf("OpenShardReader returned %v, want a CorruptShardError", err)
+	}
+}
+
+func TestMigrateFlatLayoutAddsHeaders(t *testing.T) {
+	base := t.TempDir()
+	store := NewLocalShardStore(base)
+	payload := []byte("shard written before headers")
+	if err := os.MkdirAll(filepath.Join(base, "loc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(store.flatShardPath("obj", "ver", 2, "loc"), payload, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := MigrateFlatLayout(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Migrated != 1 {
+		t.Fatalf("migrated %d shards, want 1", result.Migrated)
+	}
+	got, err := store.RetrieveShard("obj", "ver", 2, "loc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("migrated payload differs")
+	}
+}
@@ -2,9 +2,10 @@ package sharding
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"strings"
+	"strconv"
 )
 
 // ShardStore is an interface for storing shards
@@ -15,6 +16,14 @@ type ShardStore interface {
 	DeleteShardByVersion(objectID, versionID string, shardIdx int, location string) error
 }
 
+// StreamingShardStore is implemented by shard stores that can write a shard incrementally
+// and read back parts of it, instead of handling shards as single slices
+type StreamingShardStore interface {
+	ShardStore
+	OpenShardWriter(objectID, versionID string, shardIdx int, location string) (io.WriteCloser, error)
+	OpenShardReader(objectID, versionID string, shardIdx int, location string, offset, length int64) (io.ReadCloser, error)
+}
+
 // LocalShardStore is a local implementation of ShardStore
 type LocalShardStore struct {
 	BasePath string
@@ -25,27 +34,75 @@ func NewLocalShardStore(basePath string) *LocalShardStore {
 	return &LocalShardStore{BasePath: basePath}
 }
 
+// shardPath returns the path of a shard in the fan-out layout, see layout.go
+func (store *LocalShardStore) shardPath(objectID, versionID string, shardIdx int, location string) string {
+	return filepath.Join(store.objectDir(objectID, location), versionID, strconv.Itoa(shardIdx))
+}
+
 // StoreShard stores a shard locally
+// The shard is written to a temporary file and renamed into place once synced, see localShardWriter
 func (store *LocalShardStore) StoreShard(objectID, versionID string, shardIdx int, shard []byte, location string) error {
-	// Record versions with each shard
-	shardPath := filepath.Join(store.BasePath, location, fmt.Sprintf("%s-v(%s)_shard_%d", objectID, versionID, shardIdx))
-	err := os.MkdirAll(filepath.Dir(shardPath), 0755)
+	w, err := newLocalShardWriter(store.shardPath(objectID, versionID, shardIdx, location), objectID, versionID, shardIdx)
 	if err != nil {
-		return fmt.Errorf("failed to create directory for shard: %w", err)
+		return err
 	}
 
-	err = os.WriteFile(shardPath, shard, 0644)
-	if err != nil {
+	if _, err := w.Write(shard); err != nil {
+		w.abort()
+		return fmt.Errorf("failed to write shard to file: %w", err)
+	}
+	if err := w.Close(); err != nil {
 		return fmt.Errorf("failed to write shard to file: %w", err)
 	}
 	return nil
 }
 
-// RetrieveShard retrieves a shard locally
+// OpenShardWriter creates a shard locally and returns a writer for its contents
+// The shard is complete once the writer has been closed
+func (store *LocalShardStore) OpenShardWriter(objectID, versionID string, shardIdx int, location string) (io.WriteCloser, error) {
+	return newLocalShardWriter(store.shardPath(objectID, versionID, shardIdx, location), objectID, versionID, shardIdx)
+}
+
+// OpenShard opens the payload of a shard, so it can be served without reading it in full
+// Every block read is checked against its checksum, see shardFile.payload
+func (store *LocalShardStore) OpenShard(objectID, versionID string, shardIdx int, location string) (io.ReadSeekCloser, error) {
+	sf, err := openShardFile(store.shardPath(objectID, versionID, shardIdx, location), objectID, versionID, shardIdx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shard from file: %w", err)
+	}
+	return struct {
+		io.ReadSeeker
+		io.Closer
+	}{sf.payload(), sf.File}, nil
+}
+
+// OpenShardReader opens length bytes of a shard starting at offset
+// The bytes are checked against the checksums of the blocks they fall in, reads fail with a CorruptShardError
+func (store *LocalShardStore) OpenShardReader(objectID, versionID string, shardIdx int, location string, offset, length int64) (io.ReadCloser, error) {
+	sf, err := openShardFile(store.shardPath(objectID, versionID, shardIdx, location), objectID, versionID, shardIdx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shard from file: %w", err)
+	}
+
+	payload := sf.payload()
+	if _, err := payload.Seek(offset, io.SeekStart); err != nil {
+		sf.Close()
+		return nil, fmt.Errorf("failed to read shard from file: %w", err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(payload, max(0, min(length, sf.length-offset))), sf.File}, nil
+}
+
+// RetrieveShard retrieves a shard locally, a shard failing its checks is reported as a CorruptShardError
 func (store *LocalShardStore) RetrieveShard(objectID, versionID string, shardIdx int, location string) ([]byte, error) {
-	// Record version with each shard
-	shardPath := filepath.Join(store.BasePath, location, fmt.Sprintf("%s-v(%s)_shard_%d", objectID, versionID, shardIdx))
-	shard, err := os.ReadFile(shardPath)
+	shardPath := store.shardPath(objectID, versionID, shardIdx, location)
+	data, err := os.ReadFile(shardPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shard from file: %w", err)
+	}
+	shard, err := decodeShardFile(data, shardPath, objectID, versionID, shardIdx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read shard from file: %w", err)
 	}
@@ -57,7 +114,7 @@ func (store *LocalShardStore) DeleteShardByVersion(objectID, versionID string, s
 	if location == "" {
 		return fmt.Errorf("invalid storage location")
 	}
-	shardPath := filepath.Join(store.BasePath, location, fmt.Sprintf("%s-v(%s)_shard_%d", objectID, versionID, shardIdx))
+	shardPath := store.shardPath(objectID, versionID, shardIdx, location)
 
 	err := os.Remove(shardPath)
 	if err != nil {
@@ -67,6 +124,8 @@ func (store *LocalShardStore) DeleteShardByVersion(objectID, versionID string, s
 		}
 		return fmt.Errorf("failed to delete shard file, %w", err)
 	}
+	// Drop the version and object directories once their last shard is gone, the prefix directories are kept
+	removeEmptyDirs(filepath.Dir(shardPath), filepath.Dir(store.objectDir(objectID, location)))
 	return nil
 }
 
@@ -76,24 +135,10 @@ func (store *LocalShardStore) DeleteShard(objectID string, shardIdx int, locatio
 		return fmt.Errorf("invalid storage location")
 	}
 
-	shardDir := filepath.Join(store.BasePath, location)
-
-	// Read all files in the directory
-	files, err := os.ReadDir(shardDir)
-	if err != nil {
-		return fmt.Errorf("failed to read shard directory: %w", err)
-	}
-
-	// Iterate and delete matching shards
-	for _, file := range files {
-		if strings.HasPrefix(file.Name(), objectID+"-v(") {
-			shardPath := filepath.Join(shardDir, file.Name())
-
-			err := os.Remove(shardPath)
-			if err != nil && !os.IsNotExist(err) {
-				return fmt.Errorf("failed to delete shard file %s: %w", shardPath, err)
-			}
-		}
+	// Every version of the object lives under its own directory
+	objectDir := store.objectDir(objectID, location)
+	if err := os.RemoveAll(objectDir); err != nil {
+		return fmt.Errorf("failed to delete shards of object %s: %w", objectID, err)
 	}
 	return nil
 }
@@ -0,0 +1,256 @@
+package shardtest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+)
+
+// ErrInjected is the error returned by shards configured to fail without an error of their own
+var ErrInjected = errors.New("injected shard fault")
+
+// FaultKind is what happens to a shard hit by a fault
+type FaultKind int
+
+const (
+	// Fail returns an error, ErrInjected unless the fault has its own
+	Fail FaultKind = iota + 1
+	// Drop loses the shard: writes report success without storing anything, reads find no shard
+	Drop
+	// Corrupt flips the bits of the last byte of the shard, or of the range read from it
+	Corrupt
+	// Delay waits for the fault's Delay before going on as usual
+	Delay
+)
+
+// Op selects the operations a fault applies to
+type Op int
+
+const (
+	Writes Op = 1 << iota
+	Reads
+	// Both is used for faults that don't name their operations
+	Both = Writes | Reads
+)
+
+// Fault describes how a shard misbehaves
+type Fault struct {
+	Kind FaultKind
+	// On is the operations hit by the fault, all of them when it is 0
+	On    Op
+	Delay time.Duration
+	Err   error
+}
+
+func (f Fault) applies(op Op) bool {
+	on := f.On
+	if on == 0 {
+		on = Both
+	}
+	return f.Kind != 0 && on&op != 0
+}
+
+func (f Fault) err(key sharding.ShardKey) error {
+	err := f.Err
+	if err == nil {
+		err = ErrInjected
+	}
+	return fmt.Errorf("shard %s: %w", key, err)
+}
+
+// FaultyShardStore wraps a ShardStore and injects faults into chosen shard indexes or locations
+// Shards without a fault are handed to the wrapped store untouched. It is safe for concurrent use
+type FaultyShardStore struct {
+	store sharding.ShardStore
+
+	mu         sync.Mutex
+	indexes    map[int]Fault
+	locations  map[string]Fault
+	injections int
+}
+
+// NewFaultyShardStore wraps store, no faults are configured yet
+func NewFaultyShardStore(store sharding.ShardStore) *FaultyShardStore {
+	return &FaultyShardStore{
+		store:     store,
+		indexes:   make(map[int]Fault),
+		locations: make(map[string]Fault),
+	}
+}
+
+// SetShardFault applies fault to every shard with index shardIdx, in every location
+func (s *FaultyShardStore) SetShardFault(shardIdx int, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.indexes[shardIdx] = fault
+}
+
+// SetLocationFault applies fault to every shard kept at location, as if its node misbehaved
+func (s *FaultyShardStore) SetLocationFault(location string, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locations[location] = fault
+}
+
+// ClearFaults removes every configured fault
+func (s *FaultyShardStore) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.indexes = make(map[int]Fault)
+	s.locations = make(map[string]Fault)
+}
+
+// Injections returns how many operations were hit by a fault
+func (s *FaultyShardStore) Injections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.injections
+}
+
+// fault returns the fault hitting an operation on a shard, a fault set on the shard index wins over one set on its location
+// Delays are served here, so callers only have to handle the other kinds
+func (s *FaultyShardStore) fault(op Op, shardIdx int, location string) Fault {
+	s.mu.Lock()
+	fault, ok := s.indexes[shardIdx]
+	if !ok || !fault.applies(op) {
+		fault = s.locations[location]
+	}
+	if !fault.applies(op) {
+		s.mu.Unlock()
+		return Fault{}
+	}
+	s.injections++
+	s.mu.Unlock()
+
+	if fault.Kind == Delay {
+		time.Sleep(fault.Delay)
+		return Fault{}
+	}
+	return fault
+}
+
+func corrupt(data []byte) []byte {
+	data = bytes.Clone(data)
+	if len(data) > 0 {
+		data[len(data)-1] ^= 0xff
+	}
+	return data
+}
+
+func (s *FaultyShardStore) StoreShard(objectID, versionID string, shardIdx int, shard []byte, location string) error {
+	switch fault := s.fault(Writes, shardIdx, location); fault.Kind {
+	case Fail:
+		return fault.err(memoryKey(objectID, versionID, shardIdx, location))
+	case Drop:
+		return nil
+	case Corrupt:
+		shard = corrupt(shard)
+	}
+	return s.store.StoreShard(objectID, versionID, shardIdx, shard, location)
+}
+
+func (s *FaultyShardStore) RetrieveShard(objectID, versionID string, shardIdx int, location string) ([]byte, error) {
+	fault := s.fault(Reads, shardIdx, location)
+	switch fault.Kind {
+	case Fail:
+		return nil, fault.err(memoryKey(objectID, versionID, shardIdx, location))
+	case Drop:
+		return nil, fmt.Errorf("shard %s: %w", memoryKey(objectID, versionID, shardIdx, location), sharding.ErrShardNotFound)
+	}
+
+	shard, err := s.store.RetrieveShard(objectID, versionID, shardIdx, location)
+	if err == nil && fault.Kind == Corrupt {
+		shard = corrupt(shard)
+	}
+	return shard, err
+}
+
+// OpenShardWriter streams to the wrapped store when it is a StreamingShardStore, and buffers the shard otherwise
+// Writers of corrupted shards always buffer, the last byte is only known once they are closed
+func (s *FaultyShardStore) OpenShardWriter(objectID, versionID string, shardIdx int, location string) (io.WriteCloser, error) {
+	fault := s.fault(Writes, shardIdx, location)
+	switch fault.Kind {
+	case Fail:
+		return nil, fault.err(memoryKey(objectID, versionID, shardIdx, location))
+	case Drop:
+		return &faultyShardWriter{}, nil
+	case Corrupt:
+		return &faultyShardWriter{commit: func(shard []byte) error {
+			return s.store.StoreShard(objectID, versionID, shardIdx, corrupt(shard), location)
+		}}, nil
+	}
+
+	if streaming, ok := s.store.(sharding.StreamingShardStore); ok {
+		return streaming.OpenShardWriter(objectID, versionID, shardIdx, location)
+	}
+	return &faultyShardWriter{commit: func(shard []byte) error {
+		return s.store.StoreShard(objectID, versionID, shardIdx, shard, location)
+	}}, nil
+}
+
+// OpenShardReader reads through the wrapped store when it is a StreamingShardStore, and slices the whole shard otherwise
+func (s *FaultyShardStore) OpenShardReader(objectID, versionID string, shardIdx int, location string, offset, length int64) (io.ReadCloser, error) {
+	fault := s.fault(Reads, shardIdx, location)
+	switch fault.Kind {
+	case Fail:
+		return nil, fault.err(memoryKey(objectID, versionID, shardIdx, location))
+	case Drop:
+		return nil, fmt.Errorf("shard %s: %w", memoryKey(objectID, versionID, shardIdx, location), sharding.ErrShardNotFound)
+	}
+
+	var part []byte
+	if streaming, ok := s.store.(sharding.StreamingShardStore); ok {
+		rc, err := streaming.OpenShardReader(objectID, versionID, shardIdx, location, offset, length)
+		if err != nil || fault.Kind != Corrupt {
+			return rc, err
+		}
+		defer rc.Close()
+		if part, err = io.ReadAll(rc); err != nil {
+			return nil, err
+		}
+	} else {
+		shard, err := s.store.RetrieveShard(objectID, versionID, shardIdx, location)
+		if err != nil {
+			return nil, err
+		}
+		if offset < 0 || offset > int64(len(shard)) {
+			return nil, fmt.Errorf("offset %d is outside of shard %d of %s", offset, shardIdx, objectID)
+		}
+		part = shard[offset:min(offset+length, int64(len(shard)))]
+	}
+
+	if fault.Kind == Corrupt {
+		part = corrupt(part)
+	}
+	return io.NopCloser(bytes.NewReader(part)), nil
+}
+
+// DeleteShardByVersion and DeleteShard are never faulted
+func (s *FaultyShardStore) DeleteShardByVersion(objectID, versionID string, shardIdx int, location string) error {
+	return s.store.DeleteShardByVersion(objectID, versionID, shardIdx, location)
+}
+
+func (s *FaultyShardStore) DeleteShard(objectID string, shardIdx int, location string) error {
+	return s.store.DeleteShard(objectID, shardIdx, location)
+}
+
+// faultyShardWriter buffers a shard and hands it to commit once closed, a nil commit drops the shard
+type faultyShardWriter struct {
+	bytes.Buffer
+	commit func([]byte) error
+	closed bool
+}
+
+func (w *faultyShardWriter) Close() error {
+	if w.closed || w.commit == nil {
+		w.closed = true
+		return nil
+	}
+	w.closed = true
+	return w.commit(w.Bytes())
+}
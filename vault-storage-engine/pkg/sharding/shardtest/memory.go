@@ -0,0 +1,135 @@
+// Package shardtest has shard stores for exercising the storage pipeline without disks or storage nodes
+// MemoryShardStore keeps shards in memory and FaultyShardStore wraps another store to lose, corrupt,
+// delay or fail chosen shards. They are meant for tests and local development only
+package shardtest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding"
+)
+
+// MemoryShardStore is a sharding.StreamingShardStore keeping every shard in memory
+// It is safe for concurrent use
+type MemoryShardStore struct {
+	mu     sync.RWMutex
+	shards map[sharding.ShardKey][]byte
+}
+
+// NewMemoryShardStore creates an empty MemoryShardStore
+func NewMemoryShardStore() *MemoryShardStore {
+	return &MemoryShardStore{shards: make(map[sharding.ShardKey][]byte)}
+}
+
+func memoryKey(objectID, versionID string, shardIdx int, location string) sharding.ShardKey {
+	return sharding.ShardKey{Location: location, ObjectID: objectID, VersionID: versionID, Index: shardIdx}
+}
+
+// StoreShard stores a copy of shard
+func (s *MemoryShardStore) StoreShard(objectID, versionID string, shardIdx int, shard []byte, location string) error {
+	s.Put(memoryKey(objectID, versionID, shardIdx, location), shard)
+	return nil
+}
+
+// RetrieveShard returns a copy of a stored shard
+func (s *MemoryShardStore) RetrieveShard(objectID, versionID string, shardIdx int, location string) ([]byte, error) {
+	shard, ok := s.Get(memoryKey(objectID, versionID, shardIdx, location))
+	if !ok {
+		return nil, fmt.Errorf("failed to read shard %d of %s: %w", shardIdx, objectID, sharding.ErrShardNotFound)
+	}
+	return shard, nil
+}
+
+// OpenShardWriter returns a writer buffering a shard, the shard is stored once the writer is closed
+func (s *MemoryShardStore) OpenShardWriter(objectID, versionID string, shardIdx int, location string) (io.WriteCloser, error) {
+	return &memoryShardWriter{store: s, key: memoryKey(objectID, versionID, shardIdx, location)}, nil
+}
+
+// OpenShardReader opens length bytes of a stored shard starting at offset
+func (s *MemoryShardStore) OpenShardReader(objectID, versionID string, shardIdx int, location string, offset, length int64) (io.ReadCloser, error) {
+	shard, err := s.RetrieveShard(objectID, versionID, shardIdx, location)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset > int64(len(shard)) {
+		return nil, fmt.Errorf("offset %d is outside of shard %d of %s", offset, shardIdx, objectID)
+	}
+	return io.NopCloser(io.LimitReader(bytes.NewReader(shard[offset:]), length)), nil
+}
+
+// DeleteShardByVersion deletes a shard of a version, deleting a shard that isn't stored succeeds
+func (s *MemoryShardStore) DeleteShardByVersion(objectID, versionID string, shardIdx int, location string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.shards, memoryKey(objectID, versionID, shardIdx, location))
+	return nil
+}
+
+// DeleteShard deletes every shard of an object kept at location, like LocalShardStore does
+func (s *MemoryShardStore) DeleteShard(objectID string, shardIdx int, location string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.shards {
+		if key.ObjectID == objectID && key.Location == location {
+			delete(s.shards, key)
+		}
+	}
+	return nil
+}
+
+// Put stores a copy of a shard under key, overwriting it if it is already stored
+func (s *MemoryShardStore) Put(key sharding.ShardKey, shard []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shards[key] = bytes.Clone(shard)
+}
+
+// Get returns a copy of the shard stored under key
+func (s *MemoryShardStore) Get(key sharding.ShardKey) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	shard, ok := s.shards[key]
+	return bytes.Clone(shard), ok
+}
+
+// Keys returns the keys of every stored shard, sorted by their string form
+func (s *MemoryShardStore) Keys() []sharding.ShardKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]sharding.ShardKey, 0, len(s.shards))
+	for key := range s.shards {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return strings.Compare(keys[i].String(), keys[j].String()) < 0
+	})
+	return keys
+}
+
+// Len returns how many shards are stored
+func (s *MemoryShardStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.shards)
+}
+
+type memoryShardWriter struct {
+	bytes.Buffer
+	store  *MemoryShardStore
+	key    sharding.ShardKey
+	closed bool
+}
+
+func (w *memoryShardWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.store.Put(w.key, w.Bytes())
+	return nil
+}
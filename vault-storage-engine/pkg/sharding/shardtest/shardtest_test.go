@@ -0,0 +1,183 @@
+package shardtest_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/datastorage"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/sharding/shardtest"
+	"go.uber.org/zap"
+)
+
+// scenario is a fault hitting some shards of a version, count picks how many from the profile
+type scenario struct {
+	name  string
+	fault shardtest.Fault
+	count func(p erasurecoding.Profile) int
+	fails bool
+}
+
+func parity(p erasurecoding.Profile) int { return p.ParityShards }
+
+var scenarios = []scenario{
+	{name: "lost", fault: shardtest.Fault{Kind: shardtest.Fail, On: shardtest.Reads}, count: parity},
+	{name: "dropped", fault: shardtest.Fault{Kind: shardtest.Drop, On: shardtest.Writes}, count: parity},
+	{name: "slow", fault: shardtest.Fault{Kind: shardtest.Delay, On: shardtest.Reads, Delay: 20 * time.Millisecond}, count: parity},
+	{name: "corrupt on read", fault: shardtest.Fault{Kind: shardtest.Corrupt, On: shardtest.Reads}, count: parity},
+	{name: "corrupt at rest", fault: shardtest.Fault{Kind: shardtest.Corrupt, On: shardtest.Writes}, count: parity},
+	{name: "too many lost", fault: shardtest.Fault{Kind: shardtest.Fail, On: shardtest.Reads}, count: func(p erasurecoding.Profile) int { return p.ParityShards + 1 }, fails: true},
+	{name: "too many corrupt", fault: shardtest.Fault{Kind: shardtest.Corrupt, On: shardtest.Reads}, count: func(p erasurecoding.Profile) int { return p.ParityShards + 1 }, fails: true},
+}
+
+var profiles = []erasurecoding.Profile{
+	erasurecoding.ScratchProfile,
+	erasurecoding.StandardProfile,
+	erasurecoding.ArchiveProfile,
+	erasurecoding.MediaProfile,
+}
+
+func newTestConfig(t *testing.T) *config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return &config.Config{
+		EncryptionKey:   key,
+		KeyringPath:     filepath.Join(dir, "keyring.json"),
+		ManifestKeyPath: filepath.Join(dir, "manifest.key"),
+		// Small stripes give every version several stripes and several read windows
+		StripeSize: 16 << 10,
+	}
+}
+
+func TestRetrieveWithFaultyShards(t *testing.T) {
+	data := make([]byte, 300<<10+123)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, profile := range profiles {
+		for _, dedup := range []bool{false, true} {
+			for _, sc := range scenarios {
+				name := fmt.Sprintf("%s/%s", profile, sc.name)
+				if dedup {
+					name = fmt.Sprintf("%s/dedup/%s", profile, sc.name)
+				}
+				t.Run(name, func(t *testing.T) {
+					cfg := newTestConfig(t)
+					db, err := bucket.OpenDB(filepath.Join(t.TempDir(), "metadata.db"))
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer db.Close()
+					if err := bucket.CreateBucketWithOptions(db, "bucket", "owner", profile, dedup); err != nil {
+						t.Fatal(err)
+					}
+
+					locations := make([]string, profile.Total())
+					for i := range locations {
+						locations[i] = fmt.Sprintf("node%d", i)
+					}
+					// Data shards come first and are read first, faulting them forces parity shards to be used
+					store := shardtest.NewFaultyShardStore(shardtest.NewMemoryShardStore())
+					for idx := 0; idx < sc.count(profile); idx++ {
+						store.SetShardFault(idx, sc.fault)
+					}
+
+					logger := zap.NewNop()
+					versionID, _, _, err := datastorage.StoreData(db, data, "bucket", "object", "object.bin", store, cfg, locations, logger)
+					if err != nil {
+						t.Fatalf("StoreData: %v", err)
+					}
+
+					got, _, err := datastorage.RetrieveData(db, "bucket", "object", versionID, store, cfg, logger)
+					if sc.fails {
+						if err == nil {
+							t.Fatal("RetrieveData succeeded with more faulty shards than parity shards")
+						}
+						return
+					}
+					if err != nil {
+						t.Fatalf("RetrieveData: %v", err)
+					}
+					if !bytes.Equal(got, data) {
+						t.Fatal("retrieved data differs from the stored data")
+					}
+					if store.Injections() == 0 {
+						t.Fatal("no fault was injected")
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestStoreDataRoundTripsPayloadEdges(t *testing.T) {
+	leadingZero := make([]byte, 40<<10)
+	trailingZero := make([]byte, 40<<10)
+	for i := 0; i < len(leadingZero)/2; i++ {
+		leadingZero[len(leadingZero)/2+i] = byte(i%251 + 1)
+		trailingZero[i] = byte(i%251 + 1)
+	}
+	payloads := []struct {
+		name string
+		data []byte
+	}{
+		{name: "all zero", data: make([]byte, 40<<10)},
+		{name: "leading zero", data: leadingZero},
+		{name: "trailing zero", data: trailingZero},
+		{name: "one non zero byte", data: []byte{0x5a}},
+		{name: "one zero byte", data: []byte{0}},
+		{name: "empty", data: []byte{}},
+	}
+
+	for _, profile := range profiles {
+		for _, dedup := range []bool{false, true} {
+			for _, payload := range payloads {
+				name := fmt.Sprintf("%s/%s", profile, payload.name)
+				if dedup {
+					name = fmt.Sprintf("%s/dedup/%s", profile, payload.name)
+				}
+				t.Run(name, func(t *testing.T) {
+					cfg := newTestConfig(t)
+					db, err := bucket.OpenDB(filepath.Join(t.TempDir(), "metadata.db"))
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer db.Close()
+					if err := bucket.CreateBucketWithOptions(db, "bucket", "owner", profile, dedup); err != nil {
+						t.Fatal(err)
+					}
+
+					locations := make([]string, profile.Total())
+					for i := range locations {
+						locations[i] = fmt.Sprintf("node%d", i)
+					}
+					store := shardtest.NewMemoryShardStore()
+
+					logger := zap.NewNop()
+					versionID, _, _, err := datastorage.StoreData(db, payload.data, "bucket", "object", "object.bin", store, cfg, locations, logger)
+					if err != nil {
+						t.Fatalf("StoreData: %v", err)
+					}
+					got, _, err := datastorage.RetrieveData(db, "bucket", "object", versionID, store, cfg, logger)
+					if err != nil {
+						t.Fatalf("RetrieveData: %v", err)
+					}
+					if !bytes.Equal(got, payload.data) {
+						t.Fatalf("retrieved %d bytes differing from the %d stored", len(got), len(payload.data))
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Package sigv4 signs and verifies requests with AWS Signature Version 4, as spoken by S3-compatible stores
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	algorithm = "AWS4-HMAC-SHA256"
+	// TimeFormat is the format of the X-Amz-Date header
+	TimeFormat = "20060102T150405Z"
+	dateFormat = "20060102"
+	// UnsignedPayload is sent instead of the payload hash when the body isn't signed
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// EmptyPayload is the hash of an empty body
+	EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Credentials are the keys requests are signed with
+type Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// HashPayload returns the hex SHA-256 of a request body, as sent in X-Amz-Content-Sha256
+func HashPayload(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign adds the X-Amz-* headers and the Authorization header of a request for service in region
+// payloadHash is the hex SHA-256 of the body, or UnsignedPayload
+func Sign(req *http.Request, creds Credentials, region, service, payloadHash string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	signed := signedHeaders(req.Header)
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", now.Format(dateFormat), region, service)
+	signature := computeSignature(req.Method, req.URL.EscapedPath(), req.URL.Query(), host, req.Header, signed, payloadHash, now, scope, creds.SecretKey, region, service)
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, creds.AccessKey, scope, strings.Join(signed, ";"), signature))
+}
+
+// ErrSignatureMismatch is returned by Verify when a request wasn't signed with the expected secret key
+var ErrSignatureMismatch = errors.New("signature does not match")
+
+// Verify checks the Authorization header of a request received by a server
+// secretKey looks up the secret key of the access key the request claims to be signed with
+// It returns the access key the request was signed with
+func Verify(r *http.Request, secretKey func(accessKey string) (string, bool)) (string, error) {
+	auth := r.Header.Get("Authorization")
+	rest, ok := strings.CutPrefix(auth, algorithm+" ")
+	if !ok {
+		return "", errors.New("missing or unsupported authorization")
+	}
+
+	var credential, signedList, signature string
+	for _, part := range strings.Split(rest, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch name {
+		case "Credential":
+			credential = value
+		case "SignedHeaders":
+			signedList = value
+		case "Signature":
+			signature = value
+		}
+	}
+
+	// Credential is <access key>/<date>/<region>/<service>/aws4_request
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" || signedList == "" || signature == "" {
+		return "", errors.New("malformed authorization")
+	}
+	accessKey, region, service := parts[0], parts[2], parts[3]
+	secret, ok := secretKey(accessKey)
+	if !ok {
+		return "", fmt.Errorf("unknown access key %q", accessKey)
+	}
+
+	now, err := time.Parse(TimeFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return "", errors.New("missing or malformed X-Amz-Date")
+	}
+	if now.Format(dateFormat) != parts[1] {
+		return "", errors.New("credential date doesn't match X-Amz-Date")
+	}
+
+	// The path is taken as sent, before the server decoded it
+	path, _, _ := strings.Cut(r.RequestURI, "?")
+	signed := strings.Split(signedList, ";")
+	scope := strings.Join(parts[1:], "/")
+	expected := computeSignature(r.Method, path, r.URL.Query(), r.Host, r.Header, signed, r.Header.Get("X-Amz-Content-Sha256"), now, scope, secret, region, service)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", ErrSignatureMismatch
+	}
+	return accessKey, nil
+}
+
+// signedHeaders lists the headers that are signed, the host, the X-Amz-* headers and the headers S3 interprets
+func signedHeaders(header http.Header) []string {
+	signed := []string{"host"}
+	for name := range header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" || lower == "content-type" || lower == "content-md5" {
+			signed = append(signed, lower)
+		}
+	}
+	sort.Strings(signed)
+	return signed
+}
+
+func computeSignature(method, path string, query url.Values, host string, header http.Header, signed []string, payloadHash string, now time.Time, scope, secret, region, service string) string {
+	if path == "" {
+		path = "/"
+	}
+
+	var headers strings.Builder
+	for _, name := range signed {
+		value := host
+		if name != "host" {
+			value = strings.Join(header.Values(name), ",")
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		path,
+		canonicalQuery(query),
+		headers.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{algorithm, now.Format(TimeFormat), scope, hex.EncodeToString(hash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret), now.Format(dateFormat))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, URIEncode(name, true)+"="+URIEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// URIEncode encodes a string the way SigV4 expects, every byte but the unreserved characters is escaped
+// Slashes are kept when encodeSlash is false, as they are in object keys
+func URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
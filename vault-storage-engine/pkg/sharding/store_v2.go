@@ -0,0 +1,165 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ShardKey identifies a shard, shard Index of a version of an object, kept at Location
+type ShardKey struct {
+	Location  string
+	ObjectID  string
+	VersionID string
+	Index     int
+}
+
+func (k ShardKey) String() string {
+	return fmt.Sprintf("%s/%s-v(%s)_shard_%d", k.Location, k.ObjectID, k.VersionID, k.Index)
+}
+
+// ShardInfo describes a stored shard
+type ShardInfo struct {
+	Key     ShardKey
+	Size    int64
+	ModTime time.Time
+}
+
+// ErrShardNotFound is returned for shards that aren't stored, it matches os.ErrNotExist too
+var ErrShardNotFound = fmt.Errorf("shard not found: %w", os.ErrNotExist)
+
+// ShardStoreV2 stores shards as streams, every call can be cancelled through its context
+// Shards never have to fit in memory, which ShardStore requires
+type ShardStoreV2 interface {
+	// PutShard stores a shard read from r, size is the length of the shard or -1 when it isn't known
+	// A shard is only stored once PutShard succeeds, a failed or cancelled put leaves nothing behind
+	PutShard(ctx context.Context, key ShardKey, r io.Reader, size int64) error
+	// GetShard opens a shard for reading
+	GetShard(ctx context.Context, key ShardKey) (io.ReadCloser, error)
+	// GetShardRange opens length bytes of a shard starting at offset
+	GetShardRange(ctx context.Context, key ShardKey, offset, length int64) (io.ReadCloser, error)
+	// StatShard returns the size of a shard and when it was stored
+	StatShard(ctx context.Context, key ShardKey) (ShardInfo, error)
+	// ListShards lists the shards kept at a location, only those of objectID unless it is empty
+	ListShards(ctx context.Context, location, objectID string) ([]ShardInfo, error)
+	// DeleteShard deletes a shard, deleting a shard that isn't stored succeeds
+	DeleteShard(ctx context.Context, key ShardKey) error
+}
+
+// shardName returns the name a shard is stored under within its location
+func shardName(objectID, versionID string, shardIdx int) string {
+	return fmt.Sprintf("%s-v(%s)_shard_%d", objectID, versionID, shardIdx)
+}
+
+// parseShardName is the reverse of shardName
+func parseShardName(name string) (objectID, versionID string, shardIdx int, ok bool) {
+	start := strings.Index(name, "-v(")
+	end := strings.LastIndex(name, ")_shard_")
+	if start <= 0 || end < start+3 {
+		return "", "", 0, false
+	}
+	shardIdx, err := strconv.Atoi(name[end+len(")_shard_"):])
+	if err != nil || shardIdx < 0 {
+		return "", "", 0, false
+	}
+	return name[:start], name[start+3 : end], shardIdx, true
+}
+
+// contextReader fails reads once its context is done, so a copy through it stops when a request is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+type contextReadCloser struct {
+	contextReader
+	io.Closer
+}
+
+func withContext(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	return &contextReadCloser{contextReader{ctx, rc}, rc}
+}
+
+// errSizeMismatch is returned by PutShard when the reader doesn't hold exactly size bytes
+var errSizeMismatch = errors.New("shard size mismatch")
+
+// OpenShardSeeker opens a shard of a ShardStoreV2 for random access
+// Nothing is read until the first read, every read after a seek opens a new range of the shard,
+// which is what http.ServeContent needs to answer ranged requests
+func OpenShardSeeker(ctx context.Context, store ShardStoreV2, key ShardKey) (io.ReadSeekCloser, ShardInfo, error) {
+	info, err := store.StatShard(ctx, key)
+	if err != nil {
+		return nil, ShardInfo{}, err
+	}
+	return &shardSeeker{ctx: ctx, store: store, key: key, size: info.Size}, info, nil
+}
+
+type shardSeeker struct {
+	ctx    context.Context
+	store  ShardStoreV2
+	key    ShardKey
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (s *shardSeeker) Read(p []byte) (int, error) {
+	if s.offset >= s.size {
+		return 0, io.EOF
+	}
+	if s.body == nil {
+		body, err := s.store.GetShardRange(s.ctx, s.key, s.offset, s.size-s.offset)
+		if err != nil {
+			return 0, err
+		}
+		s.body = body
+	}
+
+	n, err := s.body.Read(p)
+	s.offset += int64(n)
+	if err == io.EOF && s.offset < s.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (s *shardSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != s.offset {
+		s.Close()
+		s.offset = offset
+	}
+	return offset, nil
+}
+
+func (s *shardSeeker) Close() error {
+	if s.body == nil {
+		return nil
+	}
+	err := s.body.Close()
+	s.body = nil
+	return err
+}
@@ -1,14 +1,17 @@
 package utils
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"sync"
 
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
 	"github.com/spf13/viper"
@@ -30,10 +33,30 @@ func ConvertSliceToMap(slice []string) map[string]string {
 // ConvertViperToConfig converts a viper.Viper instance to a config.Config instance
 func ConvertViperToConfig(v *viper.Viper) *config.Config {
 	cfg := &config.Config{
-		ServerAddress:      v.GetString("server_address"),
-		ShardStoreBasePath: v.GetString("shard_store_base_path"),
-		EncryptionKeyHex:   v.GetString("encryption_key"),
-		Database:           v.GetString("database"),
+		ServerAddress:       v.GetString("server_address"),
+		ShardStoreBasePath:  v.GetString("shard_store_base_path"),
+		EncryptionKeyHex:    v.GetString("encryption_key"),
+		KeyProvider:         v.GetString("key_provider"),
+		KeyringPath:         v.GetString("keyring_path"),
+		KMSURL:              v.GetString("kms_url"),
+		KMSToken:            v.GetString("kms_token"),
+		KMSKeyID:            v.GetString("kms_key_id"),
+		Database:            v.GetString("database"),
+		StripeSize:          v.GetInt("stripe_size"),
+		WriteQuorum:         v.GetInt("write_quorum"),
+		HedgePercentile:     v.GetFloat64("hedge_percentile"),
+		Compression:         v.GetString("compression"),
+		CompressionLevel:    v.GetInt("compression_level"),
+		AdaptiveCompression: v.GetBool("adaptive_compression"),
+		CompressionMinGain:  v.GetFloat64("compression_min_gain"),
+		ShardStore:          v.GetString("shard_store"),
+		S3Endpoint:          v.GetString("s3_endpoint"),
+		S3Region:            v.GetString("s3_region"),
+		S3Bucket:            v.GetString("s3_bucket"),
+		S3AccessKey:         v.GetString("s3_access_key"),
+		S3SecretKey:         v.GetString("s3_secret_key"),
+		S3PathStyle:         v.GetBool("s3_path_style"),
+		S3Prefix:            v.GetString("s3_prefix"),
 	}
 
 	// Decode the hex-encoded encryption key
@@ -100,6 +123,48 @@ func InitTracer(serviceName string) func() {
 	}
 }
 
-func ReadAllWithBuffer(r io.ReadCloser) ([]byte, error) {
-	return nil, nil
+// DefaultMaxReadSize is the most ReadAllWithBuffer reads before giving up
+const DefaultMaxReadSize = 1 << 30
+
+const (
+	// pooledBufferSize is what pooled buffers start at, enough for the shard of a default stripe
+	pooledBufferSize = 64 << 10
+	// maxPooledBufferSize keeps buffers that grew for an unusually large read out of the pool
+	maxPooledBufferSize = 8 << 20
+)
+
+// ErrReadTooLarge is returned by ReadAllWithBuffer when the reader holds more than the allowed size
+var ErrReadTooLarge = errors.New("read exceeds the maximum size")
+
+var readBuffers = sync.Pool{
+	New: func() any {
+		return bytes.NewBuffer(make([]byte, 0, pooledBufferSize))
+	},
+}
+
+// ReadAllWithBuffer reads r until EOF, like io.ReadAll, through a pooled buffer
+// Reading into a reused buffer leaves a single allocation of the exact size for the result,
+// instead of the repeated growth of io.ReadAll. Readers holding more than DefaultMaxReadSize fail with ErrReadTooLarge
+func ReadAllWithBuffer(r io.Reader) ([]byte, error) {
+	return ReadAllWithLimit(r, DefaultMaxReadSize)
+}
+
+// ReadAllWithLimit is ReadAllWithBuffer for readers holding at most maxSize bytes
+func ReadAllWithLimit(r io.Reader, maxSize int64) ([]byte, error) {
+	buf := readBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledBufferSize {
+			readBuffers.Put(buf)
+		}
+	}()
+
+	n, err := buf.ReadFrom(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSize {
+		return nil, fmt.Errorf("%w of %d bytes", ErrReadTooLarge, maxSize)
+	}
+	return bytes.Clone(buf.Bytes()), nil
 }
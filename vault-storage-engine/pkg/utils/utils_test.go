@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadAllWithBufferReusesBuffers(t *testing.T) {
+	data := bytes.Repeat([]byte{7}, 1<<20)
+
+	// The pool may drop buffers at any time, a buffer grown by a read only has to come back eventually
+	for attempt := 0; attempt < 20; attempt++ {
+		got, err := ReadAllWithBuffer(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("read data differs")
+		}
+
+		buf := readBuffers.Get().(*bytes.Buffer)
+		reused := buf.Cap() >= len(data)
+		readBuffers.Put(buf)
+		if reused {
+			return
+		}
+	}
+	t.Fatal("the buffer of a read never went back to the pool")
+}
+
+func TestReadAllWithBufferDropsLargeBuffers(t *testing.T) {
+	data := make([]byte, maxPooledBufferSize+1)
+	if _, err := ReadAllWithBuffer(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if buf := readBuffers.Get().(*bytes.Buffer); buf.Cap() > maxPooledBufferSize {
+			t.Fatalf("pooled buffer of %d bytes", buf.Cap())
+		}
+	}
+}
+
+func TestReadAllWithBufferResultsDontShareBuffers(t *testing.T) {
+	first, err := ReadAllWithBuffer(bytes.NewReader([]byte("first read")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadAllWithBuffer(bytes.NewReader([]byte("second read overwriting the buffer"))); err != nil {
+		t.Fatal(err)
+	}
+	if string(first) != "first read" {
+		t.Fatalf("first result changed to %q by the second read", first)
+	}
+}
+
+func TestReadAllWithLimit(t *testing.T) {
+	readErr := errors.New("read failed")
+	tests := []struct {
+		name    string
+		r       io.Reader
+		want    []byte
+		wantErr error
+	}{
+		{name: "empty", r: bytes.NewReader(nil), want: []byte{}},
+		{name: "under the limit", r: bytes.NewReader(make([]byte, 999)), want: make([]byte, 999)},
+		{name: "at the limit", r: bytes.NewReader(make([]byte, 1000)), want: make([]byte, 1000)},
+		{name: "over the limit", r: bytes.NewReader(make([]byte, 1001)), wantErr: ErrReadTooLarge},
+		{name: "endless reader", r: endless{}, wantErr: ErrReadTooLarge},
+		{name: "failing reader", r: io.MultiReader(bytes.NewReader(make([]byte, 10)), iotest.ErrReader(readErr)), wantErr: readErr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadAllWithLimit(tt.r, 1000)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ReadAllWithLimit returned %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("read %d bytes, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+// endless is a reader that never ends
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func TestReadAllWithBufferConcurrently(t *testing.T) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			// Every goroutine reads its own bytes, at sizes that make pooled buffers grow and get reused
+			for i := 0; i < 50; i++ {
+				data := bytes.Repeat([]byte{byte(g)}, (g+1)*(i+1)*1000)
+				got, err := ReadAllWithBuffer(bytes.NewReader(data))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(got, data) {
+					errs <- errors.New("read data differs")
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
@@ -6,7 +6,9 @@ import (
 
 	bucket_cli "github.com/getvaultapp/storage-engine/vault-storage-engine/cmd/vault_cli/bucket_management"
 	metadata_cli "github.com/getvaultapp/storage-engine/vault-storage-engine/cmd/vault_cli/handling_metadata"
+	key_cli "github.com/getvaultapp/storage-engine/vault-storage-engine/cmd/vault_cli/key_management"
 	object_cli "github.com/getvaultapp/storage-engine/vault-storage-engine/cmd/vault_cli/object_management"
+	shard_cli "github.com/getvaultapp/storage-engine/vault-storage-engine/cmd/vault_cli/shard_management"
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/bucket"
 	"github.com/getvaultapp/storage-engine/vault-storage-engine/pkg/config"
 	"github.com/urfave/cli/v2"
@@ -31,7 +33,7 @@ func RunCli() {
 		Commands: []*cli.Command{
 			{
 				Name:  "create-bucket",
-				Usage: "Create an empty bucket. Usage: create-bucket <bukcet_id> <owner_id>",
+				Usage: "Create an empty bucket, add dedup to deduplicate its versions. Usage: create-bucket <bukcet_id> <owner_id> [erasure_profile] [dedup]",
 				Action: func(c *cli.Context) error {
 					return bucket_cli.NewBucketCommand(c, db)
 				},
@@ -106,6 +108,72 @@ func RunCli() {
 					return bucket_cli.DeleteBucket(c, db, cfg, logger)
 				},
 			},
+			{
+				Name:  "rotate-key",
+				Usage: "Rotates the key encryption key and re-wraps every data key under the new key version. Usage: rotate-key",
+				Action: func(c *cli.Context) error {
+					return key_cli.RotateKeyCommand(c, db, cfg, logger)
+				},
+			},
+			{
+				Name:  "rewrap-keys",
+				Usage: "Resumes re-wrapping data keys under the current key version. Usage: rewrap-keys",
+				Action: func(c *cli.Context) error {
+					return key_cli.RewrapKeysCommand(c, db, cfg, logger)
+				},
+			},
+			{
+				Name:  "key-status",
+				Usage: "Shows how many object versions and chunks use each key version. Usage: key-status",
+				Action: func(c *cli.Context) error {
+					return key_cli.KeyStatusCommand(c, db)
+				},
+			},
+			{
+				Name:  "retire-key",
+				Usage: "Drops a key version no data key is wrapped under anymore from the keyring, including the configured master key. Usage: retire-key <key_id>",
+				Action: func(c *cli.Context) error {
+					return key_cli.RetireKeyCommand(c, db, cfg)
+				},
+			},
+			{
+				Name:  "migrate-shard-layout",
+				Usage: "Moves the shards of a local shard store from the flat layout to hash-prefixed per-object directories, run it while the store is offline. Usage: migrate-shard-layout [shard-store-path]",
+				Action: func(c *cli.Context) error {
+					return shard_cli.MigrateShardLayoutCommand(c, cfg)
+				},
+			},
+			{
+				Name:  "gc-chunks",
+				Usage: "Deletes the chunks of deduplicated buckets no version refers to anymore. Usage: gc-chunks",
+				Action: func(c *cli.Context) error {
+					return shard_cli.GCChunksCommand(c, db, cfg, logger)
+				},
+			},
+			{
+				Name:  "verify-manifest",
+				Usage: "Checks the signature of a manifest file, or of the stored manifests of a version, against the node key or the given public key. Usage: verify-manifest <manifest_file> [public_key] or verify-manifest <object_id> <version_id> [public_key]",
+				Action: func(c *cli.Context) error {
+					return shard_cli.VerifyManifestCommand(c, db, cfg, logger)
+				},
+			},
+			{
+				Name:  "manifest-key",
+				Usage: "Prints the public key manifests are signed with, to keep in manifest_public_keys for recover-metadata. Usage: manifest-key",
+				Action: func(c *cli.Context) error {
+					return shard_cli.ManifestKeyCommand(c, cfg)
+				},
+			},
+			{
+				Name:  "recover-metadata",
+				Usage: "Rebuilds the buckets, objects and versions of a lost database from the manifests kept with the shards, crawling local shard locations or storage nodes. Only manifests signed by a given public key or one of manifest_public_keys are trusted. Usage: recover-metadata [--public-key key] local [location...] or recover-metadata [--public-key key] nodes [node_url...]",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{Name: "public-key", Usage: "Hex encoded Ed25519 public key manifests have to be signed with, can be repeated"},
+				},
+				Action: func(c *cli.Context) error {
+					return shard_cli.RecoverMetadataCommand(c, db, cfg, logger)
+				},
+			},
 		},
 	}
 